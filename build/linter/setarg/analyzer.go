@@ -0,0 +1,96 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package setarg
+
+import (
+	"go/ast"
+	"go/types"
+
+	"github.com/pingcap/tidb/build/linter/util"
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+)
+
+// expressionPkgPath is the path of the package defining `ScalarFunction`.
+const expressionPkgPath = "github.com/pingcap/tidb/pkg/expression"
+
+// Analyzer defines the linter for `setarg` check
+//
+// This linter avoids assigning to the args of a `ScalarFunction` in place, like `sf.GetArgs()[i] = arg`, because
+// the function caches the result of `SafeToShareAcrossSession`, which may be stale for the new arg.
+// `ScalarFunction.SetArg` should be used instead, which clears the cached result.
+var Analyzer = &analysis.Analyzer{
+	Name:     "setarg",
+	Doc:      `Avoid assigning to the args of a scalar function in place.`,
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+func run(pass *analysis.Pass) (any, error) {
+	inspect := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+
+	nodeFilter := []ast.Node{
+		(*ast.AssignStmt)(nil),
+	}
+	inspect.Preorder(nodeFilter, func(n ast.Node) {
+		assign, ok := n.(*ast.AssignStmt)
+		if !ok {
+			return
+		}
+
+		for _, lhs := range assign.Lhs {
+			index, ok := ast.Unparen(lhs).(*ast.IndexExpr)
+			if !ok {
+				continue
+			}
+			if isScalarFunctionGetArgs(pass.TypesInfo, index.X) {
+				pass.Reportf(lhs.Pos(), "avoid assigning to the args of a scalar function in place. Please use `ScalarFunction.SetArg()` instead")
+			}
+		}
+	})
+
+	return nil, nil
+}
+
+// isScalarFunctionGetArgs returns whether the expression is a call of `ScalarFunction.GetArgs`.
+func isScalarFunctionGetArgs(info *types.Info, expr ast.Expr) bool {
+	call, ok := ast.Unparen(expr).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "GetArgs" {
+		return false
+	}
+	selection, ok := info.Selections[sel]
+	if !ok {
+		return false
+	}
+	recv := selection.Recv()
+	if ptr, ok := recv.(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Name() == "ScalarFunction" && obj.Pkg() != nil && obj.Pkg().Path() == expressionPkgPath
+}
+
+func init() {
+	util.SkipAnalyzerByConfig(Analyzer)
+}
@@ -0,0 +1,39 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expression
+
+// Expression is a test struct.
+type Expression interface{}
+
+// ScalarFunction is a test struct.
+type ScalarFunction struct {
+	args []Expression
+}
+
+// GetArgs returns the args of the function.
+func (sf *ScalarFunction) GetArgs() []Expression {
+	return sf.args
+}
+
+// SetArg replaces the i-th arg of the function.
+func (sf *ScalarFunction) SetArg(i int, arg Expression) {
+	sf.args[i] = arg
+}
+
+func testFunc() {
+	sf := &ScalarFunction{args: make([]Expression, 2)}
+	sf.GetArgs()[0] = nil // want `avoid assigning to the args of a scalar function in place.*`
+	sf.SetArg(1, nil)
+}
@@ -0,0 +1,51 @@
+// Copyright 2026 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package t
+
+import (
+	"github.com/pingcap/tidb/pkg/expression"
+)
+
+// Function is a test struct whose args can be assigned in place.
+type Function struct {
+	args []expression.Expression
+}
+
+// GetArgs returns the args of the function.
+func (f *Function) GetArgs() []expression.Expression {
+	return f.args
+}
+
+func foldArg(arg expression.Expression) (expression.Expression, bool) {
+	return arg, false
+}
+
+func testFunc() {
+	var expr expression.Expression
+	var isConst bool
+	sf := &expression.ScalarFunction{}
+
+	sf.GetArgs()[0] = expr                                                     // want `avoid assigning to the args of a scalar function in place.*`
+	(sf.GetArgs())[1] = expr                                                   // want `avoid assigning to the args of a scalar function in place.*`
+	expression.Expression(sf).(*expression.ScalarFunction).GetArgs()[0] = expr // want `avoid assigning to the args of a scalar function in place.*`
+	sf.GetArgs()[0], isConst = foldArg(expr)                                   // want `avoid assigning to the args of a scalar function in place.*`
+	sf.SetArg(0, expr)
+	args := sf.GetArgs()
+	_ = args[0]
+
+	f := &Function{}
+	f.GetArgs()[0] = expr
+	_ = isConst
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
+	"github.com/pingcap/tidb/pkg/errno"
 	"github.com/pingcap/tidb/pkg/executor/aggregate"
 	"github.com/pingcap/tidb/pkg/session"
 	"github.com/pingcap/tidb/pkg/testkit"
@@ -476,3 +477,34 @@ func TestIssue50849(t *testing.T) {
 	// Check the error contains stack information
 	require.True(t, errors.HasStack(err))
 }
+
+func TestGroupingWithRollup(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use test")
+	tk.MustExec("drop table if exists t")
+	tk.MustExec("create table t(a int, b int)")
+	tk.MustExec("insert into t values (1, 1), (1, 2), (1, null), (2, 1)")
+
+	// the real NULL of `b` in the group (1, NULL) is distinguished from the super-aggregate rows by GROUPING.
+	tk.MustQuery("select a, b, count(*), grouping(a), grouping(b), grouping(a, b), grouping(b, a) from t " +
+		"group by a, b with rollup").Sort().Check(testkit.Rows(
+		"1 1 1 0 0 0 0",
+		"1 2 1 0 0 0 0",
+		"1 <nil> 1 0 0 0 0",
+		"1 <nil> 3 0 1 1 2",
+		"2 1 1 0 0 0 0",
+		"2 <nil> 1 0 1 1 2",
+		"<nil> <nil> 4 1 1 3 3",
+	))
+	tk.MustQuery("select a, b, count(*) from t group by a, b with rollup having grouping(b) = 1").Sort().Check(testkit.Rows(
+		"1 <nil> 3",
+		"2 <nil> 1",
+		"<nil> <nil> 4",
+	))
+
+	// GROUPING is only valid in the queries with ROLLUP, and its args must be the grouping columns.
+	tk.MustGetErrCode("select a, grouping(a) from t group by a", errno.ErrInvalidGroupFuncUse)
+	tk.MustGetErrCode("select grouping(a) from t", errno.ErrInvalidGroupFuncUse)
+	tk.MustGetErrCode("select a, grouping(b) from t group by a with rollup", errno.ErrFieldInGroupingNotGroupBy)
+}
@@ -72,6 +72,12 @@ func (*baseBuiltinFunc) SafeToShareAcrossSession() bool {
 	return false
 }
 
+// ResetSafeToShareFlag implements the builtinFunc interface.
+// It clears the cached result of `SafeToShareAcrossSession`, so that it is recomputed from the current args.
+func (b *baseBuiltinFunc) ResetSafeToShareFlag() {
+	atomic.StoreUint32(&b.safeToShareAcrossSessionFlag, 0)
+}
+
 func (b *baseBuiltinFunc) PbCode() tipb.ScalarFuncSig {
 	return b.pbCode
 }
@@ -544,6 +550,10 @@ type builtinFunc interface {
 	vecBuiltinFunc
 	SafeToShareAcrossSession
 
+	// ResetSafeToShareFlag clears the cached result of `SafeToShareAcrossSession`.
+	// It must be called whenever the args are replaced in place.
+	ResetSafeToShareFlag()
+
 	// evalInt evaluates int result of builtinFunc by given row.
 	evalInt(ctx EvalContext, row chunk.Row) (val int64, isNull bool, err error)
 	// evalReal evaluates real representation of builtinFunc by given row.
@@ -535,8 +535,17 @@ func TestJSONOverlaps(t *testing.T) {
 		{[]any{`[[1,2], 3]`, `[1,[2,3]]`}, 0, nil},
 		{[]any{`[[1,2], 3]`, `[1,3]`}, 1, nil},
 		{[]any{`{"a":1,"b":10,"d":10}`, `{"a":5,"e":10,"f":1,"d":20}`}, 0, nil},
+		{[]any{`{"a":1,"b":10,"d":10}`, `{"a":5,"d":10}`}, 1, nil},
+		{[]any{`{"a":{"b":[1,2]}}`, `{"c":1,"a":{"b":[1,2]}}`}, 1, nil},
+		{[]any{`{"a":{"b":[1,2]}}`, `{"a":{"b":[1]}}`}, 0, nil},
+		{[]any{`{}`, `{}`}, 0, nil},
+		{[]any{`{"a":1}`, `1`}, 0, nil},
+		{[]any{`{"a":1}`, `{"a":1.0}`}, 1, nil},
 		{[]any{`[4,5,"6",7]`, `6`}, 0, nil},
 		{[]any{`[4,5,6,7]`, `"6"`}, 0, nil},
+		{[]any{`[4,5,6,7]`, `6.0`}, 1, nil},
+		{[]any{`[]`, `1`}, 0, nil},
+		{[]any{`[null]`, `null`}, 1, nil},
 
 		{[]any{`[2,3]`, `[1, 2]`}, 1, nil},
 		{[]any{`[2]`, `[1, 2]`}, 1, nil},
@@ -161,6 +161,24 @@ func TestUUID(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestNondeterministicFuncsNotShared(t *testing.T) {
+	ctx := createContext(t)
+	// the signatures carry the per-session semantics, though they only have the base field
+	for _, c := range []struct {
+		funcName string
+		args     []types.Datum
+	}{
+		{ast.UUID, nil},
+		{ast.Sleep, types.MakeDatums(0)},
+		{ast.LastInsertId, nil},
+		{ast.LastInsertId, types.MakeDatums(1)},
+	} {
+		f, err := funcs[c.funcName].getFunction(ctx, datumsToConstants(c.args))
+		require.NoError(t, err)
+		require.False(t, f.SafeToShareAcrossSession(), c.funcName)
+	}
+}
+
 func TestAnyValue(t *testing.T) {
 	ctx := createContext(t)
 	tbl := []struct {
@@ -318,6 +336,45 @@ func TestInet6AtoN(t *testing.T) {
 	require.True(t, r.IsNull())
 }
 
+func TestInet6RoundTrip(t *testing.T) {
+	ctx := createContext(t)
+	atonFc, ntoaFc := funcs[ast.Inet6Aton], funcs[ast.Inet6Ntoa]
+	tests := []struct {
+		ip        string
+		binary    []byte
+		canonical string
+	}{
+		{"::1", []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, "::1"},
+		{"0:0:0:0:0:0:0:1", []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, "::1"},
+		// the IPv4-mapped address keeps its 16 bytes and the dotted notation
+		{"::ffff:1.2.3.4", []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x01, 0x02, 0x03, 0x04}, "::ffff:1.2.3.4"},
+		{"1.2.3.4", []byte{0x01, 0x02, 0x03, 0x04}, "1.2.3.4"},
+	}
+	for _, test := range tests {
+		aton, err := atonFc.getFunction(ctx, datumsToConstants([]types.Datum{types.NewStringDatum(test.ip)}))
+		require.NoError(t, err)
+		require.True(t, aton.SafeToShareAcrossSession())
+		binary, err := evalBuiltinFunc(aton, ctx, chunk.Row{})
+		require.NoError(t, err)
+		require.Equal(t, test.binary, binary.GetBytes(), test.ip)
+
+		ntoa, err := ntoaFc.getFunction(ctx, datumsToConstants([]types.Datum{types.NewBytesDatum(binary.GetBytes())}))
+		require.NoError(t, err)
+		require.True(t, ntoa.SafeToShareAcrossSession())
+		ip, err := evalBuiltinFunc(ntoa, ctx, chunk.Row{})
+		require.NoError(t, err)
+		require.Equal(t, test.canonical, ip.GetString(), test.ip)
+	}
+
+	// the malformed addresses are rejected like MySQL
+	for _, ip := range []string{"::1::", "1.2.3.4.5", "gggg::1", "::ffff:1.2.3"} {
+		aton, err := atonFc.getFunction(ctx, datumsToConstants([]types.Datum{types.NewStringDatum(ip)}))
+		require.NoError(t, err)
+		_, err = evalBuiltinFunc(aton, ctx, chunk.Row{})
+		require.True(t, terror.ErrorEqual(err, errWrongValueForType), ip)
+	}
+}
+
 func TestIsIPv4Mapped(t *testing.T) {
 	ctx := createContext(t)
 	tests := []struct {
@@ -623,3 +680,37 @@ func TestTidbShard(t *testing.T) {
 		require.Error(t, err)
 	}
 }
+
+func TestVitessHash(t *testing.T) {
+	ctx := createContext(t)
+	fc := funcs[ast.VitessHash]
+	// the known answers of the vitess `hash` vindex
+	tests := []struct {
+		arg    types.Datum
+		expect uint64
+	}{
+		{types.NewIntDatum(30375298039), 0x031265661E5F1133},
+		{types.NewIntDatum(1123), 0x031B565D41BDF8CA},
+		{types.NewIntDatum(30573721600), 0x1EFD6439F2050FFD},
+		{types.NewIntDatum(116), 0x1E1788FF0FDE093C},
+		{types.NewUintDatum(math.MaxUint64), 0x355550B2150E2451},
+		// the negative value is hashed as its two's complement, like vitess does
+		{types.NewIntDatum(-1), 0x355550B2150E2451},
+	}
+	for _, test := range tests {
+		f, err := fc.getFunction(ctx, datumsToConstants([]types.Datum{test.arg}))
+		require.NoError(t, err)
+		require.True(t, mysql.HasUnsignedFlag(f.getRetTp().GetFlag()))
+		d, err := evalBuiltinFunc(f, ctx, chunk.Row{})
+		require.NoError(t, err)
+		require.Equal(t, types.KindUint64, d.Kind())
+		require.Equal(t, test.expect, d.GetUint64(), test.arg)
+	}
+
+	f, err := fc.getFunction(ctx, datumsToConstants([]types.Datum{types.NewDatum(nil)}))
+	require.NoError(t, err)
+	d, err := evalBuiltinFunc(f, ctx, chunk.Row{})
+	require.NoError(t, err)
+	require.True(t, d.IsNull())
+	require.True(t, f.SafeToShareAcrossSession())
+}
@@ -16,6 +16,7 @@ package expression
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -78,6 +79,7 @@ var (
 	_ builtinFunc = &builtinValuesDurationSig{}
 	_ builtinFunc = &builtinValuesJSONSig{}
 	_ builtinFunc = &builtinBitCountSig{}
+	_ builtinFunc = &builtinBitCountStringSig{}
 	_ builtinFunc = &builtinGetParamStringSig{}
 )
 
@@ -1719,6 +1721,18 @@ func (c *bitCountFunctionClass) getFunction(ctx BuildContext, args []Expression)
 	if err := c.verifyArgs(args); err != nil {
 		return nil, err
 	}
+	// Like MySQL 8.0, the binary string is evaluated as a string of bits rather than a number, unless it is a
+	// hexadecimal or bit literal.
+	argTp := args[0].GetType(ctx.GetEvalCtx())
+	if types.IsBinaryStr(argTp) && !argTp.Hybrid() && !IsBinaryLiteral(args[0]) {
+		bf, err := newBaseBuiltinFuncWithTp(ctx, c.funcName, args, types.ETInt, types.ETString)
+		if err != nil {
+			return nil, err
+		}
+		bf.tp.SetFlen(bitCountStringFlen(argTp.GetFlen()))
+		sig := &builtinBitCountStringSig{bf}
+		return sig, nil
+	}
 	bf, err := newBaseBuiltinFuncWithTp(ctx, c.funcName, args, types.ETInt, types.ETInt)
 	if err != nil {
 		return nil, err
@@ -1728,6 +1742,15 @@ func (c *bitCountFunctionClass) getFunction(ctx BuildContext, args []Expression)
 	return sig, nil
 }
 
+// bitCountStringFlen returns the display width of BIT_COUNT of a binary string of `argFlen` bytes, that is, the count
+// of the digits of the max bit count, or `mysql.MaxIntWidth` if the length is unknown.
+func bitCountStringFlen(argFlen int) int {
+	if argFlen < 0 {
+		return mysql.MaxIntWidth
+	}
+	return min(len(strconv.FormatInt(int64(argFlen)*8, 10)), mysql.MaxIntWidth)
+}
+
 type builtinBitCountSig struct {
 	baseBuiltinFunc
 	// NOTE: Any new fields added here must be thread-safe or immutable during execution,
@@ -1754,6 +1777,29 @@ func (b *builtinBitCountSig) evalInt(ctx EvalContext, row chunk.Row) (int64, boo
 	return bitCount(n), false, nil
 }
 
+type builtinBitCountStringSig struct {
+	baseBuiltinFunc
+	// NOTE: Any new fields added here must be thread-safe or immutable during execution,
+	// as this expression may be shared across sessions.
+	// If a field does not meet these requirements, set SafeToShareAcrossSession to false.
+}
+
+func (b *builtinBitCountStringSig) Clone() builtinFunc {
+	newSig := &builtinBitCountStringSig{}
+	newSig.cloneFrom(&b.baseBuiltinFunc)
+	return newSig
+}
+
+// evalInt evals BIT_COUNT(N) of a binary string, which counts the set bits of all its bytes.
+// See https://dev.mysql.com/doc/refman/8.0/en/bit-functions.html#bit-operations-binary-string-evaluation
+func (b *builtinBitCountStringSig) evalInt(ctx EvalContext, row chunk.Row) (int64, bool, error) {
+	s, isNull, err := b.args[0].EvalString(ctx, row)
+	if err != nil || isNull {
+		return 0, true, err
+	}
+	return bitCountBytes(s), false, nil
+}
+
 // getParamFunctionClass for plan cache of prepared statements
 type getParamFunctionClass struct {
 	baseFunctionClass
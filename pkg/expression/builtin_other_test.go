@@ -15,12 +15,15 @@
 package expression
 
 import (
+	"bytes"
 	"math"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/pingcap/tidb/pkg/expression/exprctx"
 	"github.com/pingcap/tidb/pkg/parser/ast"
+	"github.com/pingcap/tidb/pkg/parser/charset"
 	"github.com/pingcap/tidb/pkg/parser/mysql"
 	"github.com/pingcap/tidb/pkg/types"
 	"github.com/pingcap/tidb/pkg/util/chunk"
@@ -74,6 +77,61 @@ func TestBitCount(t *testing.T) {
 	}
 }
 
+func TestBitCountString(t *testing.T) {
+	ctx := createContext(t)
+	fc := funcs[ast.BitCount]
+	// the results are the same as MySQL 8.0
+	tests := []struct {
+		origin any
+		count  any
+	}{
+		{[]byte(""), int64(0)},
+		{[]byte("a"), int64(3)},
+		{[]byte("10"), int64(5)},
+		{[]byte("é"), int64(8)},
+		{[]byte("数据"), int64(26)},
+		{[]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, int64(72)},
+		{[]byte{0x00, 0x01, 0x80}, int64(2)},
+	}
+	for _, test := range tests {
+		f, err := fc.getFunction(ctx, datumsToConstants(types.MakeDatums(test.origin)))
+		require.NoError(t, err)
+		require.IsType(t, &builtinBitCountStringSig{}, f)
+		require.True(t, f.SafeToShareAcrossSession())
+		count, err := evalBuiltinFunc(f, ctx, chunk.Row{})
+		require.NoError(t, err)
+		require.Equal(t, test.count, count.GetValue(), test.origin)
+	}
+
+	// the display width fits the count of the set bits of a large value
+	largeTp := types.NewFieldTypeBuilder().SetType(mysql.TypeVarString).SetFlen(2000).
+		SetCharset(charset.CharsetBin).SetCollate(charset.CollationBin).AddFlag(mysql.BinaryFlag).BuildP()
+	large := &Constant{Value: types.NewBytesDatum(bytes.Repeat([]byte{0xFF}, 2000)), RetType: largeTp}
+	f, err := fc.getFunction(ctx, []Expression{large})
+	require.NoError(t, err)
+	require.Equal(t, 5, f.getRetTp().GetFlen())
+	count, err := evalBuiltinFunc(f, ctx, chunk.Row{})
+	require.NoError(t, err)
+	require.Equal(t, int64(16000), count.GetInt64())
+	require.Len(t, strconv.FormatInt(count.GetInt64(), 10), f.getRetTp().GetFlen())
+	require.Equal(t, mysql.MaxIntWidth, bitCountStringFlen(types.UnspecifiedLength))
+	require.Equal(t, 1, bitCountStringFlen(0))
+	require.Equal(t, 11, bitCountStringFlen(mysql.MaxLongBlobWidth))
+
+	// the non-binary string and the hexadecimal literal are still evaluated as numbers
+	f, err = fc.getFunction(ctx, datumsToConstants(types.MakeDatums("10")))
+	require.NoError(t, err)
+	require.IsType(t, &builtinBitCountSig{}, f)
+	count, err = evalBuiltinFunc(f, ctx, chunk.Row{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count.GetInt64())
+	hexLit, err := types.ParseHexStr("0x3130")
+	require.NoError(t, err)
+	f, err = fc.getFunction(ctx, datumsToConstants([]types.Datum{types.NewBinaryLiteralDatum(hexLit)}))
+	require.NoError(t, err)
+	require.IsType(t, &builtinBitCountSig{}, f)
+}
+
 func TestRowFunc(t *testing.T) {
 	ctx := createContext(t)
 	fc := funcs[ast.RowFunc]
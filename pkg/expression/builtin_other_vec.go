@@ -15,6 +15,7 @@
 package expression
 
 import (
+	"math/bits"
 	"strings"
 
 	"github.com/pingcap/errors"
@@ -90,6 +91,16 @@ func bitCount(value int64) int64 {
 	value = value & 0x7f
 	return value
 }
+
+// bitCountBytes returns the number of bits that are set in all the bytes of 's'.
+func bitCountBytes(s string) int64 {
+	count := 0
+	for i := 0; i < len(s); i++ {
+		count += bits.OnesCount8(s[i])
+	}
+	return int64(count)
+}
+
 func (b *builtinBitCountSig) vectorized() bool {
 	return true
 }
@@ -121,6 +132,32 @@ func (b *builtinBitCountSig) vecEvalInt(ctx EvalContext, input *chunk.Chunk, res
 	return nil
 }
 
+func (b *builtinBitCountStringSig) vectorized() bool {
+	return true
+}
+
+func (b *builtinBitCountStringSig) vecEvalInt(ctx EvalContext, input *chunk.Chunk, result *chunk.Column) error {
+	n := input.NumRows()
+	buf, err := b.bufAllocator.get()
+	if err != nil {
+		return err
+	}
+	defer b.bufAllocator.put(buf)
+	if err := b.args[0].VecEvalString(ctx, input, buf); err != nil {
+		return err
+	}
+	result.ResizeInt64(n, false)
+	result.MergeNulls(buf)
+	i64s := result.Int64s()
+	for i := 0; i < n; i++ {
+		if result.IsNull(i) {
+			continue
+		}
+		i64s[i] = bitCountBytes(buf.GetString(i))
+	}
+	return nil
+}
+
 func (b *builtinGetParamStringSig) vectorized() bool {
 	return true
 }
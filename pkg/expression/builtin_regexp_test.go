@@ -1002,6 +1002,7 @@ func TestRegexpReplace(t *testing.T) {
 		{"seafood fool", "foo(.?)", "123", int64(3), "sea123 123", "0x73656131323320313233", nil}, // index 5
 		{"seafood fool", "foo(.?)", "123", int64(5), "seafood 123", "0x736561666F6F6420313233", nil},
 		{"seafood fool", "foo(.?)", "123", int64(10), "seafood fool", "0x736561666F6F6420666F6F6C", nil},
+		{"abc", "", "cc", int64(2), nil, nil, ErrRegexp},
 		{"seafood fool", "foo(.?)", "z\\12", int64(3), "seazd2 zl2", "0x7365617A6432207A6C32", nil},
 		{"seafood fool", "foo(.?)", "z\\12", int64(5), "seafood zl2", "0x736561666F6F64207A6C32", nil},
 		// Invalid position index tests
@@ -1055,6 +1056,9 @@ func TestRegexpReplace(t *testing.T) {
 		{"abc abd", "ab.", "cc", int64(1), int64(0), "cc cc", "0x6363206363", nil},
 		{"abc abd abe", "ab.", "cc", int64(3), int64(2), "abc abd cc", "0x61626320616264206363", nil},
 		{"abc abd abe", "ab.", "cc", int64(3), int64(10), "abc abd abe", "0x6162632061626420616265", nil},
+		{"abc abd", "ab.", "cc", int64(1), int64(3), "abc abd", "0x61626320616264", nil},
+		{"abc abd", "ab.", "cc", int64(5), int64(2), "abc abd", "0x61626320616264", nil},
+		{"abc", "", "cc", int64(1), int64(10), nil, nil, ErrRegexp},
 		{"你好 好啊", "好", "的", int64(1), int64(1), "你的 好啊", "0xE4BDA0E79A8420E5A5BDE5958A", nil}, // index 5
 		{"你好 好啊", "好", "的", int64(3), int64(1), "你好 的啊", "0xE4BDA0E79A8420E5A5BDE5958A", nil},
 		{"seafood fool", "foo(.?)", "123", int64(1), int(1), "sea123 fool", "0x73656131323320666F6F6C", nil},
@@ -1120,6 +1124,16 @@ func TestRegexpReplace(t *testing.T) {
 		{"abc abd abe", "(.)", "cc", int64(4), int64(1), "cii", "abcccabd abe", "0x616263636361626420616265", nil},
 		{"\n", ".", "cc", int64(1), int64(0), "s", "cc", "0x6363", nil},
 		{"好的 好滴 好~", ".", "的", int64(1), int64(0), "msi", "的的的的的的的的", "0xE79A84E79A84E79A84E79A84E79A84E79A84E79A84E79A84", nil},
+		// Multiline anchors, the occurrence beyond the count of matches and the rightmost of the contradictory flags wins
+		{"ab\nAB\nab", "^ab$", "x", int64(1), int64(0), "im", "x\nx\nx", "0x780A780A78", nil},
+		{"ab\nAB\nab", "^ab$", "x", int64(1), int64(2), "im", "ab\nx\nab", "0x61620A780A6162", nil},
+		{"ab\nAB\nab", "^ab$", "x", int64(1), int64(4), "im", "ab\nAB\nab", "0x61620A41420A6162", nil},
+		{"ab\nAB\nab", "^ab$", "x", int64(4), int64(1), "im", "ab\nx\nab", "0x61620A780A6162", nil},
+		{"ab\nAB", "^ab$", "x", int64(1), int64(0), "i", "ab\nAB", "0x61620A4142", nil},
+		{"ab\nAB", "^ab$", "x", int64(1), int64(0), "mic", "x\nAB", "0x780A4142", nil},
+		{"ab\nAB", "^ab$", "x", int64(1), int64(0), "mci", "x\nx", "0x780A78", nil},
+		// Empty pattern is invalid
+		{"a", "", "a", int64(1), int64(0), "im", nil, nil, ErrRegexp},
 		// Test invalid matchType
 		{"abc", "ab.", "cc", int64(1), int64(0), "p", nil, nil, ErrRegexp},
 		// Some nullable input tests
@@ -1157,7 +1171,7 @@ func TestRegexpReplaceVec(t *testing.T) {
 	var repl []string = []string{"cc", "的", "a\\12"}
 	var position []int = []int{1, 5}
 	var occurrence []int = []int{-1, 5}
-	var matchType []string = []string{"m", "i", "icc", "cii", "s", "msi"}
+	var matchType []string = []string{"m", "i", "icc", "cii", "s", "msi", "im", "mci"}
 
 	args := make([]any, 0)
 	args = append(args, any(expr))
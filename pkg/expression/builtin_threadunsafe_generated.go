@@ -17,77 +17,77 @@
 package expression
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinArithmeticMultiplyRealSig) SafeToShareAcrossSession() bool {
+func (s *builtinAddSubDateAsStringSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinGreatestCmpStringAsTimeSig) SafeToShareAcrossSession() bool {
+func (s *builtinAddSubDateDatetimeAnySig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinGreatestTimeSig) SafeToShareAcrossSession() bool {
+func (s *builtinAddSubDateDurationAnySig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinLeastCmpStringAsTimeSig) SafeToShareAcrossSession() bool {
+func (s *builtinAesDecryptIVSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinLeastTimeSig) SafeToShareAcrossSession() bool {
+func (s *builtinAesDecryptSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinIntervalIntSig) SafeToShareAcrossSession() bool {
+func (s *builtinAesEncryptIVSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinIntervalRealSig) SafeToShareAcrossSession() bool {
+func (s *builtinAesEncryptSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinInternalFromBinarySig) SafeToShareAcrossSession() bool {
+func (s *builtinArithmeticMultiplyRealSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinAesDecryptSig) SafeToShareAcrossSession() bool {
+func (s *builtinBenchmarkSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinAesDecryptIVSig) SafeToShareAcrossSession() bool {
+func (s *builtinConcatSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinAesEncryptSig) SafeToShareAcrossSession() bool {
+func (s *builtinConcatWSSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinAesEncryptIVSig) SafeToShareAcrossSession() bool {
+func (s *builtinConnectionIDSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValidatePasswordStrengthSig) SafeToShareAcrossSession() bool {
+func (s *builtinConvertTzSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinIlikeSig) SafeToShareAcrossSession() bool {
+func (s *builtinCurrentResourceGroupSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinFoundRowsSig) SafeToShareAcrossSession() bool {
+func (s *builtinCurrentRoleSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
@@ -97,77 +97,77 @@ func (s *builtinCurrentUserSig) SafeToShareAcrossSession() bool {
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinCurrentRoleSig) SafeToShareAcrossSession() bool {
+func (s *builtinDateLiteralSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinCurrentResourceGroupSig) SafeToShareAcrossSession() bool {
+func (s *builtinFoundRowsSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinUserSig) SafeToShareAcrossSession() bool {
+func (s *builtinFreeLockSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinConnectionIDSig) SafeToShareAcrossSession() bool {
+func (s *builtinFromBase64Sig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinLastInsertIDSig) SafeToShareAcrossSession() bool {
+func (s *builtinGreatestCmpStringAsTimeSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinLastInsertIDWithIDSig) SafeToShareAcrossSession() bool {
+func (s *builtinGreatestTimeSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBIsDDLOwnerSig) SafeToShareAcrossSession() bool {
+func (s *builtinIlikeSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinBenchmarkSig) SafeToShareAcrossSession() bool {
+func (s *builtinInsertSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRowCountSig) SafeToShareAcrossSession() bool {
+func (s *builtinInsertUTF8Sig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBMVCCInfoSig) SafeToShareAcrossSession() bool {
+func (s *builtinInternalFromBinarySig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBEncodeRecordKeySig) SafeToShareAcrossSession() bool {
+func (s *builtinIntervalIntSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBEncodeIndexKeySig) SafeToShareAcrossSession() bool {
+func (s *builtinIntervalRealSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBDecodeKeySig) SafeToShareAcrossSession() bool {
+func (s *builtinJSONSchemaValidSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBDecodeSQLDigestsSig) SafeToShareAcrossSession() bool {
+func (s *builtinLastInsertIDSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinNextValSig) SafeToShareAcrossSession() bool {
+func (s *builtinLastInsertIDWithIDSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
@@ -177,12 +177,12 @@ func (s *builtinLastValSig) SafeToShareAcrossSession() bool {
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSetValSig) SafeToShareAcrossSession() bool {
+func (s *builtinLeastCmpStringAsTimeSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinJSONSchemaValidSig) SafeToShareAcrossSession() bool {
+func (s *builtinLeastTimeSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
@@ -192,256 +192,261 @@ func (s *builtinLikeSig) SafeToShareAcrossSession() bool {
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRandSig) SafeToShareAcrossSession() bool {
+func (s *builtinLockSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSleepSig) SafeToShareAcrossSession() bool {
+func (s *builtinLpadSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinLockSig) SafeToShareAcrossSession() bool {
+func (s *builtinLpadUTF8Sig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinReleaseLockSig) SafeToShareAcrossSession() bool {
+func (s *builtinNextValSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinFreeLockSig) SafeToShareAcrossSession() bool {
+func (s *builtinRandSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinUsedLockSig) SafeToShareAcrossSession() bool {
+func (s *builtinRegexpInStrFuncSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinReleaseAllLocksSig) SafeToShareAcrossSession() bool {
+func (s *builtinRegexpLikeFuncSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinVectorFloat32IsTrueSig) SafeToShareAcrossSession() bool {
+func (s *builtinRegexpReplaceFuncSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinVectorFloat32IsFalseSig) SafeToShareAcrossSession() bool {
+func (s *builtinRegexpSubstrFuncSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinUnaryMinusDecimalSig) SafeToShareAcrossSession() bool {
+func (s *builtinReleaseAllLocksSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSetStringVarSig) SafeToShareAcrossSession() bool {
+func (s *builtinReleaseLockSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSetRealVarSig) SafeToShareAcrossSession() bool {
+func (s *builtinRepeatSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSetDecimalVarSig) SafeToShareAcrossSession() bool {
+func (s *builtinRowCountSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSetIntVarSig) SafeToShareAcrossSession() bool {
+func (s *builtinRpadSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSetTimeVarSig) SafeToShareAcrossSession() bool {
+func (s *builtinRpadUTF8Sig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesIntSig) SafeToShareAcrossSession() bool {
+func (s *builtinSetDecimalVarSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesRealSig) SafeToShareAcrossSession() bool {
+func (s *builtinSetIntVarSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesDecimalSig) SafeToShareAcrossSession() bool {
+func (s *builtinSetRealVarSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesStringSig) SafeToShareAcrossSession() bool {
+func (s *builtinSetStringVarSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesTimeSig) SafeToShareAcrossSession() bool {
+func (s *builtinSetTimeVarSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesDurationSig) SafeToShareAcrossSession() bool {
+func (s *builtinSetValSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesJSONSig) SafeToShareAcrossSession() bool {
+func (s *builtinSleepSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinValuesVectorFloat32Sig) SafeToShareAcrossSession() bool {
+func (s *builtinSpaceSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRegexpLikeFuncSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBBoundedStalenessSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRegexpSubstrFuncSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBCurrentTsoSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRegexpInStrFuncSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBDecodeKeySig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRegexpReplaceFuncSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBDecodeSQLDigestsSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinConcatSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBEncodeIndexKeySig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinConcatWSSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBEncodeRecordKeySig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRepeatSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBIsDDLOwnerSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinSpaceSig) SafeToShareAcrossSession() bool {
+func (s *builtinTiDBMVCCInfoSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinLpadSig) SafeToShareAcrossSession() bool {
+func (s *builtinTimeLiteralSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinLpadUTF8Sig) SafeToShareAcrossSession() bool {
+func (s *builtinTimestamp1ArgSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRpadSig) SafeToShareAcrossSession() bool {
+func (s *builtinTimestamp2ArgsSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinRpadUTF8Sig) SafeToShareAcrossSession() bool {
+func (s *builtinTimestampLiteralSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinFromBase64Sig) SafeToShareAcrossSession() bool {
+func (s *builtinToBase64Sig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinToBase64Sig) SafeToShareAcrossSession() bool {
+func (s *builtinUUIDSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinInsertSig) SafeToShareAcrossSession() bool {
+func (s *builtinUnaryMinusDecimalSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinInsertUTF8Sig) SafeToShareAcrossSession() bool {
+func (s *builtinUsedLockSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinWeightStringSig) SafeToShareAcrossSession() bool {
+func (s *builtinUserSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinDateLiteralSig) SafeToShareAcrossSession() bool {
+func (s *builtinValidatePasswordStrengthSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTimeLiteralSig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesDecimalSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinAddSubDateAsStringSig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesDurationSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinAddSubDateDatetimeAnySig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesIntSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinAddSubDateDurationAnySig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesJSONSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTimestamp1ArgSig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesRealSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTimestamp2ArgsSig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesStringSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTimestampLiteralSig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesTimeSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinConvertTzSig) SafeToShareAcrossSession() bool {
+func (s *builtinValuesVectorFloat32Sig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBBoundedStalenessSig) SafeToShareAcrossSession() bool {
+func (s *builtinVectorFloat32IsFalseSig) SafeToShareAcrossSession() bool {
 	return false
 }
 
 // SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *builtinTiDBCurrentTsoSig) SafeToShareAcrossSession() bool {
+func (s *builtinVectorFloat32IsTrueSig) SafeToShareAcrossSession() bool {
+	return false
+}
+
+// SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
+func (s *builtinWeightStringSig) SafeToShareAcrossSession() bool {
 	return false
 }
@@ -121,7 +121,9 @@ func caseWhenHandler(ctx BuildContext, expr *ScalarFunction) (Expression, bool)
 	args, l := expr.GetArgs(), len(expr.GetArgs())
 	var isDeferred, isDeferredConst bool
 	for i := 0; i < l-1; i += 2 {
-		expr.GetArgs()[i], isDeferred = foldConstant(ctx, args[i])
+		var foldedArg Expression
+		foldedArg, isDeferred = foldConstant(ctx, args[i])
+		expr.SetArg(i, foldedArg)
 		isDeferredConst = isDeferredConst || isDeferred
 		if _, isConst := expr.GetArgs()[i].(*Constant); !isConst {
 			// for no-const, here should return directly, because the following branches are unknown to be run or not
@@ -15,17 +15,144 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/format"
 	"go/parser"
 	"go/token"
+	"hash/fnv"
 	"log"
+	"maps"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"time"
+)
+
+var (
+	updateGolden = flag.Bool("update-golden", false,
+		"update the golden classification file instead of checking against it")
+	cacheFile = flag.String("cache", "",
+		"the file to cache the classification of each source file, disabled if empty")
+	shards = flag.Int("shards", 1,
+		"the number of files to shard the generated safe methods into")
+	maxMethods = flag.Int("max-methods", 0,
+		"the maximum number of the generated safe methods in a file if positive, the methods are split into as "+
+			"many files as needed, which can not be used with -shards")
+	coverage = flag.Bool("coverage", false,
+		"emit hooks into the generated safe methods to record the invoked ones, see coverageFileName")
+	check = flag.Bool("check", false,
+		"check the generated files on disk are up to date and print the diff instead of writing them")
+	interfaceName = flag.String("interface", defaultGenOptions.Interface,
+		"the name of the interface implemented by the generated methods")
+	methodName = flag.String("method", defaultGenOptions.Method,
+		"the name of the generated methods")
+	assertInterface = flag.Bool("assert-interface", false,
+		"emit an assertion that each signature implements the interface, which must be a type in the package, "+
+			"e.g. -interface builtinFunc")
+	safeBasesFile = flag.String("safe-bases", "",
+		"the file listing the extra safe base type names, one per line, see safeBaseTypes")
+	report = flag.Bool("report", false,
+		"write the functions which newly became safe or unsafe compared to the previous generated files, "+
+			"see reportFileName")
+	trend = flag.Bool("trend", false,
+		"append the time and the counts of the safe and unsafe functions of this generation to trendFileName")
+	safeHeaderFile = flag.String("safe-header", "",
+		"the file of the custom header of the safe files replacing the default one, the generated files are "+
+			"compiled to verify the imports of the header if it is set")
+	unsafeHeaderFile = flag.String("unsafe-header", "",
+		"the file of the custom header of the unsafe file replacing the default one, the generated files are "+
+			"compiled to verify the imports of the header if it is set")
+	sourceLocations = flag.Bool("source-locations", false,
+		"emit the map from each signature to the file and line where it is declared, see locationsFileName")
+	watch = flag.Bool("watch", false,
+		"watch the builtin source files and regenerate the files when they are changed")
+	watchInterval = flag.Duration("watch-interval", 500*time.Millisecond,
+		"the interval to poll the builtin source files in the watch mode, which also debounces the writes")
+)
+
+// genOptions is the options of the generated methods.
+type genOptions struct {
+	// Coverage indicates whether to emit the coverage hooks into the safe methods, see coverageFileName.
+	Coverage bool
+	// Interface is the name of the interface implemented by the generated methods.
+	Interface string
+	// Method is the name of the generated methods.
+	Method string
+	// AssertInterface indicates whether to emit `var _ Interface = &builtinXSig{}` for each signature.
+	AssertInterface bool
+	// Commit is the source git commit embedded into the headers of the generated files, omitted if empty.
+	Commit string
+	// SafeHeader and UnsafeHeader are the custom headers replacing safeHeader and unsafeHeader if not empty.
+	// The safe header must define the helper `safeToShareAcrossSession` and import what it uses.
+	SafeHeader   string
+	UnsafeHeader string
+}
+
+// headers returns the headers of the safe and the unsafe files.
+func (opts genOptions) headers() (safe, unsafe string) {
+	safe, unsafe = safeHeader, unsafeHeader
+	if opts.SafeHeader != "" {
+		safe = opts.SafeHeader
+	}
+	if opts.UnsafeHeader != "" {
+		unsafe = opts.UnsafeHeader
+	}
+	return safe, unsafe
+}
+
+// hasCustomHeader returns whether any custom header is set, whose imports need to be verified by compilation.
+func (opts genOptions) hasCustomHeader() bool {
+	return opts.SafeHeader != "" || opts.UnsafeHeader != ""
+}
+
+var defaultGenOptions = genOptions{
+	Interface: "BuiltinFunc",
+	Method:    "SafeToShareAcrossSession",
+}
+
+const (
+	safeFileName   = "builtin_threadsafe_generated.go"
+	unsafeFileName = "builtin_threadunsafe_generated.go"
+	goldenFileName = "threadsafe_golden.txt"
+	// reportFileName is the file of the report of the functions moved between safe and unsafe, see -report.
+	reportFileName = "builtin_threadsafe_report.txt"
+	// trendFileName is the file recording the counts of each generation to track the trend, see -trend.
+	trendFileName = "threadsafe_trend.csv"
+	// coverageFileName is the file of the registry recording the invoked safe methods, which is only built with
+	// the tag `threadsafe_coverage`, so a test can assert every generated method is exercised by the package tests.
+	coverageFileName = "builtin_threadsafe_generated_coverage.go"
+	// noCoverageFileName is the file of the no-op hook which is built without the tag `threadsafe_coverage`.
+	noCoverageFileName = "builtin_threadsafe_generated_nocoverage.go"
+	// locationsFileName is the file of the map from each signature to the `file:line` where it is declared, which
+	// is used for the IDE navigation and debugging, see -source-locations.
+	locationsFileName = "builtin_threadsafe_generated_locations.go"
+	// postGenEnv is the environment variable of the command to run after the files are generated.
+	// The paths of the generated files are appended to the arguments of the command.
+	postGenEnv = "THREADSAFE_POSTGEN"
+	// commitEnv is the environment variable of the source git commit embedded into the generated files for the
+	// reproducibility audits. It is omitted if not set to keep the output stable for the local runs.
+	commitEnv = "THREADSAFE_COMMIT"
+	// generatedMarker is the line in the headers of the generated files, after which the commit is embedded.
+	generatedMarker = "// Code generated by go generate in expression/generator; DO NOT EDIT.\n"
+	// forceUnsafeMarker is a comment marker on a type spec to force the signature to be classified as unsafe.
+	// It is used when a signature looks safe but is actually unsafe, for example, because of the shared state
+	// reached via the buffers of its base.
+	forceUnsafeMarker = "threadsafe:force-unsafe"
+	// immutableMarker is a comment marker on a field of a signature besides its base, such as a cached collator,
+	// to declare the field is never changed after the signature is built, so it does not make the signature unsafe.
+	immutableMarker = "threadsafe:immutable"
 )
 
 var (
@@ -44,17 +171,69 @@ var (
 		"builtinIntIsFalseSig":     {},
 		// NOTE: please make sure there are test cases for all functions here.
 	}
+
+	// specialUnsafeFuncs is the signatures which look safe but are actually unsafe, for example, because of the
+	// hidden global state they touch at runtime. They are always classified as unsafe like forceUnsafeMarker.
+	specialUnsafeFuncs = map[string]struct{}{
+		// the nondeterministic functions with the per-session semantics
+		"builtinUUIDSig":               {},
+		"builtinSleepSig":              {},
+		"builtinLastInsertIDSig":       {},
+		"builtinLastInsertIDWithIDSig": {},
+	}
+
+	// safeBaseTypes is the base types which are safe to share across sessions. A signature whose only field is
+	// one of them is classified as safe. More names can be added by the file of the flag `-safe-bases`.
+	safeBaseTypes = map[string]struct{}{
+		"baseBuiltinFunc":     {},
+		"baseBuiltinCastFunc": {},
+	}
+
+	// statefulInterfaces is the curated interfaces implemented by the signatures holding a state across the
+	// evaluations, mapped to their methods. A signature declaring any of the methods is classified as unsafe
+	// even if its structure looks safe, because the method changes the state shared by the sessions.
+	// Note the state built only when the signature is built, e.g. the hash set of `IN`, is not such a state.
+	statefulInterfaces = map[string][]string{
+		// the `ILIKE` signature memorizes the pattern compiled in the evaluation in the signature
+		"patternMemorizer": {"tryToVecMemorize"},
+	}
 )
 
+// loadSafeBaseTypes reads the base type names from the file, one per line.
+// The empty lines and the lines starting with `#` are ignored.
+func loadSafeBaseTypes(file string) ([]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, 4)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !token.IsIdentifier(line) {
+			return nil, fmt.Errorf("%s: invalid base type name %q", file, line)
+		}
+		names = append(names, line)
+	}
+	return names, nil
+}
+
 func collectThreadSafeBuiltinFuncs(file string) (safeFuncNames, unsafeFuncNames []string) {
 	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, file, nil, 0)
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
 	if err != nil {
 		panic(err)
 	}
 
 	allFuncNames := make([]string, 0, 32)
+	var genDecl *ast.GenDecl
 	ast.Inspect(f, func(n ast.Node) bool {
+		if decl, ok := n.(*ast.GenDecl); ok {
+			genDecl = decl
+			return true
+		}
 		x, ok := n.(*ast.TypeSpec) // get all type definitions
 		if !ok {
 			return true
@@ -72,16 +251,21 @@ func collectThreadSafeBuiltinFuncs(file string) (safeFuncNames, unsafeFuncNames
 			return true
 		}
 		allFuncNames = append(allFuncNames, typeName)
-		if _, ok := specialSafeFuncs[typeName]; ok {
-			safeFuncNames = append(safeFuncNames, typeName)
+		doc := x.Doc
+		if doc == nil && genDecl != nil && len(genDecl.Specs) == 1 && genDecl.Specs[0] == x {
+			doc = genDecl.Doc // the doc of `type X struct {...}` is attached to the GenDecl
+		}
+		if hasCommentMarker(doc, forceUnsafeMarker) {
 			return true
 		}
-		if len(structType.Fields.List) != 1 { // this structure only has 1 field
+		if _, ok := specialUnsafeFuncs[typeName]; ok {
 			return true
 		}
-		// this builtinXSig has only 1 field and this field is `baseBuiltinFunc` or `baseBuiltinCastFunc`.
-		if ident, ok := structType.Fields.List[0].Type.(*ast.Ident); ok &&
-			(ident.Name == "baseBuiltinFunc" || ident.Name == "baseBuiltinCastFunc") {
+		if _, ok := specialSafeFuncs[typeName]; ok {
+			safeFuncNames = append(safeFuncNames, typeName)
+			return true
+		}
+		if isSafeStruct(structType) {
 			safeFuncNames = append(safeFuncNames, typeName)
 		}
 		return true
@@ -100,7 +284,305 @@ func collectThreadSafeBuiltinFuncs(file string) (safeFuncNames, unsafeFuncNames
 	return safeFuncNames, unsafeFuncNames
 }
 
-func genBuiltinThreadSafeCode(exprCodeDir string) (safe, unsafe []byte) {
+// isSafeStruct returns whether the structure of a builtinXSig is safe to share across sessions, that is, it has
+// exactly one field of the safeBaseTypes, and all the other fields are marked with immutableMarker.
+func isSafeStruct(structType *ast.StructType) bool {
+	bases := 0
+	for _, field := range structType.Fields.List {
+		if _, ok := safeBaseTypes[baseTypeName(field.Type)]; ok && bases == 0 {
+			bases++
+			continue
+		}
+		if !hasCommentMarker(field.Doc, immutableMarker) {
+			return false
+		}
+	}
+	return bases == 1
+}
+
+// checkSpecialFuncs returns an error listing the entries of specialSafeFuncs and specialUnsafeFuncs which are not
+// any of the classified functions, which are stale after the signatures are renamed or deleted.
+func checkSpecialFuncs(safeFuncs, unsafeFuncs []string) error {
+	seen := make(map[string]struct{}, len(safeFuncs)+len(unsafeFuncs))
+	for _, name := range safeFuncs {
+		seen[name] = struct{}{}
+	}
+	for _, name := range unsafeFuncs {
+		seen[name] = struct{}{}
+	}
+	dangling := make([]string, 0)
+	for _, special := range []map[string]struct{}{specialSafeFuncs, specialUnsafeFuncs} {
+		for name := range special {
+			if _, ok := seen[name]; !ok {
+				dangling = append(dangling, name)
+			}
+		}
+	}
+	if len(dangling) > 0 {
+		sort.Strings(dangling)
+		return fmt.Errorf("the special functions do not exist, please remove them from specialSafeFuncs or "+
+			"specialUnsafeFuncs: %s", strings.Join(dangling, ", "))
+	}
+	return nil
+}
+
+// baseTypeName returns the name of the type without the type arguments, e.g. both `baseBuiltinFunc` and
+// `baseBuiltinFunc[T]` return "baseBuiltinFunc". It returns "" if the type is not a named type in this package.
+func baseTypeName(expr ast.Expr) string {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		return x.Name
+	case *ast.IndexExpr: // a generic type with one type argument
+		return baseTypeName(x.X)
+	case *ast.IndexListExpr: // a generic type with multiple type arguments
+		return baseTypeName(x.X)
+	}
+	return ""
+}
+
+// hasCommentMarker checks whether there is a line comment `// <marker>` in the comment group.
+func hasCommentMarker(doc *ast.CommentGroup, marker string) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(strings.TrimPrefix(c.Text, "//")) == marker {
+			return true
+		}
+	}
+	return false
+}
+
+// findValueReceiverEvalMethods returns the eval methods of the `builtin*Sig` types that are declared with value
+// receivers. The generated `SafeToShareAcrossSession` methods use pointer receivers, so the method sets of these
+// signatures may diverge and the generated method may not apply where expected.
+func findValueReceiverEvalMethods(file string) []string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	methods := make([]string, 0)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 {
+			continue
+		}
+		if !strings.HasPrefix(fn.Name.Name, "eval") && !strings.HasPrefix(fn.Name.Name, "vecEval") {
+			continue
+		}
+		ident, ok := fn.Recv.List[0].Type.(*ast.Ident) // a pointer receiver is an `*ast.StarExpr`
+		if !ok || !strings.HasPrefix(ident.Name, "builtin") || !strings.HasSuffix(ident.Name, "Sig") {
+			continue
+		}
+		methods = append(methods, fmt.Sprintf("%s.%s (%s)", ident.Name, fn.Name.Name, fset.Position(fn.Pos())))
+	}
+	return methods
+}
+
+// collectSigMethods returns the names of the methods declared on the `builtin*Sig` types in the file, keyed by the
+// type names. Both the pointer and the value receivers are collected.
+func collectSigMethods(file string) map[string][]string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	methods := make(map[string][]string)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 {
+			continue
+		}
+		recv := fn.Recv.List[0].Type
+		if star, ok := recv.(*ast.StarExpr); ok {
+			recv = star.X
+		}
+		typeName := baseTypeName(recv)
+		if !strings.HasPrefix(typeName, "builtin") || !strings.HasSuffix(typeName, "Sig") {
+			continue
+		}
+		methods[typeName] = append(methods[typeName], fn.Name.Name)
+	}
+	return methods
+}
+
+// findStatefulSigs returns the signatures declaring any method of statefulInterfaces, mapped to the first such
+// method in the form of `Interface.Method`.
+func findStatefulSigs(sigMethods map[string][]string) map[string]string {
+	interfaces := make([]string, 0, len(statefulInterfaces))
+	for name := range statefulInterfaces {
+		interfaces = append(interfaces, name)
+	}
+	sort.Strings(interfaces) // report the same interface for each run
+	stateful := make(map[string]string)
+	for sig, methods := range sigMethods {
+		for _, iface := range interfaces {
+			for _, method := range statefulInterfaces[iface] {
+				if _, ok := stateful[sig]; !ok && slices.Contains(methods, method) {
+					stateful[sig] = iface + "." + method
+				}
+			}
+		}
+	}
+	return stateful
+}
+
+// collectSigLocations returns the `file:line` where each `builtin*Sig` structure is declared in the file, keyed by
+// the type names. The file is the base name, so the locations do not depend on where the generator runs.
+func collectSigLocations(file string) map[string]string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	locations := make(map[string]string)
+	ast.Inspect(f, func(n ast.Node) bool {
+		x, ok := n.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+		typeName := x.Name.Name
+		if !strings.HasPrefix(typeName, "builtin") || !strings.HasSuffix(typeName, "Sig") {
+			return true
+		}
+		if _, ok := x.Type.(*ast.StructType); !ok {
+			return true
+		}
+		pos := fset.Position(x.Name.Pos())
+		locations[typeName] = fmt.Sprintf("%s:%d", filepath.Base(pos.Filename), pos.Line)
+		return true
+	})
+	return locations
+}
+
+// fileClassification is the classification result of a source file.
+type fileClassification struct {
+	// Hash is the hash of the source file content.
+	Hash        string   `json:"hash"`
+	SafeFuncs   []string `json:"safe_funcs"`
+	UnsafeFuncs []string `json:"unsafe_funcs"`
+	// ValueReceiverMethods is the result of `findValueReceiverEvalMethods`.
+	ValueReceiverMethods []string `json:"value_receiver_methods"`
+	// SigMethods is the result of `collectSigMethods`. The methods are merged across the files because a
+	// signature may declare its methods in another file.
+	SigMethods map[string][]string `json:"sig_methods"`
+	// Locations is the result of `collectSigLocations`.
+	Locations map[string]string `json:"locations"`
+}
+
+// classificationCache caches the classification of each source file to skip the unchanged files.
+type classificationCache struct {
+	// Version is the version of the generator which produced the cache.
+	// The cache is discarded if the generator is changed.
+	Version string                        `json:"version"`
+	Files   map[string]fileClassification `json:"files"`
+}
+
+// generatorVersion returns the hash of the generator executable, which changes whenever the generator source changes.
+func generatorVersion() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(exe)
+	if err != nil {
+		return "", err
+	}
+	return hashContent(content), nil
+}
+
+func hashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadClassificationCache loads the cache from the file. An empty cache is returned if the file does not exist,
+// is corrupted, or was produced by another version of the generator.
+func loadClassificationCache(file, version string) *classificationCache {
+	cache := &classificationCache{}
+	content, err := os.ReadFile(file)
+	if err != nil || json.Unmarshal(content, cache) != nil || cache.Version != version {
+		cache = &classificationCache{}
+	}
+	cache.Version = version
+	if cache.Files == nil {
+		cache.Files = make(map[string]fileClassification)
+	}
+	return cache
+}
+
+func (c *classificationCache) save(file string) error {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0644)
+}
+
+func classifyFile(file string, cache *classificationCache) fileClassification {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	hash := hashContent(content)
+	if cache != nil {
+		if result, ok := cache.Files[file]; ok && result.Hash == hash {
+			return result
+		}
+	}
+	result := fileClassification{Hash: hash}
+	result.SafeFuncs, result.UnsafeFuncs = collectThreadSafeBuiltinFuncs(file)
+	result.ValueReceiverMethods = findValueReceiverEvalMethods(file)
+	result.SigMethods = collectSigMethods(file)
+	result.Locations = collectSigLocations(file)
+	if cache != nil {
+		cache.Files[file] = result
+	}
+	return result
+}
+
+// classifyBuiltinFuncs classifies the builtin functions in the directory.
+// `cache` is optional, the unchanged files are not parsed again if it is provided.
+func classifyBuiltinFuncs(exprCodeDir string, cache *classificationCache) (safeFuncs, unsafeFuncs []string) {
+	files := builtinSourceFiles(exprCodeDir)
+	classifiedSafe := make([]string, 0, 32)
+	unsafeFuncs = make([]string, 0, 32)
+	sigMethods := make(map[string][]string)
+	for _, file := range files {
+		result := classifyFile(path.Join(exprCodeDir, file), cache)
+		for _, method := range result.ValueReceiverMethods {
+			log.Printf("WARNING: %s uses a value receiver, but SafeToShareAcrossSession is generated "+
+				"with a pointer receiver", method)
+		}
+		classifiedSafe = append(classifiedSafe, result.SafeFuncs...)
+		unsafeFuncs = append(unsafeFuncs, result.UnsafeFuncs...)
+		for sig, methods := range result.SigMethods {
+			sigMethods[sig] = append(sigMethods[sig], methods...)
+		}
+	}
+	// the method sets are only complete after all the files are classified
+	stateful := findStatefulSigs(sigMethods)
+	safeFuncs = make([]string, 0, len(classifiedSafe))
+	for _, name := range classifiedSafe {
+		if method, ok := stateful[name]; ok {
+			log.Printf("%s implements the stateful %s, it is classified as unsafe", name, method)
+			unsafeFuncs = append(unsafeFuncs, name)
+			continue
+		}
+		safeFuncs = append(safeFuncs, name)
+	}
+	// sort both of them, so the generated files do not depend on the order of the files and the type specs
+	sort.Strings(safeFuncs)
+	sort.Strings(unsafeFuncs)
+	return safeFuncs, unsafeFuncs
+}
+
+// builtinSourceFiles returns the sorted names of the builtin source files in the directory.
+func builtinSourceFiles(exprCodeDir string) []string {
 	entries, err := os.ReadDir(exprCodeDir)
 	if err != nil {
 		panic(err)
@@ -117,22 +599,51 @@ func genBuiltinThreadSafeCode(exprCodeDir string) (safe, unsafe []byte) {
 		}
 	}
 	sort.Strings(files)
+	return files
+}
 
-	safeFuncs := make([]string, 0, 32)
-	unsafeFuncs := make([]string, 0, 32)
-	for _, file := range files {
-		safeNames, unsafeNames := collectThreadSafeBuiltinFuncs(path.Join(exprCodeDir, file))
-		safeFuncs = append(safeFuncs, safeNames...)
-		unsafeFuncs = append(unsafeFuncs, unsafeNames...)
+// collectSourceLocations returns the `file:line` where each signature in the directory is declared.
+// `cache` is optional, the unchanged files are not parsed again if it is provided.
+func collectSourceLocations(exprCodeDir string, cache *classificationCache) map[string]string {
+	locations := make(map[string]string)
+	for _, file := range builtinSourceFiles(exprCodeDir) {
+		maps.Copy(locations, classifyFile(path.Join(exprCodeDir, file), cache).Locations)
 	}
-	sort.Strings(safeFuncs)
+	return locations
+}
+
+// genSourceLocationsCode generates the file defining `builtinSourceLocations`, see locationsFileName.
+func genSourceLocationsCode(locations map[string]string, opts genOptions) []byte {
+	names := slices.Sorted(maps.Keys(locations))
+	var buffer bytes.Buffer
+	buffer.WriteString(withCommit(locationsHeader, opts.Commit))
+	for _, name := range names {
+		buffer.WriteString(fmt.Sprintf(locationEntryTemp, name, locations[name]))
+	}
+	buffer.WriteString("}\n")
+	code, err := format.Source(buffer.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
 
-	formattedSafe, err := generateCode(safeFuncs, safeHeader, safeFuncTemp)
+// safeFuncTemplate returns the template of the safe methods, which calls the coverage hook if `opts.Coverage` is true.
+func safeFuncTemplate(opts genOptions) string {
+	if opts.Coverage {
+		return safeFuncCoverageTemp
+	}
+	return safeFuncTemp
+}
+
+func genBuiltinThreadSafeCode(safeFuncs, unsafeFuncs []string, opts genOptions) (safe, unsafe []byte) {
+	safeHeader, unsafeHeader := opts.headers()
+	formattedSafe, err := generateCode(safeFuncs, safeHeader, safeFuncTemplate(opts), opts)
 	if err != nil {
 		panic(err)
 	}
 
-	formattedUnsafe, err := generateCode(unsafeFuncs, unsafeHeader, unsafeFuncTemp)
+	formattedUnsafe, err := generateCode(unsafeFuncs, unsafeHeader, unsafeFuncTemp, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -140,35 +651,697 @@ func genBuiltinThreadSafeCode(exprCodeDir string) (safe, unsafe []byte) {
 	return formattedSafe, formattedUnsafe
 }
 
-func generateCode(funcNames []string, header, template string) ([]byte, error) {
+// shardFileName returns the file name of the i-th shard of the generated safe methods.
+func shardFileName(i int) string {
+	return fmt.Sprintf("builtin_threadsafe_generated_%d.go", i)
+}
+
+// shardFuncNames assigns the functions to shards by the hash of their names,
+// so the assignment is deterministic and does not change when other functions are added or removed.
+func shardFuncNames(funcNames []string, shards int) [][]string {
+	result := make([][]string, shards)
+	for _, name := range funcNames {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		i := h.Sum32() % uint32(shards)
+		result[i] = append(result[i], name)
+	}
+	return result
+}
+
+// splitFuncNames splits the sorted functions into the fewest groups of at most `maxMethods` functions in order, so
+// the file of each group is deterministic. There is always at least one group to contain the helper function.
+func splitFuncNames(funcNames []string, maxMethods int) [][]string {
+	if len(funcNames) == 0 {
+		return [][]string{nil}
+	}
+	return slices.Collect(slices.Chunk(funcNames, maxMethods))
+}
+
+// genBuiltinThreadSafeShards generates the safe methods sharded into multiple files.
+// The helper function `safeToShareAcrossSession` is only generated in the first shard.
+func genBuiltinThreadSafeShards(safeFuncs []string, shards int, opts genOptions) [][]byte {
+	return genShardFiles(shardFuncNames(safeFuncs, shards), opts)
+}
+
+// genBuiltinThreadSafeSplit generates the safe methods split into the files of at most `maxMethods` methods, see
+// `splitFuncNames`. The files are named like the shards.
+func genBuiltinThreadSafeSplit(safeFuncs []string, maxMethods int, opts genOptions) [][]byte {
+	return genShardFiles(splitFuncNames(safeFuncs, maxMethods), opts)
+}
+
+// genShardFiles generates a file for each group of the safe methods, and the helper function is only generated in
+// the first one.
+func genShardFiles(groups [][]string, opts genOptions) [][]byte {
+	result := make([][]byte, 0, len(groups))
+	safeHeader, unsafeHeader := opts.headers()
+	for i, names := range groups {
+		header := unsafeHeader
+		if i == 0 {
+			header = safeHeader
+		}
+		code, err := generateCode(names, header, safeFuncTemplate(opts), opts)
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, code)
+	}
+	return result
+}
+
+// genCoverageCode generates the coverage registry of the safe methods and the no-op hook used without the tag.
+func genCoverageCode(safeFuncs []string, opts genOptions) (coverage, noCoverage []byte) {
+	var buffer bytes.Buffer
+	buffer.WriteString(withCommit(coverageHeader, opts.Commit))
+	for _, funcName := range safeFuncs {
+		buffer.WriteString(fmt.Sprintf(coverageEntryTemp, funcName))
+	}
+	buffer.WriteString(coverageFooter)
+	coverage, err := format.Source(buffer.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	noCoverage, err = format.Source([]byte(withCommit(noCoverageCode, opts.Commit)))
+	if err != nil {
+		panic(err)
+	}
+	return coverage, noCoverage
+}
+
+// collectGeneratedFuncs returns the receiver type names of the methods named `method` in the generated files.
+// The files which do not exist are skipped, so the result is empty before the first generation.
+func collectGeneratedFuncs(files []string, method string) (map[string]struct{}, error) {
+	funcs := make(map[string]struct{})
+	fset := token.NewFileSet()
+	for _, file := range files {
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || len(fn.Recv.List) != 1 || fn.Name.Name != method {
+				continue
+			}
+			recv := fn.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			if name := baseTypeName(recv); name != "" {
+				funcs[name] = struct{}{}
+			}
+		}
+	}
+	return funcs, nil
+}
+
+// genThreadSafeReport reports the functions which newly became unsafe or safe compared to the previous generated
+// files, so a reviewer can notice a hot function is demoted by adding a field. The functions which are added or
+// removed are not reported.
+func genThreadSafeReport(prevSafe, prevUnsafe map[string]struct{}, safeFuncs, unsafeFuncs []string) []byte {
+	var buffer bytes.Buffer
+	write := func(title string, funcs []string, prev map[string]struct{}) {
+		moved := make([]string, 0)
+		for _, name := range funcs {
+			if _, ok := prev[name]; ok {
+				moved = append(moved, name)
+			}
+		}
+		sort.Strings(moved)
+		fmt.Fprintf(&buffer, "%s (%d):\n", title, len(moved))
+		for _, name := range moved {
+			fmt.Fprintf(&buffer, "  %s\n", name)
+		}
+	}
+	write("newly unsafe", unsafeFuncs, prevSafe)
+	write("newly safe", safeFuncs, prevUnsafe)
+	return buffer.Bytes()
+}
+
+// appendTrend appends a line of the time and the counts of the safe and unsafe functions to the CSV file, so the
+// trend of the functions which are safe to share can be tracked across the generations.
+// The header is written if the file is created.
+func appendTrend(file string, now time.Time, safeCount, unsafeCount int) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var buffer bytes.Buffer
+	if info.Size() == 0 {
+		buffer.WriteString("timestamp,safe,unsafe\n")
+	}
+	fmt.Fprintf(&buffer, "%s,%d,%d\n", now.UTC().Format(time.RFC3339), safeCount, unsafeCount)
+	_, err = f.Write(buffer.Bytes())
+	return err
+}
+
+// writeSafeFiles writes the generated safe files to the directory,
+// and removes the stale ones generated with another sharding.
+func writeSafeFiles(dir string, files map[string][]byte) error {
+	existing, err := filepath.Glob(filepath.Join(dir, "builtin_threadsafe_generated*.go"))
+	if err != nil {
+		return err
+	}
+	for _, file := range existing {
+		if _, ok := files[filepath.Base(file)]; !ok {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	for name, code := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), code, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGeneratedFiles compares the generated files with the ones on disk, and returns a diff of the out-of-date files.
+// The generated files on disk which are not in `files`, like the stale shards, are regarded as removed.
+// It returns an empty string if all the files are up to date.
+func checkGeneratedFiles(dir string, files map[string][]byte) (string, error) {
+	existing, err := filepath.Glob(filepath.Join(dir, "builtin_thread*_generated*.go"))
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(files)+len(existing))
+	for name := range files {
+		names = append(names, name)
+	}
+	for _, file := range existing {
+		if _, ok := files[filepath.Base(file)]; !ok {
+			names = append(names, filepath.Base(file))
+		}
+	}
+	sort.Strings(names)
+
+	var diff strings.Builder
+	for _, name := range names {
+		onDisk, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if !bytes.Equal(onDisk, files[name]) {
+			diff.WriteString(lineDiff(name, onDisk, files[name]))
+		}
+	}
+	return diff.String(), nil
+}
+
+// maxLineDiffCells caps the size of the longest common subsequence table of lineDiff, which is quadratic in the
+// number of the changed lines.
+const maxLineDiffCells = 1 << 20
+
+// lineDiff returns a simple unified-style line diff from `old` to `new` without the hunk headers.
+// The common prefix and suffix are omitted, and the lines in between are diffed by the longest common subsequence.
+// If there are too many changed lines to diff, only the numbers of them are reported.
+func lineDiff(name string, old, new []byte) string {
+	a, b := splitLines(old), splitLines(new)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "--- a/%s\n+++ b/%s\n@@ line %d @@\n", name, name, prefix+1)
+	if (len(a)+1)*(len(b)+1) > maxLineDiffCells {
+		fmt.Fprintf(&diff, "files differ: %d lines replaced by %d lines, too many to diff\n", len(a), len(b))
+		return diff.String()
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff.WriteString(" " + a[i] + "\n")
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff.WriteString("-" + a[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return diff.String()
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// runPostGenHook runs the post-generation command with the generated files appended to its arguments.
+// The command is split by white spaces, and nothing is done if it is empty.
+func runPostGenHook(command string, files []string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+	cmd := exec.Command(args[0], append(args[1:], files...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// compileGeneratedFiles builds the package in `dir` with the generated `files` replacing the ones on disk by the
+// overlay of the go command, so the files are verified without being written. The generated files on disk which are
+// not in `files`, like the stale shards, are excluded. It is used to verify the imports of the custom headers,
+// and the returned error contains the compiler output if the build fails.
+func compileGeneratedFiles(dir string, files map[string][]byte) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "threadsafe-compile")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	existing, err := filepath.Glob(filepath.Join(absDir, "builtin_thread*_generated*.go"))
+	if err != nil {
+		return err
+	}
+	replace := make(map[string]string, len(files)+len(existing))
+	for _, file := range existing {
+		// an empty replacement deletes the file from the build
+		replace[file] = ""
+	}
+	for name, code := range files {
+		tmpFile := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(tmpFile, code, 0644); err != nil {
+			return err
+		}
+		replace[filepath.Join(absDir, name)] = tmpFile
+	}
+	overlay, err := json.Marshal(struct{ Replace map[string]string }{Replace: replace})
+	if err != nil {
+		return err
+	}
+	overlayFile := filepath.Join(tmpDir, "overlay.json")
+	if err := os.WriteFile(overlayFile, overlay, 0644); err != nil {
+		return err
+	}
+	cmd := exec.Command("go", "build", "-overlay", overlayFile, ".")
+	cmd.Dir = absDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w\n%s", err, output)
+	}
+	return nil
+}
+
+// readHeader reads the custom header from the file, or returns "" if the file is not set.
+func readHeader(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// commitFromEnv returns the source git commit set by commitEnv, or "" if it is not set.
+func commitFromEnv() string {
+	return strings.TrimSpace(os.Getenv(commitEnv))
+}
+
+// withCommit embeds the source git commit into the header of a generated file after generatedMarker.
+// The header is returned unchanged if the commit is empty.
+func withCommit(header, commit string) string {
+	if commit == "" {
+		return header
+	}
+	return strings.Replace(header, generatedMarker, generatedMarker+"// Source commit: "+commit+"\n", 1)
+}
+
+// generateCode generates the methods of `funcNames` by the `template`, in which `%[1]s` is the function name,
+// `%[2]s` is the interface name and `%[3]s` is the method name.
+func generateCode(funcNames []string, header, template string, opts genOptions) ([]byte, error) {
 	var buffer bytes.Buffer
-	buffer.WriteString(header)
+	buffer.WriteString(withCommit(header, opts.Commit))
 	for _, funcName := range funcNames {
-		buffer.WriteString(fmt.Sprintf(template, funcName))
+		buffer.WriteString(fmt.Sprintf(template, funcName, opts.Interface, opts.Method))
+		if opts.AssertInterface {
+			buffer.WriteString(fmt.Sprintf(interfaceAssertTemp, funcName, opts.Interface))
+		}
 	}
 	return format.Source(buffer.Bytes())
 }
 
+// genGolden generates the content of the golden classification file.
+// Each line is `safe <name>` or `unsafe <name>`, and the lines are sorted.
+func genGolden(safeFuncs, unsafeFuncs []string) []byte {
+	lines := make([]string, 0, len(safeFuncs)+len(unsafeFuncs))
+	for _, name := range safeFuncs {
+		lines = append(lines, "safe "+name)
+	}
+	for _, name := range unsafeFuncs {
+		lines = append(lines, "unsafe "+name)
+	}
+	sort.Strings(lines)
+	var buffer bytes.Buffer
+	for _, line := range lines {
+		buffer.WriteString(line)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+// checkGolden checks the current classification against the golden file and returns an error if any function
+// moved between safe and unsafe. Functions that are added or removed are not regarded as drifted.
+func checkGolden(goldenFile string, safeFuncs, unsafeFuncs []string) error {
+	f, err := os.Open(goldenFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	golden := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		class, name, ok := strings.Cut(line, " ")
+		if !ok || (class != "safe" && class != "unsafe") {
+			return fmt.Errorf("invalid line in %s: %q", goldenFile, line)
+		}
+		golden[name] = class == "safe"
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	drifted := make([]string, 0)
+	for _, name := range safeFuncs {
+		if wasSafe, ok := golden[name]; ok && !wasSafe {
+			drifted = append(drifted, name+": unsafe -> safe")
+		}
+	}
+	for _, name := range unsafeFuncs {
+		if wasSafe, ok := golden[name]; ok && wasSafe {
+			drifted = append(drifted, name+": safe -> unsafe")
+		}
+	}
+	if len(drifted) > 0 {
+		sort.Strings(drifted)
+		return fmt.Errorf("the classification drifted from %s, please run the generator with -update-golden "+
+			"if it is expected:\n%s", goldenFile, strings.Join(drifted, "\n"))
+	}
+	return nil
+}
+
+// generate classifies the builtin functions in the current directory and writes the generated files, or checks
+// them if -check is set. It returns a one-line summary of the generated files.
+func generate(cache *classificationCache) (string, error) {
+	if *maxMethods > 0 && *shards > 1 {
+		return "", errors.New("-max-methods can not be used with -shards")
+	}
+	safeFuncs, unsafeFuncs := classifyBuiltinFuncs(".", cache)
+	if err := checkSpecialFuncs(safeFuncs, unsafeFuncs); err != nil {
+		return "", err
+	}
+	if cache != nil && *cacheFile != "" {
+		if err := cache.save(*cacheFile); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", *cacheFile, err)
+		}
+	}
+	if *updateGolden {
+		if err := os.WriteFile(goldenFileName, genGolden(safeFuncs, unsafeFuncs), 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", goldenFileName, err)
+		}
+	} else if err := checkGolden(goldenFileName, safeFuncs, unsafeFuncs); err != nil {
+		return "", err
+	}
+
+	opts := genOptions{
+		Coverage:        *coverage,
+		Interface:       *interfaceName,
+		Method:          *methodName,
+		AssertInterface: *assertInterface,
+		Commit:          commitFromEnv(),
+	}
+	var err error
+	if opts.SafeHeader, err = readHeader(*safeHeaderFile); err != nil {
+		return "", fmt.Errorf("failed to read the safe header: %w", err)
+	}
+	if opts.UnsafeHeader, err = readHeader(*unsafeHeaderFile); err != nil {
+		return "", fmt.Errorf("failed to read the unsafe header: %w", err)
+	}
+	safeCode, unsafeCode := genBuiltinThreadSafeCode(safeFuncs, unsafeFuncs, opts)
+	safeFiles := map[string][]byte{safeFileName: safeCode}
+	if *shards > 1 {
+		safeFiles = make(map[string][]byte, *shards)
+		for i, code := range genBuiltinThreadSafeShards(safeFuncs, *shards, opts) {
+			safeFiles[shardFileName(i)] = code
+		}
+	} else if *maxMethods > 0 {
+		safeFiles = make(map[string][]byte)
+		for i, code := range genBuiltinThreadSafeSplit(safeFuncs, *maxMethods, opts) {
+			safeFiles[shardFileName(i)] = code
+		}
+	}
+	if *coverage {
+		safeFiles[coverageFileName], safeFiles[noCoverageFileName] = genCoverageCode(safeFuncs, opts)
+	}
+	if *sourceLocations {
+		safeFiles[locationsFileName] = genSourceLocationsCode(collectSourceLocations(".", cache), opts)
+	}
+	files := maps.Clone(safeFiles)
+	files[unsafeFileName] = unsafeCode
+	if opts.hasCustomHeader() {
+		if err := compileGeneratedFiles(".", files); err != nil {
+			return "", fmt.Errorf("the generated files with the custom headers do not compile: %w", err)
+		}
+	}
+	if *check {
+		diff, err := checkGeneratedFiles(".", files)
+		if err != nil {
+			return "", fmt.Errorf("failed to check the generated files: %w", err)
+		}
+		if diff != "" {
+			fmt.Print(diff)
+			return "", errors.New("the generated files are out of date, please run the generator to update them")
+		}
+		return fmt.Sprintf("%d safe and %d unsafe functions are up to date", len(safeFuncs), len(unsafeFuncs)), nil
+	}
+	if *report {
+		prevSafeFiles, err := filepath.Glob("builtin_threadsafe_generated*.go")
+		if err != nil {
+			return "", err
+		}
+		prevSafe, err := collectGeneratedFuncs(prevSafeFiles, opts.Method)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the previous safe files: %w", err)
+		}
+		prevUnsafe, err := collectGeneratedFuncs([]string{unsafeFileName}, opts.Method)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the previous unsafe file: %w", err)
+		}
+		content := genThreadSafeReport(prevSafe, prevUnsafe, safeFuncs, unsafeFuncs)
+		if err := os.WriteFile(reportFileName, content, 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", reportFileName, err)
+		}
+	}
+	if err := writeSafeFiles(".", safeFiles); err != nil {
+		return "", fmt.Errorf("failed to write the safe files: %w", err)
+	}
+	if err := os.WriteFile(unsafeFileName, unsafeCode, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", unsafeFileName, err)
+	}
+
+	generated := make([]string, 0, len(safeFiles)+1)
+	for name := range safeFiles {
+		generated = append(generated, name)
+	}
+	sort.Strings(generated)
+	generated = append(generated, unsafeFileName)
+	if err := runPostGenHook(os.Getenv(postGenEnv), generated); err != nil {
+		return "", fmt.Errorf("failed to run the post-generation command %s: %w", postGenEnv, err)
+	}
+	if *trend {
+		if err := appendTrend(trendFileName, time.Now(), len(safeFuncs), len(unsafeFuncs)); err != nil {
+			return "", fmt.Errorf("failed to append to %s: %w", trendFileName, err)
+		}
+	}
+	return fmt.Sprintf("generated %d safe and %d unsafe functions into %d files",
+		len(safeFuncs), len(unsafeFuncs), len(generated)), nil
+}
+
+// fileStamp is the modification time and the size of a file, which is used by watchDir to detect the changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// isThreadSafeGeneratedFile returns whether the file is written by this generator.
+func isThreadSafeGeneratedFile(name string) bool {
+	return strings.HasPrefix(name, "builtin_threadsafe_generated") || name == unsafeFileName
+}
+
+// snapshotBuiltinFiles returns the stamps of the builtin source files in the directory except the files written
+// by this generator, so that a regeneration does not trigger another one.
+func snapshotBuiltinFiles(dir string) (map[string]fileStamp, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	stamps := make(map[string]fileStamp, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "builtin_") || !strings.HasSuffix(name, ".go") ||
+			strings.Contains(name, "_test") || isThreadSafeGeneratedFile(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		stamps[name] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+// watchDir polls the builtin source files in the directory every `interval` and calls `regenerate` when they are
+// changed, until `stop` is closed. The rapid successive writes are debounced, that is, `regenerate` is called once
+// after the files have not changed for an interval.
+func watchDir(dir string, interval time.Duration, stop <-chan struct{}, regenerate func()) error {
+	last, err := snapshotBuiltinFiles(dir)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pending := false
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		current, err := snapshotBuiltinFiles(dir)
+		if err != nil {
+			return err
+		}
+		if !maps.Equal(current, last) {
+			last, pending = current, true
+			continue
+		}
+		if pending {
+			pending = false
+			regenerate()
+		}
+	}
+}
+
 func main() {
-	safeCode, unsafeCode := genBuiltinThreadSafeCode(".")
-	if err := os.WriteFile("./builtin_threadsafe_generated.go", safeCode, 0644); err != nil {
-		log.Fatalln("failed to write builtin_threadsafe_generated.go", err)
+	flag.Parse()
+	var safeBases []string
+	if *safeBasesFile != "" {
+		var err error
+		safeBases, err = loadSafeBaseTypes(*safeBasesFile)
+		if err != nil {
+			log.Fatalln("failed to load the safe base types", err)
+		}
+		for _, name := range safeBases {
+			safeBaseTypes[name] = struct{}{}
+		}
 	}
-	if err := os.WriteFile("./builtin_threadunsafe_generated.go", unsafeCode, 0644); err != nil {
-		log.Fatalln("failed to write builtin_threadunsafe_generated.go", err)
+	var cache *classificationCache
+	if *cacheFile != "" {
+		version, err := generatorVersion()
+		if err != nil {
+			log.Fatalln("failed to get the version of the generator", err)
+		}
+		if len(safeBases) > 0 {
+			// the classification depends on the safe base types, so they are part of the cache version
+			version = hashContent([]byte(version + "," + strings.Join(safeBases, ",")))
+		}
+		cache = loadClassificationCache(*cacheFile, version)
+	}
+	if !*watch {
+		if _, err := generate(cache); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if *check {
+		log.Fatalln("-watch can not be used with -check")
+	}
+	if cache == nil {
+		// keep the classification in memory, so only the changed files are parsed again
+		cache = &classificationCache{Files: make(map[string]fileClassification)}
+	}
+	regenerate := func() {
+		summary, err := generate(cache)
+		if err != nil {
+			log.Println("failed to regenerate:", err)
+			return
+		}
+		log.Println(summary)
+	}
+	regenerate()
+	if err := watchDir(".", *watchInterval, nil, regenerate); err != nil {
+		log.Fatalln("failed to watch the directory", err)
 	}
 }
 
 const (
-	safeFuncTemp = `// SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *%s) SafeToShareAcrossSession() bool {
+	safeFuncTemp = `// %[3]s implements %[2]s.%[3]s.
+func (s *%[1]s) %[3]s() bool {
 	return safeToShareAcrossSession(&s.safeToShareAcrossSessionFlag, s.args)
 }
 `
-	unsafeFuncTemp = `// SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.
-func (s *%s) SafeToShareAcrossSession() bool {
+	safeFuncCoverageTemp = `// %[3]s implements %[2]s.%[3]s.
+func (s *%[1]s) %[3]s() bool {
+	threadSafeCoverageHit("%[1]s")
+	return safeToShareAcrossSession(&s.safeToShareAcrossSessionFlag, s.args)
+}
+`
+	unsafeFuncTemp = `// %[3]s implements %[2]s.%[3]s.
+func (s *%[1]s) %[3]s() bool {
 	return false
 }
+`
+	interfaceAssertTemp = `
+var _ %[2]s = &%[1]s{}
+
 `
 	safeHeader = `// Copyright 2024 PingCAP, Inc.
 //
@@ -231,5 +1404,101 @@ func safeToShareAcrossSession(flag *uint32, args []Expression) bool {
 
 package expression
 
+`
+
+	coverageHeader = `// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by go generate in expression/generator; DO NOT EDIT.
+
+//go:build threadsafe_coverage
+
+package expression
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// threadSafeCoverage records whether the generated SafeToShareAcrossSession method of each signature is invoked.
+var threadSafeCoverage = map[string]*atomic.Bool{
+`
+	coverageEntryTemp = `"%s": new(atomic.Bool),
+`
+	coverageFooter = `}
+
+func threadSafeCoverageHit(name string) {
+	threadSafeCoverage[name].Store(true)
+}
+
+// uncoveredThreadSafeMethods returns the signatures whose generated SafeToShareAcrossSession methods are never invoked.
+func uncoveredThreadSafeMethods() []string {
+	names := make([]string, 0)
+	for name, hit := range threadSafeCoverage {
+		if !hit.Load() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+`
+
+	noCoverageCode = `// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by go generate in expression/generator; DO NOT EDIT.
+
+//go:build !threadsafe_coverage
+
+package expression
+
+func threadSafeCoverageHit(string) {}
+`
+
+	locationsHeader = `// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by go generate in expression/generator; DO NOT EDIT.
+
+package expression
+
+// builtinSourceLocations maps the name of each signature to the file and line where it is declared.
+var builtinSourceLocations = map[string]string{
+`
+	locationEntryTemp = `"%s": "%s",
 `
 )
@@ -0,0 +1,827 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const fixtureBuiltins = `package expression
+
+type builtinSafeSig struct {
+	baseBuiltinFunc
+}
+
+type builtinSafeCastSig struct {
+	baseBuiltinCastFunc
+}
+
+type builtinUnsafeSig struct {
+	baseBuiltinFunc
+	buf []byte
+}
+`
+
+func writeFixture(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+	return file
+}
+
+func TestClassifyBuiltinFuncs(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins)
+	writeFixture(t, dir, "builtin_fixture_test.go",
+		"package expression\n\ntype builtinTestSig struct {\n\tbaseBuiltinFunc\n}\n")
+	safe, unsafe := classifyBuiltinFuncs(dir, nil)
+	require.Equal(t, []string{"builtinSafeCastSig", "builtinSafeSig"}, safe)
+	require.Equal(t, []string{"builtinUnsafeSig"}, unsafe)
+}
+
+func TestClassifyGenericBuiltinFuncs(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFixture(t, dir, "builtin_generic.go", `package expression
+
+type builtinGenericSig struct {
+	baseBuiltinFunc[int64]
+}
+
+type builtinGenericCastSig struct {
+	baseBuiltinCastFunc[int64, string]
+}
+
+type builtinGenericUnsafeSig struct {
+	baseBuiltinFunc[int64]
+	buf []byte
+}
+
+type builtinOtherGenericSig struct {
+	otherBaseFunc[int64]
+}
+`)
+	safe, unsafe := collectThreadSafeBuiltinFuncs(file)
+	require.Equal(t, []string{"builtinGenericSig", "builtinGenericCastSig"}, safe)
+	require.Equal(t, []string{"builtinGenericUnsafeSig", "builtinOtherGenericSig"}, unsafe)
+}
+
+func TestCustomSafeBaseTypes(t *testing.T) {
+	dir := t.TempDir()
+	basesFile := writeFixture(t, dir, "safe_bases.txt", "# the base of the aggregate signatures\n\nbaseBuiltinAggFunc\n")
+	names, err := loadSafeBaseTypes(basesFile)
+	require.NoError(t, err)
+	require.Equal(t, []string{"baseBuiltinAggFunc"}, names)
+
+	_, err = loadSafeBaseTypes(writeFixture(t, dir, "invalid_bases.txt", "base builtin\n"))
+	require.ErrorContains(t, err, "invalid base type name")
+
+	file := writeFixture(t, dir, "builtin_agg.go", `package expression
+
+type builtinAggSig struct {
+	baseBuiltinAggFunc
+}
+
+type builtinSafeSig struct {
+	baseBuiltinFunc
+}
+`)
+	safe, unsafe := collectThreadSafeBuiltinFuncs(file)
+	require.Equal(t, []string{"builtinSafeSig"}, safe)
+	require.Equal(t, []string{"builtinAggSig"}, unsafe)
+
+	origin := maps.Clone(safeBaseTypes)
+	t.Cleanup(func() { safeBaseTypes = origin })
+	for _, name := range names {
+		safeBaseTypes[name] = struct{}{}
+	}
+	safe, unsafe = collectThreadSafeBuiltinFuncs(file)
+	require.Equal(t, []string{"builtinAggSig", "builtinSafeSig"}, safe)
+	require.Empty(t, unsafe)
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	specs := []string{
+		"type builtinASig struct {\n\tbaseBuiltinFunc\n}\n",
+		"type builtinBSig struct {\n\tbaseBuiltinFunc\n\tbuf []byte\n}\n",
+		"type builtinCSig struct {\n\tbaseBuiltinCastFunc\n}\n",
+		"type builtinDSig struct {\n\tbaseBuiltinFunc\n\tbuf []byte\n}\n",
+		"type builtinESig struct {\n\tbaseBuiltinFunc\n\tbuf []byte\n}\n",
+		"type builtinFSig struct {\n\tbaseBuiltinFunc\n}\n",
+	}
+	generate := func(order []int) (safe, unsafe []byte) {
+		dir := t.TempDir()
+		// split the type specs into two files to shuffle the order across the files as well
+		var first, second strings.Builder
+		first.WriteString("package expression\n\n")
+		second.WriteString("package expression\n\n")
+		for i, idx := range order {
+			if i%2 == 0 {
+				first.WriteString(specs[idx])
+			} else {
+				second.WriteString(specs[idx])
+			}
+		}
+		writeFixture(t, dir, "builtin_a.go", first.String())
+		writeFixture(t, dir, "builtin_b.go", second.String())
+		safeFuncs, unsafeFuncs := classifyBuiltinFuncs(dir, nil)
+		return genBuiltinThreadSafeCode(safeFuncs, unsafeFuncs, defaultGenOptions)
+	}
+
+	expectedSafe, expectedUnsafe := generate([]int{0, 1, 2, 3, 4, 5})
+	rng := rand.New(rand.NewSource(1))
+	for range 10 {
+		safe, unsafe := generate(rng.Perm(len(specs)))
+		require.Equal(t, string(expectedSafe), string(safe))
+		require.Equal(t, string(expectedUnsafe), string(unsafe))
+	}
+}
+
+func TestCheckGolden(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins)
+	safe, unsafe := classifyBuiltinFuncs(dir, nil)
+	golden := genGolden(safe, unsafe)
+	require.Equal(t, "safe builtinSafeCastSig\nsafe builtinSafeSig\nunsafe builtinUnsafeSig\n", string(golden))
+
+	// matching golden
+	goldenFile := writeFixture(t, dir, goldenFileName, string(golden))
+	require.NoError(t, checkGolden(goldenFile, safe, unsafe))
+
+	// new functions should not be regarded as drifted
+	require.NoError(t, checkGolden(goldenFile, append(safe, "builtinNewSig"), unsafe))
+
+	// drifted golden
+	writeFixture(t, dir, goldenFileName, "safe builtinSafeCastSig\nunsafe builtinSafeSig\nsafe builtinUnsafeSig\n")
+	err := checkGolden(goldenFile, safe, unsafe)
+	require.ErrorContains(t, err, "builtinSafeSig: unsafe -> safe")
+	require.ErrorContains(t, err, "builtinUnsafeSig: safe -> unsafe")
+	require.NotContains(t, err.Error(), "builtinSafeCastSig")
+
+	// invalid golden
+	writeFixture(t, dir, goldenFileName, "unknown builtinSafeSig\n")
+	require.ErrorContains(t, checkGolden(goldenFile, safe, unsafe), "invalid line")
+}
+
+func TestFindValueReceiverEvalMethods(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins+`
+func (b *builtinSafeSig) evalInt(ctx EvalContext, row chunk.Row) (int64, bool, error) {
+	return 0, false, nil
+}
+
+func (b builtinUnsafeSig) evalString(ctx EvalContext, row chunk.Row) (string, bool, error) {
+	return "", false, nil
+}
+
+func (b builtinUnsafeSig) vecEvalString(ctx EvalContext, input *chunk.Chunk, result *chunk.Column) error {
+	return nil
+}
+
+func (b builtinSafeCastSig) Clone() builtinFunc {
+	return nil
+}
+`)
+	methods := findValueReceiverEvalMethods(file)
+	require.Len(t, methods, 2)
+	require.Contains(t, methods[0], "builtinUnsafeSig.evalString")
+	require.Contains(t, methods[1], "builtinUnsafeSig.vecEvalString")
+}
+
+func TestClassificationCache(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins)
+	cacheFile := filepath.Join(dir, "cache.json")
+
+	// missing cache file
+	cache := loadClassificationCache(cacheFile, "v1")
+	require.Equal(t, "v1", cache.Version)
+	require.Empty(t, cache.Files)
+	safe, unsafe := classifyBuiltinFuncs(dir, cache)
+	require.Equal(t, []string{"builtinSafeCastSig", "builtinSafeSig"}, safe)
+	require.Equal(t, []string{"builtinUnsafeSig"}, unsafe)
+	require.Len(t, cache.Files, 1)
+	require.NoError(t, cache.save(cacheFile))
+
+	// the cached result is used if the file is not changed
+	cache = loadClassificationCache(cacheFile, "v1")
+	require.Len(t, cache.Files, 1)
+	cached := cache.Files[file]
+	cached.SafeFuncs = []string{"builtinCachedSig"}
+	cache.Files[file] = cached
+	safe, _ = classifyBuiltinFuncs(dir, cache)
+	require.Equal(t, []string{"builtinCachedSig"}, safe)
+	require.NoError(t, cache.save(cacheFile))
+
+	// the cache is discarded if the generator version changes
+	cache = loadClassificationCache(cacheFile, "v2")
+	require.Equal(t, "v2", cache.Version)
+	require.Empty(t, cache.Files)
+	safe, _ = classifyBuiltinFuncs(dir, cache)
+	require.Equal(t, []string{"builtinSafeCastSig", "builtinSafeSig"}, safe)
+
+	// the file is classified again if its content changes
+	cache = loadClassificationCache(cacheFile, "v1")
+	writeFixture(t, dir, "builtin_fixture.go", "package expression\n\ntype builtinNewSig struct {\n\tbaseBuiltinFunc\n}\n")
+	safe, unsafe = classifyBuiltinFuncs(dir, cache)
+	require.Equal(t, []string{"builtinNewSig"}, safe)
+	require.Empty(t, unsafe)
+
+	// corrupted cache file
+	writeFixture(t, dir, "cache.json", "{")
+	cache = loadClassificationCache(cacheFile, "v1")
+	require.Empty(t, cache.Files)
+
+	version, err := generatorVersion()
+	require.NoError(t, err)
+	require.NotEmpty(t, version)
+}
+
+func TestForceUnsafeMarker(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", `package expression
+
+// builtinForceUnsafeSig looks safe, but it reaches the shared state via the buffers of its base.
+// threadsafe:force-unsafe
+type builtinForceUnsafeSig struct {
+	baseBuiltinFunc
+}
+
+type (
+	// threadsafe:force-unsafe
+	builtinGroupedForceUnsafeSig struct {
+		baseBuiltinFunc
+	}
+
+	// builtinGroupedSafeSig is safe.
+	builtinGroupedSafeSig struct {
+		baseBuiltinFunc
+	}
+)
+
+// builtinSafeSig mentions threadsafe:force-unsafe but is not marked.
+type builtinSafeSig struct {
+	baseBuiltinFunc
+}
+`)
+	safe, unsafe := classifyBuiltinFuncs(dir, nil)
+	require.Equal(t, []string{"builtinGroupedSafeSig", "builtinSafeSig"}, safe)
+	require.Equal(t, []string{"builtinForceUnsafeSig", "builtinGroupedForceUnsafeSig"}, unsafe)
+
+	safeCode, unsafeCode := genBuiltinThreadSafeCode(safe, unsafe, defaultGenOptions)
+	require.NotContains(t, string(safeCode), "builtinForceUnsafeSig")
+	require.Contains(t, string(unsafeCode), "func (s *builtinForceUnsafeSig) SafeToShareAcrossSession() bool {\n\treturn false\n}")
+}
+
+func TestSpecialUnsafeFuncs(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins)
+	origin := maps.Clone(specialUnsafeFuncs)
+	t.Cleanup(func() { specialUnsafeFuncs = origin })
+	specialUnsafeFuncs["builtinSafeSig"] = struct{}{}
+
+	safe, unsafe := classifyBuiltinFuncs(dir, nil)
+	require.Equal(t, []string{"builtinSafeCastSig"}, safe)
+	require.Equal(t, []string{"builtinSafeSig", "builtinUnsafeSig"}, unsafe)
+}
+
+func TestNondeterministicFuncsUnsafe(t *testing.T) {
+	// the nondeterministic signatures look safe as they only have the base field
+	var fixture strings.Builder
+	fixture.WriteString("package expression\n")
+	for _, name := range []string{"builtinUUIDSig", "builtinSleepSig", "builtinLastInsertIDSig"} {
+		require.Contains(t, specialUnsafeFuncs, name)
+		fmt.Fprintf(&fixture, "\ntype %s struct {\n\tbaseBuiltinFunc\n}\n", name)
+	}
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", fixture.String())
+
+	safe, unsafe := classifyBuiltinFuncs(dir, nil)
+	require.Empty(t, safe)
+	require.Equal(t, []string{"builtinLastInsertIDSig", "builtinSleepSig", "builtinUUIDSig"}, unsafe)
+	safeCode, _ := genBuiltinThreadSafeCode(safe, unsafe, defaultGenOptions)
+	for name := range specialUnsafeFuncs {
+		require.NotContains(t, string(safeCode), name)
+	}
+}
+
+func TestStatefulInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins+`
+type builtinResettableSig struct {
+	baseBuiltinFunc
+}
+
+func (b *builtinResettableSig) Reset() {}
+
+type builtinResettableValueSig struct {
+	baseBuiltinFunc
+}
+
+func (b builtinResettableValueSig) Reset() {}
+`)
+	// the method is declared in another file of the signature
+	writeFixture(t, dir, "builtin_other.go", `package expression
+
+func (b *builtinSafeCastSig) Reset() {}
+
+func (b *builtinSafeSig) evalInt(ctx EvalContext, row chunk.Row) (int64, bool, error) {
+	return 0, false, nil
+}
+`)
+	// the fixtures implement no stateful interface declared by default
+	safe, unsafe := classifyBuiltinFuncs(dir, nil)
+	require.Equal(t, []string{
+		"builtinResettableSig", "builtinResettableValueSig", "builtinSafeCastSig", "builtinSafeSig",
+	}, safe)
+	require.Equal(t, []string{"builtinUnsafeSig"}, unsafe)
+
+	origin := maps.Clone(statefulInterfaces)
+	t.Cleanup(func() { statefulInterfaces = origin })
+	statefulInterfaces = map[string][]string{"ResettableSig": {"Reset"}}
+	safe, unsafe = classifyBuiltinFuncs(dir, nil)
+	require.Equal(t, []string{"builtinSafeSig"}, safe)
+	require.Equal(t, []string{
+		"builtinResettableSig", "builtinResettableValueSig", "builtinSafeCastSig", "builtinUnsafeSig",
+	}, unsafe)
+
+	// the methods are merged from the cached results too
+	cache := loadClassificationCache(filepath.Join(dir, "cache.json"), "v1")
+	classifyBuiltinFuncs(dir, cache)
+	safe, unsafe = classifyBuiltinFuncs(dir, cache)
+	require.Equal(t, []string{"builtinSafeSig"}, safe)
+	require.Len(t, unsafe, 4)
+
+	statefulInterfaces = map[string][]string{"StatefulSig": {"evalInt"}}
+	safe, unsafe = classifyBuiltinFuncs(dir, nil)
+	require.Equal(t, []string{"builtinResettableSig", "builtinResettableValueSig", "builtinSafeCastSig"}, safe)
+	require.Equal(t, []string{"builtinSafeSig", "builtinUnsafeSig"}, unsafe)
+}
+
+func TestDefaultStatefulInterfaces(t *testing.T) {
+	// the default stateful interfaces are implemented by the signatures of the package
+	sigMethods := make(map[string][]string)
+	for _, file := range builtinSourceFiles("..") {
+		for sig, methods := range collectSigMethods(filepath.Join("..", file)) {
+			sigMethods[sig] = append(sigMethods[sig], methods...)
+		}
+	}
+	stateful := findStatefulSigs(sigMethods)
+	for iface, methods := range statefulInterfaces {
+		for _, method := range methods {
+			require.Contains(t, slices.Collect(maps.Values(stateful)), iface+"."+method)
+		}
+	}
+	require.Equal(t, "patternMemorizer.tryToVecMemorize", stateful["builtinIlikeSig"])
+}
+
+func TestCheckSpecialFuncs(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins+`
+type builtinInIntSig struct {
+	baseBuiltinFunc
+	hashSet map[int64]bool
+}
+`)
+	originSafe, originUnsafe := maps.Clone(specialSafeFuncs), maps.Clone(specialUnsafeFuncs)
+	t.Cleanup(func() { specialSafeFuncs, specialUnsafeFuncs = originSafe, originUnsafe })
+	specialSafeFuncs = map[string]struct{}{"builtinInIntSig": {}}
+	specialUnsafeFuncs = map[string]struct{}{"builtinSafeSig": {}}
+	require.NoError(t, checkSpecialFuncs(classifyBuiltinFuncs(dir, nil)))
+
+	// delete the referenced signatures
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(fixtureBuiltins, "builtinSafeSig", "builtinRenamedSig", 1)), 0644))
+	err := checkSpecialFuncs(classifyBuiltinFuncs(dir, nil))
+	require.ErrorContains(t, err, "the special functions do not exist")
+	require.ErrorContains(t, err, "builtinInIntSig, builtinSafeSig")
+}
+
+func TestImmutableFieldMarker(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", `package expression
+
+type builtinImmutableSig struct {
+	baseBuiltinFunc
+
+	// threadsafe:immutable
+	collator collate.Collator
+}
+
+type builtinMutableSig struct {
+	baseBuiltinCastFunc
+
+	// buf is reused across the evaluations.
+	buf []byte
+}
+
+type builtinPartlyImmutableSig struct {
+	baseBuiltinFunc
+
+	// threadsafe:immutable
+	constant int64
+	buf      []byte
+}
+
+type builtinNoBaseSig struct {
+	// threadsafe:immutable
+	constant int64
+}
+`)
+	safe, unsafe := classifyBuiltinFuncs(dir, nil)
+	require.Equal(t, []string{"builtinImmutableSig"}, safe)
+	require.Equal(t, []string{"builtinMutableSig", "builtinNoBaseSig", "builtinPartlyImmutableSig"}, unsafe)
+}
+
+func TestThreadSafeReport(t *testing.T) {
+	dir := t.TempDir()
+	prevSafeCode, prevUnsafeCode := genBuiltinThreadSafeCode(
+		[]string{"builtinArithmeticPlusIntSig", "builtinSafeSig"}, []string{"builtinPromotedSig"}, defaultGenOptions)
+	safeFile := writeFixture(t, dir, safeFileName, string(prevSafeCode))
+	unsafeFile := writeFixture(t, dir, unsafeFileName, string(prevUnsafeCode))
+
+	prevSafe, err := collectGeneratedFuncs([]string{safeFile, filepath.Join(dir, shardFileName(0))}, defaultGenOptions.Method)
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{"builtinArithmeticPlusIntSig": {}, "builtinSafeSig": {}}, prevSafe)
+	prevUnsafe, err := collectGeneratedFuncs([]string{unsafeFile}, defaultGenOptions.Method)
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{"builtinPromotedSig": {}}, prevUnsafe)
+
+	// the added functions should not be reported
+	report := genThreadSafeReport(prevSafe, prevUnsafe,
+		[]string{"builtinPromotedSig", "builtinSafeSig", "builtinNewSafeSig"},
+		[]string{"builtinArithmeticPlusIntSig", "builtinNewUnsafeSig"})
+	require.Equal(t, "newly unsafe (1):\n  builtinArithmeticPlusIntSig\nnewly safe (1):\n  builtinPromotedSig\n", string(report))
+
+	report = genThreadSafeReport(prevSafe, prevUnsafe,
+		[]string{"builtinArithmeticPlusIntSig", "builtinSafeSig"}, []string{"builtinPromotedSig"})
+	require.Equal(t, "newly unsafe (0):\nnewly safe (0):\n", string(report))
+}
+
+func TestAppendTrend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), trendFileName)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, appendTrend(file, now, 500, 90))
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "timestamp,safe,unsafe\n2024-01-02T03:04:05Z,500,90\n", string(content))
+
+	// a new line should be appended without the header
+	require.NoError(t, appendTrend(file, now.Add(time.Hour).In(time.FixedZone("UTC+8", 8*3600)), 505, 86))
+	content, err = os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "timestamp,safe,unsafe\n2024-01-02T03:04:05Z,500,90\n2024-01-02T04:04:05Z,505,86\n", string(content))
+}
+
+func TestShardSafeFuncs(t *testing.T) {
+	funcNames := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		funcNames = append(funcNames, fmt.Sprintf("builtin%dSig", i))
+	}
+	shards := genBuiltinThreadSafeShards(funcNames, 4, defaultGenOptions)
+	require.Len(t, shards, 4)
+	for i, name := range funcNames {
+		method := fmt.Sprintf("func (s *%s) SafeToShareAcrossSession() bool", name)
+		found := 0
+		for _, shard := range shards {
+			found += strings.Count(string(shard), method)
+		}
+		require.Equal(t, 1, found, "function %d", i)
+	}
+	// only the first shard contains the helper function
+	for i, shard := range shards {
+		require.Equal(t, i == 0, strings.Contains(string(shard), "func safeToShareAcrossSession("))
+		require.Equal(t, i == 0, strings.Contains(string(shard), `import "sync/atomic"`))
+	}
+	// the assignment is deterministic
+	require.Equal(t, shards, genBuiltinThreadSafeShards(funcNames, 4, defaultGenOptions))
+	// a function stays in the same shard when other functions are removed
+	for i, names := range shardFuncNames(funcNames[:50], 4) {
+		require.Subset(t, shardFuncNames(funcNames, 4)[i], names)
+	}
+
+	// write the shards and remove the stale files
+	dir := t.TempDir()
+	writeFixture(t, dir, safeFileName, "stale")
+	writeFixture(t, dir, shardFileName(5), "stale")
+	writeFixture(t, dir, "builtin_other.go", "other")
+	files := make(map[string][]byte)
+	for i, shard := range shards {
+		files[shardFileName(i)] = shard
+	}
+	require.NoError(t, writeSafeFiles(dir, files))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Equal(t, []string{
+		"builtin_other.go",
+		"builtin_threadsafe_generated_0.go",
+		"builtin_threadsafe_generated_1.go",
+		"builtin_threadsafe_generated_2.go",
+		"builtin_threadsafe_generated_3.go",
+	}, names)
+}
+
+func TestSplitSafeFuncs(t *testing.T) {
+	funcNames := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		funcNames = append(funcNames, fmt.Sprintf("builtin%03dSig", i))
+	}
+	for _, maxMethods := range []int{1, 7, 50, 100, 200} {
+		files := genBuiltinThreadSafeSplit(funcNames, maxMethods, defaultGenOptions)
+		require.Len(t, files, (len(funcNames)+maxMethods-1)/maxMethods)
+		found := make(map[string]int, len(funcNames))
+		for i, file := range files {
+			methods := strings.Count(string(file), ") SafeToShareAcrossSession() bool {")
+			require.LessOrEqual(t, methods, maxMethods, "file %d", i)
+			for _, name := range funcNames {
+				found[name] += strings.Count(string(file), fmt.Sprintf("func (s *%s) SafeToShareAcrossSession", name))
+			}
+			// only the first file contains the helper function
+			require.Equal(t, i == 0, strings.Contains(string(file), "func safeToShareAcrossSession("))
+		}
+		for _, name := range funcNames {
+			require.Equal(t, 1, found[name], name)
+		}
+		// the split is deterministic
+		require.Equal(t, files, genBuiltinThreadSafeSplit(funcNames, maxMethods, defaultGenOptions))
+	}
+	require.Equal(t, [][]string{{"builtin000Sig", "builtin001Sig"}, {"builtin002Sig"}}, splitFuncNames(funcNames[:3], 2))
+
+	// the helper function is still generated without any safe function
+	files := genBuiltinThreadSafeSplit(nil, 10, defaultGenOptions)
+	require.Len(t, files, 1)
+	require.Contains(t, string(files[0]), "func safeToShareAcrossSession(")
+}
+
+func TestCoverageHooks(t *testing.T) {
+	funcNames := []string{"builtinASig", "builtinBSig", "builtinCSig"}
+	safeCode, _ := genBuiltinThreadSafeCode(funcNames, nil, defaultGenOptions)
+	require.NotContains(t, string(safeCode), "threadSafeCoverageHit")
+
+	opts := defaultGenOptions
+	opts.Coverage = true
+	safeCode, _ = genBuiltinThreadSafeCode(funcNames, nil, opts)
+	for _, shard := range append(genBuiltinThreadSafeShards(funcNames, 2, opts), safeCode) {
+		require.Equal(t, strings.Count(string(shard), "SafeToShareAcrossSession() bool {"),
+			strings.Count(string(shard), "threadSafeCoverageHit("))
+	}
+	for _, name := range funcNames {
+		require.Contains(t, string(safeCode), fmt.Sprintf("threadSafeCoverageHit(%q)", name))
+	}
+
+	// the registry should be populated with all the safe methods
+	coverageCode, noCoverageCode := genCoverageCode(funcNames, defaultGenOptions)
+	require.Contains(t, string(coverageCode), "//go:build threadsafe_coverage\n")
+	require.Contains(t, string(noCoverageCode), "//go:build !threadsafe_coverage\n")
+	require.Contains(t, string(noCoverageCode), "func threadSafeCoverageHit(string) {}")
+	f, err := parser.ParseFile(token.NewFileSet(), coverageFileName, coverageCode, 0)
+	require.NoError(t, err)
+	registered := make([]string, 0, len(funcNames))
+	ast.Inspect(f, func(n ast.Node) bool {
+		if kv, ok := n.(*ast.KeyValueExpr); ok {
+			name, err := strconv.Unquote(kv.Key.(*ast.BasicLit).Value)
+			require.NoError(t, err)
+			registered = append(registered, name)
+		}
+		return true
+	})
+	require.Equal(t, funcNames, registered)
+}
+
+func TestSourceLocations(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins)
+	writeFixture(t, dir, "builtin_other.go", "package expression\n\ntype builtinOtherSig struct {\n\tbaseBuiltinFunc\n}\n")
+	writeFixture(t, dir, "builtin_other_test.go", "package expression\n\ntype builtinTestSig struct {\n\tbaseBuiltinFunc\n}\n")
+	locations := collectSourceLocations(dir, nil)
+	require.Equal(t, map[string]string{
+		"builtinSafeSig":     "builtin_fixture.go:3",
+		"builtinSafeCastSig": "builtin_fixture.go:7",
+		"builtinUnsafeSig":   "builtin_fixture.go:11",
+		"builtinOtherSig":    "builtin_other.go:3",
+	}, locations)
+
+	code := genSourceLocationsCode(locations, defaultGenOptions)
+	require.Contains(t, string(code), generatedMarker)
+	f, err := parser.ParseFile(token.NewFileSet(), locationsFileName, code, 0)
+	require.NoError(t, err)
+	generated := make(map[string]string, len(locations))
+	ast.Inspect(f, func(n ast.Node) bool {
+		if kv, ok := n.(*ast.KeyValueExpr); ok {
+			name, err := strconv.Unquote(kv.Key.(*ast.BasicLit).Value)
+			require.NoError(t, err)
+			location, err := strconv.Unquote(kv.Value.(*ast.BasicLit).Value)
+			require.NoError(t, err)
+			generated[name] = location
+		}
+		return true
+	})
+	require.Equal(t, locations, generated)
+}
+
+func TestPostGenHook(t *testing.T) {
+	// an empty command does nothing
+	require.NoError(t, runPostGenHook("", []string{safeFileName}))
+	require.NoError(t, runPostGenHook("  ", []string{safeFileName}))
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "args.txt")
+	script := writeFixture(t, dir, "postgen.sh", "#!/bin/sh\nprintf '%s\\n' \"$@\" > "+output+"\n")
+	require.NoError(t, os.Chmod(script, 0755))
+	require.NoError(t, runPostGenHook(script+" --flag", []string{safeFileName, unsafeFileName}))
+	args, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, "--flag\n"+safeFileName+"\n"+unsafeFileName+"\n", string(args))
+
+	// the error of the command should be returned
+	require.Error(t, runPostGenHook(filepath.Join(dir, "not-exist"), []string{safeFileName}))
+}
+
+func TestCheckGeneratedFiles(t *testing.T) {
+	dir := t.TempDir()
+	safeCode, unsafeCode := genBuiltinThreadSafeCode([]string{"builtinASig", "builtinBSig"}, []string{"builtinCSig"}, defaultGenOptions)
+	writeFixture(t, dir, safeFileName, string(safeCode))
+	writeFixture(t, dir, unsafeFileName, string(unsafeCode))
+	files := map[string][]byte{safeFileName: safeCode, unsafeFileName: unsafeCode}
+	diff, err := checkGeneratedFiles(dir, files)
+	require.NoError(t, err)
+	require.Empty(t, diff)
+
+	// builtinCSig becomes safe
+	safeCode, unsafeCode = genBuiltinThreadSafeCode([]string{"builtinASig", "builtinBSig", "builtinCSig"}, nil, defaultGenOptions)
+	files = map[string][]byte{safeFileName: safeCode, unsafeFileName: unsafeCode}
+	diff, err = checkGeneratedFiles(dir, files)
+	require.NoError(t, err)
+	require.Contains(t, diff, "--- a/"+safeFileName+"\n+++ b/"+safeFileName+"\n")
+	require.Contains(t, diff, "--- a/"+unsafeFileName+"\n+++ b/"+unsafeFileName+"\n")
+	require.Contains(t, diff, "\n+func (s *builtinCSig) SafeToShareAcrossSession() bool {\n")
+	require.Contains(t, diff, "\n-func (s *builtinCSig) SafeToShareAcrossSession() bool {\n")
+	require.NotContains(t, diff, "builtinASig")
+	require.NotContains(t, diff, "builtinBSig")
+
+	// the stale generated files should be reported
+	writeFixture(t, dir, shardFileName(1), "package expression\n")
+	writeFixture(t, dir, safeFileName, string(safeCode))
+	writeFixture(t, dir, unsafeFileName, string(unsafeCode))
+	diff, err = checkGeneratedFiles(dir, files)
+	require.NoError(t, err)
+	require.Equal(t, "--- a/"+shardFileName(1)+"\n+++ b/"+shardFileName(1)+"\n@@ line 1 @@\n-package expression\n", diff)
+
+	// too many changed lines are not diffed line by line
+	var oldLines, newLines strings.Builder
+	for i := range 1100 {
+		fmt.Fprintf(&oldLines, "old %d\n", i)
+		fmt.Fprintf(&newLines, "new %d\n", i)
+	}
+	diff = lineDiff("large.go", []byte("same\n"+oldLines.String()), []byte("same\n"+newLines.String()))
+	require.Equal(t, "--- a/large.go\n+++ b/large.go\n@@ line 2 @@\n"+
+		"files differ: 1100 lines replaced by 1100 lines, too many to diff\n", diff)
+}
+
+func TestCustomInterfaceName(t *testing.T) {
+	// the default options generate the same methods as before
+	safeCode, unsafeCode := genBuiltinThreadSafeCode([]string{"builtinASig"}, []string{"builtinBSig"}, defaultGenOptions)
+	require.Contains(t, string(safeCode), "// SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.\n"+
+		"func (s *builtinASig) SafeToShareAcrossSession() bool {\n")
+	require.Contains(t, string(unsafeCode), "// SafeToShareAcrossSession implements BuiltinFunc.SafeToShareAcrossSession.\n"+
+		"func (s *builtinBSig) SafeToShareAcrossSession() bool {\n")
+	require.NotContains(t, string(safeCode), "var _ ")
+
+	opts := genOptions{Interface: "SharableFunc", Method: "Sharable", AssertInterface: true}
+	safeCode, unsafeCode = genBuiltinThreadSafeCode([]string{"builtinASig"}, []string{"builtinBSig"}, opts)
+	require.Contains(t, string(safeCode), "// Sharable implements SharableFunc.Sharable.\n"+
+		"func (s *builtinASig) Sharable() bool {\n")
+	require.Contains(t, string(safeCode), "\nvar _ SharableFunc = &builtinASig{}\n")
+	require.Contains(t, string(unsafeCode), "// Sharable implements SharableFunc.Sharable.\n"+
+		"func (s *builtinBSig) Sharable() bool {\n")
+	require.Contains(t, string(unsafeCode), "\nvar _ SharableFunc = &builtinBSig{}\n")
+	require.NotContains(t, string(safeCode)+string(unsafeCode), ") SafeToShareAcrossSession() bool")
+	require.True(t, strings.HasSuffix(string(safeCode), "\n\nvar _ SharableFunc = &builtinASig{}\n"))
+	for _, shard := range genBuiltinThreadSafeShards([]string{"builtinASig", "builtinBSig"}, 2, opts) {
+		require.Equal(t, strings.Count(string(shard), ") Sharable() bool {"), strings.Count(string(shard), "var _ SharableFunc"))
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFixture(t, dir, "builtin_fixture.go", fixtureBuiltins)
+	var regenerated atomic.Int32
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchDir(dir, 50*time.Millisecond, stop, func() { regenerated.Add(1) })
+	}()
+
+	// the generated files and the test files should not trigger the regeneration
+	writeFixture(t, dir, safeFileName, "package expression\n")
+	writeFixture(t, dir, shardFileName(0), "package expression\n")
+	writeFixture(t, dir, unsafeFileName, "package expression\n")
+	writeFixture(t, dir, "builtin_fixture_test.go", "package expression\n")
+	time.Sleep(200 * time.Millisecond)
+	require.Zero(t, regenerated.Load())
+
+	// the rapid successive writes should trigger only one regeneration
+	for i := range 3 {
+		require.NoError(t, os.WriteFile(file, []byte(fixtureBuiltins+strings.Repeat("\n", i+1)), 0644))
+	}
+	require.Eventually(t, func() bool { return regenerated.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(1), regenerated.Load())
+
+	close(stop)
+	require.NoError(t, <-done)
+}
+
+func TestEmbedCommit(t *testing.T) {
+	funcNames := []string{"builtinSafeSig"}
+	for _, commit := range []string{"", "0123456789abcdef"} {
+		t.Setenv(commitEnv, commit)
+		opts := defaultGenOptions
+		opts.Commit = commitFromEnv()
+		safeCode, unsafeCode := genBuiltinThreadSafeCode(funcNames, funcNames, opts)
+		coverageCode, noCoverageCode := genCoverageCode(funcNames, opts)
+		for _, code := range [][]byte{safeCode, unsafeCode, coverageCode, noCoverageCode} {
+			if commit == "" {
+				require.NotContains(t, string(code), "Source commit")
+			} else {
+				require.Contains(t, string(code), generatedMarker+"// Source commit: "+commit+"\n")
+			}
+		}
+	}
+}
+
+func TestCustomHeaderCompiled(t *testing.T) {
+	// a minimal package with the types referenced by the generated code
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module expression\n\ngo 1.21\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "builtin.go"), []byte(`package expression
+
+type Expression interface {
+	SafeToShareAcrossSession() bool
+}
+
+type baseBuiltinFunc struct {
+	args                         []Expression
+	safeToShareAcrossSessionFlag uint32
+}
+
+type builtinASig struct {
+	baseBuiltinFunc
+}
+
+type builtinBSig struct {
+	baseBuiltinFunc
+}
+`), 0644))
+	// a stale generated file on disk is excluded from the build
+	require.NoError(t, os.WriteFile(filepath.Join(dir, shardFileName(1)), []byte("package expression\n\nbroken"), 0644))
+
+	compile := func(opts genOptions) error {
+		safeCode, unsafeCode := genBuiltinThreadSafeCode([]string{"builtinASig"}, []string{"builtinBSig"}, opts)
+		return compileGeneratedFiles(dir, map[string][]byte{safeFileName: safeCode, unsafeFileName: unsafeCode})
+	}
+	require.NoError(t, compile(defaultGenOptions))
+
+	opts := defaultGenOptions
+	opts.UnsafeHeader = "// Code generated; DO NOT EDIT.\n\npackage expression\n"
+	require.False(t, defaultGenOptions.hasCustomHeader())
+	require.True(t, opts.hasCustomHeader())
+	require.NoError(t, compile(opts))
+
+	// the custom header imports the wrong package for the helper
+	opts.SafeHeader = strings.Replace(safeHeader, `import "sync/atomic"`, `import "sync"`, 1)
+	err := compile(opts)
+	require.ErrorContains(t, err, `"sync" imported and not used`)
+	require.ErrorContains(t, err, "undefined: atomic")
+	// nothing is written
+	_, err = os.Stat(filepath.Join(dir, safeFileName))
+	require.True(t, os.IsNotExist(err))
+}
@@ -2371,6 +2371,39 @@ func TestTimestamp(t *testing.T) {
 	require.Less(t, now2.UnixNano(), now3.UnixNano())
 }
 
+func TestTimestampDiffAcrossDST(t *testing.T) {
+	store := testkit.CreateMockStore(t)
+	tk := testkit.NewTestKit(t, store)
+	tk.MustExec("use test")
+	tk.MustExec("set time_zone = 'America/New_York'")
+	tk.MustExec("create table t(id int, a datetime(6), b datetime(6), ts_a timestamp(6), ts_b timestamp(6))")
+	// the clocks spring forward from 2024-03-10 02:00:00 to 03:00:00 in America/New_York
+	tk.MustExec("insert into t values " +
+		"(1, '2024-03-10 01:59:59.999999', '2024-03-10 03:00:00.000001', " +
+		"'2024-03-10 01:59:59.999999', '2024-03-10 03:00:00.000001'), " +
+		"(2, '2024-03-10 01:30:00', '2024-03-10 03:29:59.5', '2024-03-10 01:30:00', '2024-03-10 03:29:59.5')")
+
+	// like MySQL, the difference is computed between the date and time values in the session time zone, so the
+	// skipped hour is counted for both the datetime and the timestamp values, in both the scalar and the vectorized
+	// evaluation
+	for _, vectorized := range []string{"on", "off"} {
+		tk.MustExec("set @@tidb_enable_vectorized_expression = " + vectorized)
+		for _, cols := range [][2]string{{"a", "b"}, {"ts_a", "ts_b"}} {
+			sql := fmt.Sprintf("select id, "+
+				"timestampdiff(microsecond, %[1]s, %[2]s), timestampdiff(second, %[1]s, %[2]s), "+
+				"timestampdiff(minute, %[1]s, %[2]s), timestampdiff(microsecond, %[2]s, %[1]s), "+
+				"timestampdiff(second, %[2]s, %[1]s), timestampdiff(minute, %[2]s, %[1]s) from t order by id",
+				cols[0], cols[1])
+			tk.MustQuery(sql).Check(testkit.Rows(
+				"1 3600000002 3600 60 -3600000002 -3600 -60",
+				"2 7199500000 7199 119 -7199500000 -7199 -119",
+			))
+		}
+	}
+	tk.MustQuery("select timestampdiff(microsecond, '2024-03-10 01:59:59.999999', '2024-03-10 03:00:00.000001')").
+		Check(testkit.Rows("3600000002"))
+}
+
 func TestCastJSONTimeDuration(t *testing.T) {
 	store := testkit.CreateMockStore(t)
 	tk := testkit.NewTestKit(t, store)
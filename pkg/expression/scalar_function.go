@@ -52,6 +52,19 @@ func (sf *ScalarFunction) SafeToShareAcrossSession() bool {
 	return sf.Function.SafeToShareAcrossSession()
 }
 
+// ResetSafeToShareFlag clears the cached result of `SafeToShareAcrossSession`.
+// It is called by `SetArg`, which should be used to replace the args of the function in place.
+func (sf *ScalarFunction) ResetSafeToShareFlag() {
+	sf.Function.ResetSafeToShareFlag()
+}
+
+// SetArg replaces the i-th arg of the function in place and clears the cached result of `SafeToShareAcrossSession`,
+// which may be stale for the new arg. Assigning to `GetArgs()[i]` directly is rejected by the linter `setarg`.
+func (sf *ScalarFunction) SetArg(i int, arg Expression) {
+	sf.Function.getArgs()[i] = arg
+	sf.ResetSafeToShareFlag()
+}
+
 // VecEvalInt evaluates this expression in a vectorized manner.
 func (sf *ScalarFunction) VecEvalInt(ctx EvalContext, input *chunk.Chunk, result *chunk.Column) error {
 	intest.Assert(ctx != nil)
@@ -432,7 +445,7 @@ func (sf *ScalarFunction) ConstLevel() ConstLevel {
 // Decorrelate implements Expression interface.
 func (sf *ScalarFunction) Decorrelate(schema *Schema) Expression {
 	for i, arg := range sf.GetArgs() {
-		sf.GetArgs()[i] = arg.Decorrelate(schema)
+		sf.SetArg(i, arg.Decorrelate(schema))
 	}
 	return sf
 }
@@ -784,7 +797,7 @@ func (sf *ScalarFunction) RemapColumn(m map[int64]*Column) (Expression, error) {
 		if err != nil {
 			return nil, err
 		}
-		newSf.GetArgs()[i] = newArg
+		newSf.SetArg(i, newArg)
 	}
 	// clear hash code
 	newSf.hashcode = nil
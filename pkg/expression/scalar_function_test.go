@@ -115,6 +115,26 @@ func TestScalarFunction(t *testing.T) {
 	require.True(t, ok)
 }
 
+func TestScalarFunctionResetSafeToShareFlag(t *testing.T) {
+	a := &Column{
+		UniqueID: 1,
+		RetType:  types.NewFieldType(mysql.TypeDouble),
+	}
+	sf := newFunctionWithMockCtx(ast.LT, a, NewOne()).(*ScalarFunction)
+	require.True(t, sf.SafeToShareAcrossSession())
+
+	// SetArg replaces the arg in place and resets the cached answer.
+	corCol := &CorrelatedColumn{Column: *a, Data: new(types.Datum)}
+	sf.SetArg(0, corCol)
+	require.Equal(t, corCol, sf.GetArgs()[0])
+	require.False(t, sf.SafeToShareAcrossSession())
+
+	// Decorrelate rebuilds the args and resets the flag by itself.
+	sf.Decorrelate(NewSchema(a))
+	require.Equal(t, a, sf.GetArgs()[0])
+	require.True(t, sf.SafeToShareAcrossSession())
+}
+
 func TestIssue23309(t *testing.T) {
 	a := &Column{
 		UniqueID: 1,
@@ -403,9 +403,8 @@ func SetExprColumnInOperand(expr Expression) Expression {
 		col.InOperand = true
 		return col
 	case *ScalarFunction:
-		args := v.GetArgs()
-		for i, arg := range args {
-			args[i] = SetExprColumnInOperand(arg)
+		for i, arg := range v.GetArgs() {
+			v.SetArg(i, SetExprColumnInOperand(arg))
 		}
 	}
 	return expr
@@ -647,7 +646,7 @@ func SubstituteCorCol2Constant(ctx BuildContext, expr Expression) (Expression, e
 			newSf = BuildCastFunction(ctx, newArgs[0], x.RetType)
 		} else if x.FuncName.L == ast.Grouping {
 			newSf = x.Clone()
-			newSf.(*ScalarFunction).GetArgs()[0] = newArgs[0]
+			newSf.(*ScalarFunction).SetArg(0, newArgs[0])
 		} else {
 			newSf, err = NewFunction(ctx, x.FuncName.L, x.GetType(ctx.GetEvalCtx()), newArgs...)
 		}
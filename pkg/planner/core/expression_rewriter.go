@@ -1192,7 +1192,7 @@ func (er *expressionRewriter) handleInSubquery(ctx context.Context, planCtx *exp
 					rarg.InOperand = true
 					col = &rarg
 					if larg != nil {
-						lexpr.(*expression.ScalarFunction).GetArgs()[i] = expression.SetExprColumnInOperand(larg)
+						lexpr.(*expression.ScalarFunction).SetArg(i, expression.SetExprColumnInOperand(larg))
 					}
 				}
 			}
@@ -53,7 +53,7 @@ func ReplaceColumnOfExpr(expr expression.Expression, exprs []expression.Expressi
 		}
 	case *expression.ScalarFunction:
 		for i := range v.GetArgs() {
-			v.GetArgs()[i] = ReplaceColumnOfExpr(v.GetArgs()[i], exprs, schema)
+			v.SetArg(i, ReplaceColumnOfExpr(v.GetArgs()[i], exprs, schema))
 		}
 	}
 	return expr
@@ -0,0 +1,229 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"context"
+	"iter"
+	"slices"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/types"
+)
+
+// RowToWrite is a row to be encoded by `BatchEncoder`. The `Flags` are only used by the writes to the memBuffer.
+type RowToWrite struct {
+	ColIDs []int64
+	Row    []types.Datum
+	Key    kv.Key
+	Handle kv.Handle
+	Flags  []kv.FlagsOp
+}
+
+// RowWriteResult is the result of writing a row in `BatchEncoder.WriteRowsWithResults`.
+type RowWriteResult struct {
+	// BytesWritten is the size of the encoded row value written to the memBuffer.
+	BytesWritten int
+	// ChecksumWritten indicates whether the row level checksum is encoded in the value.
+	ChecksumWritten bool
+	// Err is the error to write the row, nil if the row is written successfully.
+	Err error
+}
+
+// KVPair is an encoded row emitted by `BatchEncoder.StreamEncode`.
+type KVPair struct {
+	Key   kv.Key
+	Value []byte
+}
+
+// BatchEncoder encodes and writes the rows of a bulk write, such as a multi-row INSERT or a bulk ingest pipeline,
+// with the encoding settings shared by all the rows. It is created by `MutateBuffers.BatchEncoder`, and the buffer
+// is reused for each row.
+type BatchEncoder struct {
+	buffer *EncodeRowBuffer
+	cfg    RowEncodingConfig
+	loc    *time.Location
+	ec     errctx.Context
+}
+
+// load resets the buffer with the values of the `row`.
+func (e *BatchEncoder) load(row *RowToWrite) error {
+	if len(row.ColIDs) != len(row.Row) {
+		return errors.Errorf("the row has %d column ids but %d values", len(row.ColIDs), len(row.Row))
+	}
+	e.buffer.Reset(len(row.Row))
+	e.buffer.AddColVals(row.ColIDs, row.Row)
+	return nil
+}
+
+func (e *BatchEncoder) writeRow(memBuffer kv.MemBuffer, row *RowToWrite) error {
+	if err := e.load(row); err != nil {
+		return err
+	}
+	return e.buffer.WriteMemBufferEncoded(e.cfg, e.loc, e.ec, memBuffer, row.Key, row.Handle, row.Flags...)
+}
+
+// WriteRows encodes and writes the rows yielded by `rows` to the memBuffer in order.
+// It stops at the first row failing to be encoded or written, for example, rejected by `ec.HandleError`. It returns
+// the count of the rows written, which is also the index of the failed row if the error is not nil.
+func (e *BatchEncoder) WriteRows(memBuffer kv.MemBuffer, rows iter.Seq[RowToWrite]) (int, error) {
+	written := 0
+	for row := range rows {
+		if err := e.writeRow(memBuffer, &row); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// WriteRowsWithResults is similar to `WriteRows`, but a failed row does not abort the whole batch, and it returns the
+// result of each row, so the caller can attribute the failures to the specific rows.
+func (e *BatchEncoder) WriteRowsWithResults(memBuffer kv.MemBuffer, rows iter.Seq[RowToWrite]) []RowWriteResult {
+	var results []RowWriteResult
+	for row := range rows {
+		if err := e.writeRow(memBuffer, &row); err != nil {
+			results = append(results, RowWriteResult{Err: err})
+			continue
+		}
+		results = append(results, RowWriteResult{
+			BytesWritten:    len(e.buffer.writeStmtBufs.RowValBuf),
+			ChecksumWritten: e.buffer.checksumWritten,
+		})
+	}
+	return results
+}
+
+// StreamEncode encodes the rows received from `in` and emits the encoded key-value pairs to `out` in order until
+// `in` is closed and all the encoded pairs are emitted. At most `window` rows are encoded ahead of the consumer: once
+// `window` encoded pairs are waiting for `out`, no more row is received from `in` until `out` accepts one, which
+// applies the backpressure to the producer. The emitted values are copies, so they are safe to retain.
+// It returns the first error to encode a row, or the error of `ctx` if it is done. The pairs still waiting for `out`
+// are dropped then. The `out` is not closed by it.
+func (e *BatchEncoder) StreamEncode(ctx context.Context, in <-chan RowToWrite, out chan<- KVPair, window int) error {
+	if window <= 0 {
+		return errors.Errorf("the in-flight window of the stream encoding must be positive, got %d", window)
+	}
+	pending := make([]KVPair, 0, window)
+	for in != nil || len(pending) > 0 {
+		// a nil channel blocks forever, so it disables the receiving when the window is full or `in` is closed,
+		// and the sending when there is nothing to emit
+		recv, send := in, out
+		if len(pending) == window {
+			recv = nil
+		}
+		var next KVPair
+		if len(pending) == 0 {
+			send = nil
+		} else {
+			next = pending[0]
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case row, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			if err := e.load(&row); err != nil {
+				return err
+			}
+			encoded, err := e.buffer.encodeForWrite(e.cfg, e.loc, e.ec, row.Key, row.Handle)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, KVPair{Key: row.Key, Value: slices.Clone(encoded)})
+		case send <- next:
+			pending = slices.Delete(pending, 0, 1)
+		}
+	}
+	return nil
+}
+
+// ColumnarBatch accumulates the rows filled in an `EncodeRowBuffer` into per-column arrays, that is, the
+// struct-of-arrays representation, which is used to export the rows to the columnar sinks.
+// Usage:
+// 1. Call `NewColumnarBatch` with the ids of the exported columns.
+// 2. For each row, fill the `EncodeRowBuffer` and call `ColumnarBatch.AppendRow`.
+// 3. Call `ColumnarBatch.Column` to get the values of each column.
+type ColumnarBatch struct {
+	colIDs  []int64
+	columns [][]types.Datum
+	numRows int
+}
+
+// NewColumnarBatch creates a `ColumnarBatch` of the columns `colIDs`.
+// The slice is referenced by the batch, so the caller should not modify it.
+func NewColumnarBatch(colIDs []int64) *ColumnarBatch {
+	return &ColumnarBatch{
+		colIDs:  colIDs,
+		columns: make([][]types.Datum, len(colIDs)),
+	}
+}
+
+// AppendRow appends the row in the buffer to the batch. The lazy columns of the buffer are evaluated.
+// A column of the batch which is not added to the buffer is appended as NULL, and an error is returned without
+// appending anything if the buffer has a column which is not in the batch.
+// The values are deep copied, so the buffer can be reset and reused for the next row.
+func (c *ColumnarBatch) AppendRow(buf *EncodeRowBuffer) error {
+	if err := buf.evalLazyColVals(); err != nil {
+		return err
+	}
+	for _, colID := range buf.colIDs {
+		if !slices.Contains(c.colIDs, colID) {
+			return errors.Errorf("column %d is not in the columnar batch", colID)
+		}
+	}
+	for i, colID := range c.colIDs {
+		var val types.Datum
+		if idx := slices.Index(buf.colIDs, colID); idx >= 0 {
+			buf.row[idx].Copy(&val)
+		}
+		c.columns[i] = append(c.columns[i], val)
+	}
+	c.numRows++
+	return nil
+}
+
+// NumRows returns the number of rows in the batch.
+func (c *ColumnarBatch) NumRows() int {
+	return c.numRows
+}
+
+// ColumnIDs returns the ids of the columns of the batch.
+func (c *ColumnarBatch) ColumnIDs() []int64 {
+	return c.colIDs
+}
+
+// Column returns the values of the column `colID` of all the rows in the batch, or nil if the column is not in
+// the batch. The returned slice is referenced by the batch until the next `Reset`.
+func (c *ColumnarBatch) Column(colID int64) []types.Datum {
+	if idx := slices.Index(c.colIDs, colID); idx >= 0 {
+		return c.columns[idx]
+	}
+	return nil
+}
+
+// Reset removes all the rows from the batch and keeps the capacity of the columns.
+func (c *ColumnarBatch) Reset() {
+	for i := range c.columns {
+		c.columns[i] = c.columns[i][:0]
+	}
+	c.numRows = 0
+}
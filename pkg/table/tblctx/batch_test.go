@@ -0,0 +1,306 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchEncoderWriteRowsWithResults(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}, IsRowLevelChecksumEnabled: true}
+	rows := []RowToWrite{
+		{
+			ColIDs: []int64{1, 2},
+			Row:    []types.Datum{types.NewIntDatum(1), types.NewStringDatum("a")},
+			Key:    kv.Key("key1"),
+			Handle: kv.IntHandle(1),
+		},
+		{
+			// NaN is rejected in strict mode
+			ColIDs: []int64{1, 2},
+			Row:    []types.Datum{types.NewIntDatum(2), types.NewFloat64Datum(math.NaN())},
+			Key:    kv.Key("key2"),
+			Handle: kv.IntHandle(2),
+		},
+		{
+			ColIDs: []int64{1, 2},
+			Row:    []types.Datum{types.NewIntDatum(3), types.NewStringDatum("abc")},
+			Key:    kv.Key("key3"),
+			Handle: kv.IntHandle(3),
+			Flags:  []kv.FlagsOp{kv.SetPresumeKeyNotExists},
+		},
+		{
+			// the column ids mismatch the values
+			ColIDs: []int64{1},
+			Row:    []types.Datum{types.NewIntDatum(4), types.NewStringDatum("abcd")},
+			Key:    kv.Key("key4"),
+			Handle: kv.IntHandle(4),
+		},
+	}
+	expected := make([][]byte, len(rows))
+	for i, row := range rows {
+		if i == 1 || i == 3 {
+			continue
+		}
+		var err error
+		expected[i], err = tablecodec.EncodeRow(time.UTC, row.Row, row.ColIDs, nil, nil,
+			rowcodec.RawChecksum{Handle: row.Handle}, &rowcodec.Encoder{Enable: true})
+		require.NoError(t, err)
+	}
+
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), expected[0]).Return(nil).Once()
+	memBuffer.On("SetWithFlags", kv.Key("key3"), expected[2], []kv.FlagsOp{kv.SetPresumeKeyNotExists}).
+		Return(nil).Once()
+	encoder := ctx.GetMutateBuffers().BatchEncoder(cfg, time.UTC, errctx.StrictNoWarningContext)
+	results := encoder.WriteRowsWithResults(memBuffer, slices.Values(rows))
+	memBuffer.AssertExpectations(t)
+	require.Len(t, results, 4)
+	require.Equal(t, RowWriteResult{BytesWritten: len(expected[0]), ChecksumWritten: true}, results[0])
+	require.ErrorContains(t, results[1].Err, "DOUBLE value is out of range")
+	require.Equal(t, 0, results[1].BytesWritten)
+	require.False(t, results[1].ChecksumWritten)
+	require.Equal(t, RowWriteResult{BytesWritten: len(expected[2]), ChecksumWritten: true}, results[2])
+	require.ErrorContains(t, results[3].Err, "the row has 1 column ids but 2 values")
+}
+
+func TestBatchEncoderWriteRows(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	newRow := func(i int64, val types.Datum) RowToWrite {
+		return RowToWrite{
+			ColIDs: []int64{1, 2},
+			Row:    []types.Datum{types.NewIntDatum(i), val},
+			Key:    kv.Key("key" + strconv.FormatInt(i, 10)),
+			Handle: kv.IntHandle(i),
+		}
+	}
+	rows := []RowToWrite{
+		newRow(1, types.NewStringDatum("a")),
+		newRow(2, types.NewStringDatum("b")),
+		// NaN is rejected in strict mode
+		newRow(3, types.NewFloat64Datum(math.NaN())),
+		newRow(4, types.NewStringDatum("d")),
+	}
+
+	memBuffer := &mockMemBuffer{}
+	for _, row := range rows[:2] {
+		expected, err := tablecodec.EncodeRow(time.UTC, row.Row, row.ColIDs, nil, nil, nil, &rowcodec.Encoder{Enable: true})
+		require.NoError(t, err)
+		memBuffer.On("Set", row.Key, expected).Return(nil).Once()
+	}
+	encoder := ctx.GetMutateBuffers().BatchEncoder(cfg, time.UTC, errctx.StrictNoWarningContext)
+	written, err := encoder.WriteRows(memBuffer, slices.Values(rows))
+	require.ErrorContains(t, err, "DOUBLE value is out of range")
+	require.Equal(t, 2, written)
+	memBuffer.AssertExpectations(t)
+
+	// the error of the memBuffer also stops the batch
+	memBuffer = &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Once()
+	memBuffer.On("Set", kv.Key("key2"), mock.Anything).Return(errors.New("mock set error")).Once()
+	written, err = encoder.WriteRows(memBuffer, slices.Values(rows))
+	require.EqualError(t, err, "mock set error")
+	require.Equal(t, 1, written)
+	memBuffer.AssertExpectations(t)
+
+	memBuffer = &mockMemBuffer{}
+	memBuffer.On("Set", mock.Anything, mock.Anything).Return(nil).Times(2)
+	written, err = encoder.WriteRows(memBuffer, slices.Values([]RowToWrite{rows[0], rows[3]}))
+	require.NoError(t, err)
+	require.Equal(t, 2, written)
+	memBuffer.AssertExpectations(t)
+
+	// the column ids mismatching the values stop the batch
+	mismatched := newRow(5, types.NewStringDatum("e"))
+	mismatched.ColIDs = mismatched.ColIDs[:1]
+	written, err = encoder.WriteRows(&mockMemBuffer{}, slices.Values([]RowToWrite{mismatched}))
+	require.ErrorContains(t, err, "the row has 1 column ids but 2 values")
+	require.Zero(t, written)
+}
+
+func TestColumnarBatch(t *testing.T) {
+	rows := [][]types.Datum{
+		{types.NewIntDatum(1), types.NewStringDatum("a"), types.NewFloat64Datum(1.5)},
+		{types.NewIntDatum(2), types.NewDatum(nil), types.NewFloat64Datum(2.5)},
+		{types.NewIntDatum(3), types.NewStringDatum("c"), {}},
+	}
+	colIDs := []int64{1, 2, 3}
+	batch := NewColumnarBatch(colIDs)
+	buffer := &EncodeRowBuffer{}
+	for i, row := range rows {
+		buffer.Reset(len(row))
+		buffer.AddColVal(1, row[0])
+		if i == 2 {
+			// the value of a lazy column should be evaluated
+			buffer.AddLazyColVal(2, func() (types.Datum, error) { return row[1], nil })
+		} else {
+			buffer.AddColVal(2, row[1])
+		}
+		// the column not added should be NULL
+		if !row[2].IsNull() {
+			buffer.AddColVal(3, row[2])
+		}
+		require.NoError(t, batch.AppendRow(buffer))
+	}
+	require.Equal(t, 3, batch.NumRows())
+	require.Equal(t, colIDs, batch.ColumnIDs())
+	require.Nil(t, batch.Column(4))
+
+	// the per-column arrays should reconstruct the rows
+	for i, row := range rows {
+		got := make([]types.Datum, 0, len(colIDs))
+		for _, colID := range batch.ColumnIDs() {
+			col := batch.Column(colID)
+			require.Len(t, col, 3)
+			got = append(got, col[i])
+		}
+		require.Equal(t, row, got)
+	}
+
+	// the values should be copied from the buffer
+	buffer.Reset(1)
+	bs := []byte("abc")
+	buffer.AddColVal(2, types.NewBytesDatum(bs))
+	require.NoError(t, batch.AppendRow(buffer))
+	bs[0] = 'x'
+	require.Equal(t, []byte("abc"), batch.Column(2)[3].GetBytes())
+	require.True(t, batch.Column(1)[3].IsNull())
+
+	// the column not in the batch
+	buffer.AddColVal(4, types.NewIntDatum(4))
+	require.ErrorContains(t, batch.AppendRow(buffer), "column 4 is not in the columnar batch")
+	require.Equal(t, 4, batch.NumRows())
+
+	batch.Reset()
+	require.Equal(t, 0, batch.NumRows())
+	require.Empty(t, batch.Column(1))
+}
+
+func TestBatchEncoderStreamEncode(t *testing.T) {
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+	}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	_, mutateCtx := newMockMutateCtx()
+	encoder := mutateCtx.GetMutateBuffers().BatchEncoder(cfg, time.UTC, errctx.StrictNoWarningContext)
+
+	const rowCount = 5
+	in := make(chan RowToWrite)
+	out := make(chan KVPair, 2)
+	go func() {
+		defer close(in)
+		for i := range rowCount {
+			handle := kv.IntHandle(i)
+			in <- RowToWrite{
+				ColIDs: []int64{1, 2},
+				Row:    []types.Datum{types.NewIntDatum(int64(i)), types.NewStringDatum(strconv.Itoa(i))},
+				Key:    tablecodec.EncodeRowKeyWithHandle(1, handle),
+				Handle: handle,
+			}
+		}
+	}()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- encoder.StreamEncode(context.Background(), in, out, 2)
+		close(out)
+	}()
+	pairs := make([]KVPair, 0, rowCount)
+	for pair := range out {
+		pairs = append(pairs, pair)
+	}
+	require.NoError(t, <-errCh)
+	require.Len(t, pairs, rowCount)
+	for i, pair := range pairs {
+		require.Equal(t, tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(i)), pair.Key)
+		row, err := tablecodec.DecodeRowToDatumMap(pair.Value, fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{
+			1: types.NewIntDatum(int64(i)), 2: types.NewStringDatum(strconv.Itoa(i)),
+		}, row)
+	}
+
+	// at most `window` rows are encoded ahead of the consumer
+	in = make(chan RowToWrite, 4)
+	for i := range 4 {
+		key := kv.Key("key" + strconv.Itoa(i))
+		in <- RowToWrite{ColIDs: []int64{1}, Row: []types.Datum{types.NewIntDatum(int64(i))}, Key: key}
+	}
+	close(in)
+	out = make(chan KVPair)
+	errCh = make(chan error, 1)
+	go func() {
+		errCh <- encoder.StreamEncode(context.Background(), in, out, 2)
+		close(out)
+	}()
+	require.Eventually(t, func() bool { return len(in) == 2 }, time.Second, time.Millisecond)
+	require.Never(t, func() bool { return len(in) < 2 }, 50*time.Millisecond, time.Millisecond)
+	require.Equal(t, kv.Key("key0"), (<-out).Key)
+	require.Eventually(t, func() bool { return len(in) == 1 }, time.Second, time.Millisecond)
+	for i := 1; i < 4; i++ {
+		require.Equal(t, kv.Key("key"+strconv.Itoa(i)), (<-out).Key)
+	}
+	_, ok := <-out
+	require.False(t, ok)
+	require.NoError(t, <-errCh)
+
+	// the window must be positive
+	require.EqualError(t, encoder.StreamEncode(context.Background(), make(chan RowToWrite), make(chan KVPair), 0),
+		"the in-flight window of the stream encoding must be positive, got 0")
+
+	// the encoding stops when the context is canceled while the output is full
+	ctx, cancel := context.WithCancel(context.Background())
+	in = make(chan RowToWrite, 2)
+	in <- RowToWrite{ColIDs: []int64{1}, Row: []types.Datum{types.NewIntDatum(1)}, Key: kv.Key("key1")}
+	in <- RowToWrite{ColIDs: []int64{1}, Row: []types.Datum{types.NewIntDatum(2)}, Key: kv.Key("key2")}
+	out = make(chan KVPair, 1)
+	errCh = make(chan error, 1)
+	go func() {
+		errCh <- encoder.StreamEncode(ctx, in, out, 1)
+	}()
+	require.Equal(t, kv.Key("key1"), (<-out).Key)
+	require.Eventually(t, func() bool { return len(out) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+
+	// the first error to encode a row is returned
+	in = make(chan RowToWrite, 1)
+	in <- RowToWrite{ColIDs: []int64{1}, Row: []types.Datum{types.NewFloat64Datum(math.NaN())}, Key: kv.Key("key3")}
+	require.EqualError(t, encoder.StreamEncode(context.Background(), in, make(chan KVPair, 1), 1),
+		"[types:1690]DOUBLE value is out of range in 'NaN'")
+
+	// the column ids mismatching the values are an error
+	in = make(chan RowToWrite, 1)
+	in <- RowToWrite{ColIDs: []int64{1, 2}, Row: []types.Datum{types.NewIntDatum(1)}, Key: kv.Key("key4")}
+	require.ErrorContains(t, encoder.StreamEncode(context.Background(), in, make(chan KVPair, 1), 1),
+		"the row has 2 column ids but 1 values")
+}
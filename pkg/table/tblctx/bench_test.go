@@ -0,0 +1,243 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/sessionctx/variable"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/hack"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+)
+
+type discardMemBuffer struct {
+	kv.MemBuffer
+}
+
+func (discardMemBuffer) Set(kv.Key, []byte) error {
+	return nil
+}
+
+// BenchmarkMutateBuffersWithProfile writes a row of a known width with fresh buffers in every iteration,
+// which shows the reallocations saved by presizing the buffers with a `CapacityProfile`.
+func BenchmarkMutateBuffersWithProfile(b *testing.B) {
+	const columns = 32
+	row := make([]types.Datum, columns)
+	for i := range row {
+		row[i] = types.NewStringDatum("a string value of the column")
+	}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	key := kv.Key("key")
+	writeRow := func(b *testing.B, buffers *MutateBuffers) {
+		checkBuffer := buffers.GetCheckRowBufferWithCap(columns)
+		buffer := buffers.GetEncodeRowBufferWithCap(columns)
+		for i, val := range row {
+			checkBuffer.AddColVal(val)
+			buffer.AddColVal(int64(i+1), val)
+		}
+		err := buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, discardMemBuffer{}, key, kv.IntHandle(1),
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("default", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writeRow(b, NewMutateBuffers(&variable.WriteStmtBufs{}))
+		}
+	})
+	b.Run("profile", func(b *testing.B) {
+		profile := CapacityProfile{Columns: columns, RowBytes: 1024}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writeRow(b, NewMutateBuffersWithProfile(&variable.WriteStmtBufs{}, profile))
+		}
+	})
+}
+
+// BenchmarkEncodeRandomRow encodes the pseudo-random rows filled by `FillRandomRow`, so the results are comparable
+// across runs.
+func BenchmarkEncodeRandomRow(b *testing.B) {
+	fts := []*types.FieldType{
+		types.NewFieldType(mysql.TypeLonglong),
+		types.NewFieldType(mysql.TypeVarchar),
+		types.NewFieldType(mysql.TypeDouble),
+		types.NewFieldType(mysql.TypeNewDecimal),
+		types.NewFieldType(mysql.TypeDatetime),
+	}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	key := kv.Key("key")
+	buffer := NewMutateBuffers(&variable.WriteStmtBufs{}).GetEncodeRowBufferWithCap(32)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer.FillRandomRow(int64(i%64), 32, fts)
+		err := buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, discardMemBuffer{}, key, kv.IntHandle(1),
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkBatchEncoder writes 10k rows in every iteration like a bulk INSERT, which compares `BatchEncoder` with
+// the loop getting the buffer and writing for each row.
+func BenchmarkBatchEncoder(b *testing.B) {
+	const rowCount = 10000
+	rows := make([]RowToWrite, rowCount)
+	for i := range rows {
+		rows[i] = RowToWrite{
+			ColIDs: []int64{1, 2, 3},
+			Row: []types.Datum{
+				types.NewIntDatum(int64(i)),
+				types.NewStringDatum("a string value of the column"),
+				types.NewFloat64Datum(float64(i)),
+			},
+			Key:    kv.Key("key"),
+			Handle: kv.IntHandle(i),
+		}
+	}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+
+	b.Run("PerRow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, row := range rows {
+				buffer := buffers.GetEncodeRowBufferWithCap(len(row.Row))
+				for j, colID := range row.ColIDs {
+					buffer.AddColVal(colID, row.Row[j])
+				}
+				err := buffer.WriteMemBufferEncoded(
+					cfg, time.UTC, errctx.StrictNoWarningContext, discardMemBuffer{}, row.Key, row.Handle,
+				)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("BatchEncoder", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encoder := buffers.BatchEncoder(cfg, time.UTC, errctx.StrictNoWarningContext)
+			if _, err := encoder.WriteRows(discardMemBuffer{}, slices.Values(rows)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkInternStrings adds 100k rows of a string column with 10 distinct values in every iteration, sourced from
+// a buffer reused by the caller, which compares the allocations of `MutateBuffers.SetCopyOnAdd` with and without
+// `MutateBuffers.SetInternStrings`.
+func BenchmarkInternStrings(b *testing.B) {
+	const rowCount = 100000
+	values := make([]string, 10)
+	for i := range values {
+		values[i] = "enum-like value " + strconv.Itoa(i)
+	}
+	source := make([]byte, 0, 64)
+	addRows := func(b *testing.B, intern bool) {
+		buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+		buffers.SetCopyOnAdd(true)
+		buffers.SetInternStrings(intern)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := range rowCount {
+				source = append(source[:0], values[j%len(values)]...)
+				buffer := buffers.GetEncodeRowBufferWithCap(1)
+				buffer.AddColVal(1, types.NewStringDatum(string(hack.String(source))))
+			}
+		}
+	}
+
+	b.Run("CopyOnAdd", func(b *testing.B) {
+		addRows(b, false)
+	})
+	b.Run("Intern", func(b *testing.B) {
+		addRows(b, true)
+	})
+}
+
+// BenchmarkAddColVals adds a wide row to a fresh buffer in every iteration, which compares the growth of the
+// inner slices by `AddColVals` with repeated `AddColVal`.
+func BenchmarkAddColVals(b *testing.B) {
+	const columns = 100
+	colIDs := make([]int64, columns)
+	row := make([]types.Datum, columns)
+	for i := range row {
+		colIDs[i] = int64(i + 1)
+		row[i] = types.NewIntDatum(int64(i))
+	}
+
+	b.Run("AddColVal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buffer := &EncodeRowBuffer{}
+			for j, colID := range colIDs {
+				buffer.AddColVal(colID, row[j])
+			}
+		}
+	})
+	b.Run("AddColVals", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buffer := &EncodeRowBuffer{}
+			buffer.AddColVals(colIDs, row)
+		}
+	})
+}
+
+// BenchmarkCheckRowBuffer builds the row to check for every inserted row like a big insert, which shows the
+// allocations saved by reusing the row in `CheckRowBuffer.GetRowToCheck`. Run it with `-benchtime=1000000x` to
+// simulate an insert of 1M rows.
+func BenchmarkCheckRowBuffer(b *testing.B) {
+	row := []types.Datum{
+		types.NewIntDatum(1),
+		types.NewStringDatum("a string value of the column"),
+		types.NewDecimalDatum(types.NewDecFromInt(1)),
+		types.NewDatum(nil),
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = chunk.MutRowFromDatums(row).ToRow()
+		}
+	})
+	b.Run("reuse", func(b *testing.B) {
+		buffer := &CheckRowBuffer{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buffer.Reset(len(row))
+			for _, val := range row {
+				buffer.AddColVal(val)
+			}
+			_ = buffer.GetRowToCheck()
+		}
+	})
+}
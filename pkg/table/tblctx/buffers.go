@@ -15,18 +15,107 @@
 package tblctx
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/errctx"
 	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/meta/model"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
 	"github.com/pingcap/tidb/pkg/sessionctx/variable"
 	"github.com/pingcap/tidb/pkg/tablecodec"
 	"github.com/pingcap/tidb/pkg/types"
 	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/codec"
+	"github.com/pingcap/tidb/pkg/util/collate"
+	"github.com/pingcap/tidb/pkg/util/dbterror"
+	"github.com/pingcap/tidb/pkg/util/dbterror/plannererrors"
 	"github.com/pingcap/tidb/pkg/util/intest"
 	"github.com/pingcap/tidb/pkg/util/rowcodec"
 )
 
+// ErrTruncatedWrongValueForField is returned when a value is invalid for a column.
+// It is the same error as `table.ErrTruncatedWrongValueForField`, which cannot be imported here.
+var ErrTruncatedWrongValueForField = dbterror.ClassTable.NewStd(mysql.ErrTruncatedWrongValueForField)
+
+// ErrColumnCantNull is returned when a NULL value is written to a NOT NULL column.
+// It is the same error as `table.ErrColumnCantNull`, which cannot be imported here.
+var ErrColumnCantNull = dbterror.ClassTable.NewStd(mysql.ErrBadNull)
+
+// ErrFixedBufferTooSmall is returned by `EncodeRowBuffer.EncodeIntoFixed` when the row does not fit in the buffer.
+var ErrFixedBufferTooSmall = errors.New("the fixed buffer is too small to encode the row")
+
+// HandleEncoder encodes the handles of a table to the record keys.
+// Different table layouts use different handles, see `HandleEncoderForTable`.
+type HandleEncoder interface {
+	// AppendRecordKey appends the record key of `handle` in the table `tableID` to `buf` and returns the result.
+	AppendRecordKey(buf []byte, tableID int64, handle kv.Handle) ([]byte, error)
+}
+
+// The `HandleEncoder`s for different table layouts.
+var (
+	// IntHandleEncoder is used by the tables whose integer primary key is the handle.
+	IntHandleEncoder HandleEncoder = intHandleEncoder{name: "int"}
+	// ExtraHandleEncoder is used by the tables using the hidden column `_tidb_rowid` as the handle.
+	ExtraHandleEncoder HandleEncoder = intHandleEncoder{name: "extra"}
+	// CommonHandleEncoder is used by the tables with a clustered index which is not a single integer column.
+	CommonHandleEncoder HandleEncoder = commonHandleEncoder{}
+)
+
+// HandleEncoderForTable returns the `HandleEncoder` for the table.
+func HandleEncoderForTable(tblInfo *model.TableInfo) HandleEncoder {
+	switch {
+	case tblInfo.IsCommonHandle:
+		return CommonHandleEncoder
+	case tblInfo.PKIsHandle:
+		return IntHandleEncoder
+	default:
+		return ExtraHandleEncoder
+	}
+}
+
+type intHandleEncoder struct {
+	name string
+}
+
+// AppendRecordKey implements the `HandleEncoder` interface.
+func (e intHandleEncoder) AppendRecordKey(buf []byte, tableID int64, handle kv.Handle) ([]byte, error) {
+	if !handle.IsInt() {
+		return nil, errors.Errorf("%s handle encoder expects an int handle, but got %s", e.name, handle)
+	}
+	return appendRecordKey(buf, tableID, handle.Encoded()), nil
+}
+
+type commonHandleEncoder struct{}
+
+// AppendRecordKey implements the `HandleEncoder` interface.
+func (commonHandleEncoder) AppendRecordKey(buf []byte, tableID int64, handle kv.Handle) ([]byte, error) {
+	if handle.IsInt() {
+		return nil, errors.Errorf("common handle encoder expects a common handle, but got %s", handle)
+	}
+	return appendRecordKey(buf, tableID, handle.Encoded()), nil
+}
+
+// appendRecordKey appends the record key "t[tableID]_r[encodedHandle]" to `buf`.
+func appendRecordKey(buf []byte, tableID int64, encodedHandle []byte) []byte {
+	buf = append(buf, tablecodec.TablePrefix()...)
+	buf = codec.EncodeInt(buf, tableID)
+	buf = append(buf, '_', 'r')
+	return append(buf, encodedHandle...)
+}
+
 // EncodeRowBuffer is used to encode a row.
 type EncodeRowBuffer struct {
 	// colIDs is the column ids for a row to be encoded.
@@ -35,18 +124,618 @@ type EncodeRowBuffer struct {
 	row []types.Datum
 	// writeStmtBufs refs the `WriteStmtBufs` in session
 	writeStmtBufs *variable.WriteStmtBufs
+	// lazyCols stores the columns whose values are not evaluated until the row is encoded.
+	lazyCols []lazyColVal
+	// transformedCols is the count of the leading columns whose values are already transformed by `applyTransforms`,
+	// so a row encoded more than once is not transformed again.
+	transformedCols int
+	// checksumWritten indicates whether the row level checksum is encoded in the last written row.
+	checksumWritten bool
+	// nullCols is the count of the NULL columns in the last encoded row, see `NullColumnCount`.
+	nullCols int
+	// tableID is the id of the table the buffer is configured for by `ResetForTable`.
+	// It is valid only when `hasTableID` is true.
+	tableID    int64
+	hasTableID bool
+	// handleEncoder encodes the record keys of the table configured by `ResetForTable`.
+	handleEncoder HandleEncoder
+	// schemaColIDs is the ids of all the columns in the schema of the table, see `SetSchemaColIDs`.
+	schemaColIDs []int64
+	// commonHandlePK is the clustered primary key set by `SetCommonHandlePK`. It is unset if `Index` is nil.
+	commonHandlePK IndexSpec
+	// encodedLoc is the location used by the last `WriteMemBufferEncoded`.
+	encodedLoc *time.Location
+	// cursor is reused by `NewDecodeCursor`.
+	cursor RowDecodeCursor
+	// faultInjector is set by `MutateBuffers.SetFaultInjector` and only works in test.
+	faultInjector func(stage string) error
+	// copyOnAdd is set by `MutateBuffers.SetCopyOnAdd`.
+	copyOnAdd bool
+	// internStrings is set by `MutateBuffers.SetInternStrings`, and interned is the strings interned by `intern`,
+	// which is kept across the resets.
+	internStrings bool
+	interned      map[string]string
+	// keyBuf is the scratch of the keys returned by `RecordKeyRange`.
+	keyBuf []byte
+	// oldFormatBuf is the scratch of the old format row returned by `EncodeBoth`.
+	oldFormatBuf []byte
+	// encodeToValues is the scratch of the flattened values used by `EncodeTo` to encode the old row format.
+	encodeToValues []types.Datum
+	// noOpBuf is the scratch of the row encoded by `WouldBeNoOp` and `EstimateWriteAmplification`.
+	noOpBuf []byte
+	// indexVals, indexKeyBuf, indexKeysBuf, indexKeys and indexValBuf are the scratches of `IndexDeleteKeys` and
+	// `EstimateWriteAmplification`.
+	indexVals    []types.Datum
+	indexKeyBuf  []byte
+	indexKeysBuf []byte
+	indexKeys    []kv.Key
+	indexValBuf  []byte
+	// filteredColIDs and filteredRow are the scratches of `WriteMemBufferEncodedFiltered`.
+	filteredColIDs []int64
+	filteredRow    []types.Datum
+	// colTTLs is the expiry of the columns set by `SetColumnTTL`.
+	colTTLs []columnTTL
+	// schemaState is the state set by `SetSchemaState`, which is valid only when `hasSchemaState` is true.
+	schemaState    byte
+	hasSchemaState bool
+	// sidecarBuf is the scratch of the row value with the sidecar written by `WriteWithSidecar` and `WriteIntent`.
+	sidecarBuf []byte
+	// peakCap is the peak capacity used by the resets since the last check of `ShrinkIfIdle`,
+	// and resets is the count of these resets.
+	peakCap int
+	resets  int
+	// reuse counts the reuse of the inner slices, see `MutateBuffers.ReuseStats`.
+	reuse reuseStats
+}
+
+// The stages of `EncodeRowBuffer.WriteMemBufferEncoded` to inject faults, see `MutateBuffers.SetFaultInjector`.
+const (
+	// FaultStageEncode is the stage before encoding the row.
+	FaultStageEncode = "encode"
+	// FaultStageSet is the stage before writing the encoded row to the memBuffer.
+	FaultStageSet = "set"
+)
+
+// injectFault returns the error injected at the stage. It always returns nil if not in test.
+func (b *EncodeRowBuffer) injectFault(stage string) error {
+	if intest.InTest && b.faultInjector != nil {
+		return b.faultInjector(stage)
+	}
+	return nil
+}
+
+// lazyColVal is a column value that is produced by `fn` when the row is encoded.
+type lazyColVal struct {
+	// offset is the offset of the column in `EncodeRowBuffer.row`.
+	offset int
+	fn     func() (types.Datum, error)
 }
 
 // Reset resets the inner buffers to a capacity.
 func (b *EncodeRowBuffer) Reset(capacity int) {
-	b.colIDs = ensureCapacityAndReset(b.colIDs, 0, capacity)
-	b.row = ensureCapacityAndReset(b.row, 0, capacity)
+	// the columns appended beyond the requested capacity are also used
+	b.peakCap = max(b.peakCap, capacity, len(b.colIDs))
+	b.resets++
+	b.colIDs = ensureCapacityAndResetWithStats(&b.reuse, b.colIDs, 0, capacity)
+	b.row = ensureCapacityAndResetWithStats(&b.reuse, b.row, 0, capacity)
+	b.lazyCols = b.lazyCols[:0]
+	b.colTTLs = b.colTTLs[:0]
+	b.schemaState, b.hasSchemaState = 0, false
+	b.transformedCols = 0
+	b.checksumWritten = false
+	b.nullCols = 0
+	b.tableID, b.hasTableID = 0, false
+	b.handleEncoder = nil
+	b.schemaColIDs = nil
+	b.commonHandlePK = IndexSpec{}
+}
+
+// shrinkRatio is the ratio of the current capacity to the peak capacity used recently, above which
+// `ShrinkIfIdle` shrinks the buffer.
+const shrinkRatio = 4
+
+// ShrinkIfIdle shrinks the buffer to the peak capacity used by the recent resets if the buffer has been reset at
+// least `threshold` times since the last check and the peak is far less than the current capacity.
+// It returns whether the buffer is shrunk. It is used to release the memory held by a single wide row, so a
+// session alternating between the wide batch loads and the narrow inserts does not keep the wide buffer forever.
+// The columns in the buffer are kept.
+func (b *EncodeRowBuffer) ShrinkIfIdle(threshold int) bool {
+	if b.resets < threshold {
+		return false
+	}
+	peakCap := max(b.peakCap, len(b.colIDs))
+	b.peakCap, b.resets = 0, 0
+	if cap(b.colIDs) == 0 || peakCap*shrinkRatio > cap(b.colIDs) {
+		return false
+	}
+	b.colIDs = append(make([]int64, 0, peakCap), b.colIDs...)
+	b.row = append(make([]types.Datum, 0, peakCap), b.row...)
+	return true
+}
+
+// SetSchemaColIDs sets the ids of all the columns in the schema of the table, which is used by `PresenceSummary`.
+// The slice is referenced by the buffer until the next `Reset`, so the caller should not modify it.
+func (b *EncodeRowBuffer) SetSchemaColIDs(colIDs []int64) {
+	b.schemaColIDs = colIDs
+}
+
+// SetCommonHandlePK sets the clustered primary key of the table whose handle is a common handle. When the assertion
+// is enabled, `WriteMemBufferEncoded` checks the written handle equals to the common handle encoded from the values
+// of the primary key columns in the buffer, to detect the caller passes a handle inconsistent with the row.
+// The check is skipped if any primary key column is not added, e.g. by `WriteMemBufferEncodedFiltered`.
+// It is cleared by the next `Reset`, and the index is ignored if it is not the primary key of a common handle table.
+func (b *EncodeRowBuffer) SetCommonHandlePK(pk IndexSpec) {
+	if pk.Index == nil || !pk.Index.Primary || !pk.Table.IsCommonHandle {
+		return
+	}
+	b.commonHandlePK = pk
+}
+
+// PresenceSummary reports how many columns in the schema set by `SetSchemaColIDs` are present in the buffer
+// with non-NULL values and how many are absent, that is, not added or added as NULL.
+// It is used to analyze the storage density of the wide sparse tables.
+func (b *EncodeRowBuffer) PresenceSummary() (present, absent int) {
+	nonNull := make(map[int64]struct{}, len(b.colIDs))
+	for i, colID := range b.colIDs {
+		if !b.row[i].IsNull() {
+			nonNull[colID] = struct{}{}
+		}
+	}
+	for _, colID := range b.schemaColIDs {
+		if _, ok := nonNull[colID]; ok {
+			present++
+		}
+	}
+	return present, len(b.schemaColIDs) - present
+}
+
+// ResetForTable is similar to `Reset`, but it also records the id of the table the buffer is used for and the
+// `HandleEncoder` of the table, which is used by `RecordKey`. See `HandleEncoderForTable` to select the encoder.
+// When the assertion is enabled, `WriteMemBufferEncoded` checks the written key belongs to this table
+// to detect the buffer is reused across tables by mistake.
+func (b *EncodeRowBuffer) ResetForTable(tableID int64, handleEncoder HandleEncoder, capacity int) {
+	b.Reset(capacity)
+	b.tableID, b.hasTableID = tableID, true
+	b.handleEncoder = handleEncoder
+}
+
+// ConfiguredTableID returns the table id recorded by `ResetForTable`.
+// The second return value is false if the buffer is not configured for a table.
+func (b *EncodeRowBuffer) ConfiguredTableID() (int64, bool) {
+	return b.tableID, b.hasTableID
 }
 
 // AddColVal adds a column value to the buffer.
 func (b *EncodeRowBuffer) AddColVal(colID int64, val types.Datum) {
 	b.colIDs = append(b.colIDs, colID)
 	b.row = append(b.row, val)
+	b.copyIfNeeded(len(b.row) - 1)
+}
+
+// copyIfNeeded copies the bytes of the string value at the `offset` of the row if the buffer is in the copy-on-add
+// mode, so the value does not share the memory of the caller, see `MutateBuffers.SetCopyOnAdd`.
+// If the strings are interned, a short string is replaced by the interned one instead, see `intern`.
+func (b *EncodeRowBuffer) copyIfNeeded(offset int) {
+	if !b.copyOnAdd && !b.internStrings {
+		return
+	}
+	val := b.row[offset]
+	switch {
+	case b.internStrings && val.Kind() == types.KindString && len(val.GetBytes()) <= maxInternedStringLen:
+		b.row[offset].SetString(b.intern(val.GetString()), val.Collation())
+	case b.copyOnAdd && sharesMemory(val.Kind()):
+		val.Copy(&b.row[offset])
+	}
+}
+
+// sharesMemory returns whether the datums of the `kind` may reference the memory of the source they are read from.
+func sharesMemory(kind byte) bool {
+	switch kind {
+	case types.KindString, types.KindBytes, types.KindMysqlBit, types.KindMysqlJSON, types.KindVectorFloat32,
+		types.KindMysqlDecimal:
+		return true
+	}
+	return false
+}
+
+// The limits of the strings interned by `EncodeRowBuffer.intern`, which target the low-cardinality values such as
+// the enum-like strings repeated across the rows.
+const (
+	// maxInternedStrings is the count of the interned strings, beyond which the interned strings are dropped.
+	maxInternedStrings = 256
+	// maxInternedStringLen is the max length of a string to be interned.
+	maxInternedStringLen = 64
+)
+
+// intern returns the interned string equal to `s`. If `s` is not seen recently, a copy of it is interned, so the
+// returned string never shares the memory of the caller. When `maxInternedStrings` strings are interned, they are
+// dropped to make room for the recent ones.
+func (b *EncodeRowBuffer) intern(s string) string {
+	if interned, ok := b.interned[s]; ok {
+		return interned
+	}
+	if b.interned == nil {
+		b.interned = make(map[string]string)
+	} else if len(b.interned) >= maxInternedStrings {
+		clear(b.interned)
+	}
+	interned := strings.Clone(s)
+	b.interned[interned] = interned
+	return interned
+}
+
+// setInternStrings sets whether the buffer interns the short string values added, see
+// `MutateBuffers.SetInternStrings`. The interned strings are dropped when it is disabled.
+func (b *EncodeRowBuffer) setInternStrings(intern bool) {
+	b.internStrings = intern
+	if !intern {
+		b.interned = nil
+	}
+}
+
+// AddColVals adds the values `vals` of the columns `colIDs` to the buffer in one call, which grows the inner
+// slices at most once. It is used when the values are already at hand, for example, read from a chunk.
+// The `colIDs` and `vals` must have the same length.
+func (b *EncodeRowBuffer) AddColVals(colIDs []int64, vals []types.Datum) {
+	intest.Assert(len(colIDs) == len(vals),
+		"the count of column ids %d mismatches the count of values %d", len(colIDs), len(vals))
+	b.colIDs = append(b.colIDs, colIDs...)
+	b.row = append(b.row, vals...)
+	if b.copyOnAdd || b.internStrings {
+		for i := len(b.row) - len(vals); i < len(b.row); i++ {
+			b.copyIfNeeded(i)
+		}
+	}
+}
+
+// AddUserColVal is similar to `AddColVal`, but the value is supplied by the user explicitly, so it returns
+// `plannererrors.ErrBadGeneratedColumn` without adding the value if the column is a `GENERATED ALWAYS` column.
+// `generatedCols` maps the ids of the generated columns of the table `tableName` to their names.
+func (b *EncodeRowBuffer) AddUserColVal(
+	colID int64, val types.Datum, generatedCols map[int64]string, tableName string,
+) error {
+	if name, ok := generatedCols[colID]; ok {
+		return plannererrors.ErrBadGeneratedColumn.GenWithStackByArgs(name, tableName)
+	}
+	b.AddColVal(colID, val)
+	return nil
+}
+
+// AddColValFromChunk adds a column value read from the cell `rowIdx` of the chunk column `col`.
+// It sets the value to the buffer in place to avoid constructing an intermediate datum for the vectorized writes.
+// Like `AddColVal`, the string, BLOB, BIT, JSON, vector and decimal values reference the memory of the chunk unless
+// `MutateBuffers.SetCopyOnAdd` is enabled, so the chunk should not be modified or reused before the row is encoded.
+// It returns an error for the types it cannot read, and the column is not added.
+func (b *EncodeRowBuffer) AddColValFromChunk(
+	colID int64, col *chunk.Column, rowIdx int, ft *types.FieldType,
+) error {
+	b.colIDs = append(b.colIDs, colID)
+	b.row = append(b.row, types.Datum{})
+	d := &b.row[len(b.row)-1]
+	if col.IsNull(rowIdx) {
+		return nil
+	}
+	switch ft.GetType() {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong:
+		if mysql.HasUnsignedFlag(ft.GetFlag()) {
+			d.SetUint64(col.GetUint64(rowIdx))
+		} else {
+			d.SetInt64(col.GetInt64(rowIdx))
+		}
+	case mysql.TypeYear:
+		d.SetInt64(col.GetInt64(rowIdx))
+	case mysql.TypeFloat:
+		d.SetFloat32(col.GetFloat32(rowIdx))
+	case mysql.TypeDouble:
+		d.SetFloat64(col.GetFloat64(rowIdx))
+	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString,
+		mysql.TypeBlob, mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob:
+		d.SetString(col.GetString(rowIdx), ft.GetCollate())
+	case mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp:
+		d.SetMysqlTime(col.GetTime(rowIdx))
+	case mysql.TypeDuration:
+		d.SetMysqlDuration(col.GetDuration(rowIdx, ft.GetDecimal()))
+	case mysql.TypeNewDecimal:
+		dec := col.GetDecimal(rowIdx)
+		d.SetMysqlDecimal(dec)
+		d.SetLength(ft.GetFlen())
+		if ft.GetDecimal() == types.UnspecifiedLength {
+			d.SetFrac(int(dec.GetDigitsFrac()))
+		} else {
+			d.SetFrac(ft.GetDecimal())
+		}
+	case mysql.TypeEnum:
+		d.SetMysqlEnum(col.GetEnum(rowIdx), ft.GetCollate())
+	case mysql.TypeSet:
+		d.SetMysqlSet(col.GetSet(rowIdx), ft.GetCollate())
+	case mysql.TypeBit:
+		d.SetMysqlBit(col.GetBytes(rowIdx))
+	case mysql.TypeJSON:
+		d.SetMysqlJSON(col.GetJSON(rowIdx))
+	case mysql.TypeTiDBVectorFloat32:
+		d.SetVectorFloat32(col.GetVectorFloat32(rowIdx))
+	default:
+		b.colIDs, b.row = b.colIDs[:len(b.colIDs)-1], b.row[:len(b.row)-1]
+		return errors.Errorf("AddColValFromChunk does not support the type %s of column %d", ft, colID)
+	}
+	b.copyIfNeeded(len(b.row) - 1)
+	return nil
+}
+
+// AddLazyColVal adds a column whose value is produced by `fn` only when the row is encoded.
+// It is used to defer some expensive computation, for example, a virtual generated column, until all the
+// validations are passed.
+func (b *EncodeRowBuffer) AddLazyColVal(colID int64, fn func() (types.Datum, error)) {
+	b.lazyCols = append(b.lazyCols, lazyColVal{offset: len(b.row), fn: fn})
+	b.AddColVal(colID, types.Datum{})
+}
+
+// AddColValWithDefaultExpr adds a column whose default value is an expression, e.g. `DEFAULT (UUID())`.
+// If `isNull` is false, the `supplied` value is added. Otherwise, the value is not supplied and the default
+// expression `eval` is evaluated lazily like `AddLazyColVal`, so it runs only once when the row is encoded.
+func (b *EncodeRowBuffer) AddColValWithDefaultExpr(
+	colID int64, supplied types.Datum, isNull bool, eval func() (types.Datum, error),
+) {
+	if isNull {
+		b.AddLazyColVal(colID, eval)
+		return
+	}
+	b.AddColVal(colID, supplied)
+}
+
+// AddHashColVal adds a column whose value is a stable hash of the `source` datums modulo `buckets`, which is used
+// by the application-level sharding. The hash only depends on the encoded source values, so equal source datums
+// always yield the same value. Like `AddLazyColVal`, the value is computed when the row is encoded, so the caller
+// should not modify the `source` datums before that.
+func (b *EncodeRowBuffer) AddHashColVal(colID int64, source []types.Datum, buckets int) {
+	b.AddLazyColVal(colID, func() (types.Datum, error) {
+		if buckets <= 0 {
+			return types.Datum{}, errors.Errorf("invalid buckets %d of the hash column %d", buckets, colID)
+		}
+		encoded, err := codec.EncodeValue(time.UTC, nil, source...)
+		if err != nil {
+			return types.Datum{}, err
+		}
+		h := fnv.New64a()
+		_, _ = h.Write(encoded)
+		return types.NewIntDatum(int64(h.Sum64() % uint64(buckets))), nil
+	})
+}
+
+// applyTransforms replaces the values of the columns in `transforms` with the transformed ones. Only the columns
+// added since the last call are transformed, so each value is transformed once until `Reset` even if the row is
+// encoded more than once.
+func (b *EncodeRowBuffer) applyTransforms(transforms map[int64]func(types.Datum) (types.Datum, error)) error {
+	if len(transforms) == 0 {
+		return nil
+	}
+	for i := b.transformedCols; i < len(b.colIDs); i++ {
+		colID := b.colIDs[i]
+		transform, ok := transforms[colID]
+		if !ok {
+			continue
+		}
+		val, err := transform(b.row[i])
+		if err != nil {
+			return errors.Annotatef(err, "failed to transform the value of column %d", colID)
+		}
+		b.row[i] = val
+	}
+	b.transformedCols = len(b.colIDs)
+	return nil
+}
+
+// normalizeValues prepares the values of the row for the encoding in a single pass: it counts the NULL columns for
+// `NullColumnCount`, validates the string values of the columns in `utf8Cols` if it is not nil, which maps column
+// ids to column names, and makes the encoding of NaN and Inf float values deterministic.
+// These float values are invalid in MySQL and are not guaranteed to round trip, so an out-of-range error is handled
+// by `ec` for them. If the error is ignored or downgraded to a warning, the value is replaced with 0.
+func (b *EncodeRowBuffer) normalizeValues(ec errctx.Context, utf8Cols map[int64]string) error {
+	b.nullCols = 0
+	for i := range b.row {
+		d := &b.row[i]
+		switch d.Kind() {
+		case types.KindNull:
+			b.nullCols++
+		case types.KindString:
+			if colName, ok := utf8Cols[b.colIDs[i]]; ok {
+				if err := validateUTF8(d.GetBytes(), colName); err != nil {
+					return err
+				}
+			}
+		case types.KindFloat64, types.KindFloat32:
+			if err := normalizeFloat(d, ec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeFloat replaces the NaN or Inf float value `d` with 0 if the out-of-range error is not returned by `ec`,
+// see `normalizeValues`.
+func normalizeFloat(d *types.Datum, ec errctx.Context) error {
+	v := d.GetFloat64()
+	if !math.IsNaN(v) && !math.IsInf(v, 0) {
+		return nil
+	}
+	err := types.ErrOverflow.GenWithStackByArgs("DOUBLE", strconv.FormatFloat(v, 'g', -1, 64))
+	if err = ec.HandleError(err); err != nil {
+		return err
+	}
+	if d.Kind() == types.KindFloat32 {
+		d.SetFloat32(0)
+	} else {
+		d.SetFloat64(0)
+	}
+	return nil
+}
+
+// validateUTF8 validates the string value `str` of the column `colName`.
+func validateUTF8(str []byte, colName string) error {
+	if utf8.Valid(str) {
+		return nil
+	}
+	// find the first invalid byte sequence to report
+	offset := 0
+	for offset < len(str) {
+		r, size := utf8.DecodeRune(str[offset:])
+		if r == utf8.RuneError && size == 1 {
+			break
+		}
+		offset += size
+	}
+	invalid := str[offset:min(offset+utf8.UTFMax, len(str))]
+	var hex strings.Builder
+	for _, c := range invalid {
+		fmt.Fprintf(&hex, "\\x%02X", c)
+	}
+	return ErrTruncatedWrongValueForField.FastGen(
+		"Incorrect string value '%s' for column '%s'", hex.String(), colName)
+}
+
+// CheckNotNullCols checks that no NULL value is added for the columns in `notNullCols`,
+// which maps the ids of the NOT NULL columns to their names.
+// An empty string is a valid value for a NOT NULL column, so it should never be conflated with NULL,
+// for example, when filling the empty string default value of a NOT NULL column.
+func (b *EncodeRowBuffer) CheckNotNullCols(notNullCols map[int64]string) error {
+	if len(notNullCols) == 0 {
+		return nil
+	}
+	for i, colID := range b.colIDs {
+		if colName, ok := notNullCols[colID]; ok && b.row[i].IsNull() {
+			return ErrColumnCantNull.FastGenByArgs(colName)
+		}
+	}
+	return nil
+}
+
+// CheckFitTargetTypes checks the added values fit the target types of the columns, which is used when a
+// modify-column DDL narrows the types of the columns, for example, from BIGINT to INT.
+// `targets` maps the column ids to the target types, and the columns not in it are not checked.
+// It returns `types.ErrWarnDataOutOfRange` with the column id if a value overflows the target type,
+// or the other conversion error like `types.ErrDataTooLong` annotated with the column id.
+func (b *EncodeRowBuffer) CheckFitTargetTypes(tc types.Context, targets map[int64]*types.FieldType) error {
+	if err := b.evalLazyColVals(); err != nil {
+		return err
+	}
+	for i, colID := range b.colIDs {
+		ft, ok := targets[colID]
+		if !ok || b.row[i].IsNull() {
+			continue
+		}
+		_, err := b.row[i].ConvertTo(tc, ft)
+		if err == nil {
+			continue
+		}
+		if types.ErrOverflow.Equal(err) {
+			return types.ErrWarnDataOutOfRange.FastGen(
+				"Out of range value %v for column %d of type %s", b.row[i].GetValue(), colID, ft.String())
+		}
+		return errors.Annotatef(err, "the value of column %d does not fit type %s", colID, ft.String())
+	}
+	return nil
+}
+
+// CopyDatums returns a deep copy of the added column values, including the backing bytes of string and BLOB values.
+// The returned datums are not referenced by the buffer, so they can be retained after the buffer is reset and reused,
+// for example, to report an error.
+func (b *EncodeRowBuffer) CopyDatums() []types.Datum {
+	return types.CloneRow(b.row)
+}
+
+// FillRandomRow resets the buffer and fills it with `colCount` pseudo-random column values, which is used by the
+// benchmarks to encode the rows consistently. The ids of the columns are 1 to `colCount`, and the type of the i-th
+// column is `fts[i%len(fts)]`. The same seed always produces the same row.
+// The nullable columns are NULL in about one tenth of the rows, and the columns of the unsupported types are NULL.
+func (b *EncodeRowBuffer) FillRandomRow(seed int64, colCount int, fts []*types.FieldType) {
+	b.Reset(colCount)
+	rng := rand.New(rand.NewSource(seed))
+	for i := range colCount {
+		b.AddColVal(int64(i+1), randomDatum(rng, fts[i%len(fts)]))
+	}
+}
+
+// randomDatum returns a pseudo-random value of the type `ft` produced by `rng`.
+func randomDatum(rng *rand.Rand, ft *types.FieldType) types.Datum {
+	if !mysql.HasNotNullFlag(ft.GetFlag()) && rng.Intn(10) == 0 {
+		return types.Datum{}
+	}
+	tp := ft.GetType()
+	switch tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong:
+		if mysql.HasUnsignedFlag(ft.GetFlag()) {
+			upper := types.IntegerUnsignedUpperBound(tp)
+			if upper == math.MaxUint64 {
+				return types.NewUintDatum(rng.Uint64())
+			}
+			return types.NewUintDatum(uint64(rng.Int63n(int64(upper) + 1)))
+		}
+		lower, upper := types.IntegerSignedLowerBound(tp), types.IntegerSignedUpperBound(tp)
+		if upper == math.MaxInt64 {
+			return types.NewIntDatum(int64(rng.Uint64()))
+		}
+		return types.NewIntDatum(lower + rng.Int63n(upper-lower+1))
+	case mysql.TypeFloat:
+		return types.NewFloat32Datum(float32(rng.NormFloat64() * 1e3))
+	case mysql.TypeDouble:
+		return types.NewFloat64Datum(rng.NormFloat64() * 1e6)
+	case mysql.TypeNewDecimal:
+		flen, frac := ft.GetFlen(), ft.GetDecimal()
+		if flen == types.UnspecifiedLength {
+			flen = 10
+		}
+		if frac == types.UnspecifiedLength {
+			frac = 0
+		}
+		dec := new(types.MyDecimal).FromInt(rng.Int63n(int64(math.Pow10(min(flen, 18)))))
+		if err := dec.Shift(-frac); err != nil {
+			return types.Datum{}
+		}
+		d := types.NewDecimalDatum(dec)
+		d.SetLength(flen)
+		d.SetFrac(frac)
+		return d
+	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString:
+		return types.NewCollationStringDatum(randomString(rng, ft.GetFlen()), ft.GetCollate())
+	case mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob:
+		return types.NewBytesDatum([]byte(randomString(rng, ft.GetFlen())))
+	case mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp:
+		year, month, day := 1971+rng.Intn(60), 1+rng.Intn(12), 1+rng.Intn(28)
+		hour, minute, second := 0, 0, 0
+		if tp != mysql.TypeDate {
+			hour, minute, second = rng.Intn(24), rng.Intn(60), rng.Intn(60)
+		}
+		return types.NewTimeDatum(types.NewTime(types.FromDate(year, month, day, hour, minute, second, 0), tp, 0))
+	case mysql.TypeDuration:
+		return types.NewDurationDatum(types.NewDuration(rng.Intn(839), rng.Intn(60), rng.Intn(60), 0, 0))
+	}
+	return types.Datum{}
+}
+
+// randomString returns a pseudo-random string of the letters no longer than `flen`, or 32 if `flen` is unspecified.
+func randomString(rng *rand.Rand, flen int) string {
+	if flen == types.UnspecifiedLength || flen > 32 {
+		flen = 32
+	}
+	buf := make([]byte, rng.Intn(flen+1))
+	for i := range buf {
+		buf[i] = byte('a' + rng.Intn(26))
+	}
+	return string(buf)
+}
+
+// evalLazyColVals evaluates all the lazy columns and fills their values to the row.
+func (b *EncodeRowBuffer) evalLazyColVals() error {
+	for _, col := range b.lazyCols {
+		val, err := col.fn()
+		if err != nil {
+			return err
+		}
+		b.row[col.offset] = val
+	}
+	b.lazyCols = b.lazyCols[:0]
+	return nil
 }
 
 // WriteMemBufferEncoded writes the encoded row to the memBuffer.
@@ -54,6 +743,256 @@ func (b *EncodeRowBuffer) WriteMemBufferEncoded(
 	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
 	memBuffer kv.MemBuffer, key kv.Key, handle kv.Handle, flags ...kv.FlagsOp,
 ) error {
+	encoded, err := b.encodeForWrite(cfg, loc, ec, key, handle)
+	if err != nil {
+		return err
+	}
+	return b.setEncoded(cfg, memBuffer, key, encoded, flags...)
+}
+
+// setEncoded writes the encoded value to the memBuffer, and verifies it if `cfg.VerifyAfterWrite`.
+func (b *EncodeRowBuffer) setEncoded(
+	cfg RowEncodingConfig, memBuffer kv.MemBuffer, key kv.Key, encoded []byte, flags ...kv.FlagsOp,
+) (err error) {
+	if err = b.injectFault(FaultStageSet); err != nil {
+		return err
+	}
+
+	if len(flags) == 0 {
+		err = memBuffer.Set(key, encoded)
+	} else {
+		err = memBuffer.SetWithFlags(key, encoded, flags...)
+	}
+	if err != nil || !cfg.VerifyAfterWrite {
+		return err
+	}
+	return verifyWritten(memBuffer, key, encoded)
+}
+
+// NullColumnCount returns the count of the NULL columns in the last row encoded, e.g. by `WriteMemBufferEncoded`,
+// which is used to record the metrics about the sparsity of the wide tables. It is counted while the row is prepared
+// for the encoding, so it does not cost another pass over the row. It is cleared by `Reset`.
+func (b *EncodeRowBuffer) NullColumnCount() int {
+	return b.nullCols
+}
+
+// WriteMemBufferEncodedReturning is similar to `WriteMemBufferEncoded`, but it also returns the written value for
+// the secondary consumers, e.g. a CDC hook, so they do not need to encode the row again.
+// Unlike `WriteStmtBufs.RowValBuf`, which is overwritten by the next encoding, the returned slice is a copy,
+// so it is safe to retain.
+func (b *EncodeRowBuffer) WriteMemBufferEncodedReturning(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+	memBuffer kv.MemBuffer, key kv.Key, handle kv.Handle, flags ...kv.FlagsOp,
+) ([]byte, error) {
+	if err := b.WriteMemBufferEncoded(cfg, loc, ec, memBuffer, key, handle, flags...); err != nil {
+		return nil, err
+	}
+	return slices.Clone(b.writeStmtBufs.RowValBuf), nil
+}
+
+// verifyWritten reads the value of the `key` back from the `memBuffer` and checks it equals to `written`.
+func verifyWritten(memBuffer kv.MemBuffer, key kv.Key, written []byte) error {
+	val, err := memBuffer.Get(context.Background(), key)
+	if err != nil {
+		return errors.Annotatef(err, "failed to read back the row of key %s", key)
+	}
+	if !bytes.Equal(val, written) {
+		return errors.Errorf("the row read back from key %s mismatches the written one, written %x, got %x",
+			key, written, val)
+	}
+	return nil
+}
+
+// WriteMemBufferEncodedFiltered is similar to `WriteMemBufferEncoded`, but it only encodes the columns passing the
+// filter `include`, which is used by the projection-aware writes, e.g. writing a subset of the columns to a
+// secondary store. The written value is a valid row of the included columns, but it is not a complete record,
+// so it should never be written as the primary row of the table.
+// The added columns are kept in the buffer, so the buffer can be written again with another filter.
+func (b *EncodeRowBuffer) WriteMemBufferEncodedFiltered(
+	include func(colID int64) bool, cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+	memBuffer kv.MemBuffer, key kv.Key, handle kv.Handle, flags ...kv.FlagsOp,
+) error {
+	// the lazy columns are evaluated and the values are transformed in the whole row because their offsets refer to it
+	if err := b.evalLazyColVals(); err != nil {
+		return err
+	}
+	if err := b.applyTransforms(cfg.Transforms); err != nil {
+		return err
+	}
+	b.filteredColIDs, b.filteredRow = b.filteredColIDs[:0], b.filteredRow[:0]
+	for i, colID := range b.colIDs {
+		if include(colID) {
+			b.filteredColIDs = append(b.filteredColIDs, colID)
+			b.filteredRow = append(b.filteredRow, b.row[i])
+		}
+	}
+
+	colIDs, row, transformedCols := b.colIDs, b.row, b.transformedCols
+	b.colIDs, b.row, b.transformedCols = b.filteredColIDs, b.filteredRow, len(b.filteredRow)
+	defer func() {
+		b.filteredColIDs, b.filteredRow = b.colIDs, b.row
+		b.colIDs, b.row, b.transformedCols = colIDs, row, transformedCols
+	}()
+	return b.WriteMemBufferEncoded(cfg, loc, ec, memBuffer, key, handle, flags...)
+}
+
+// The upper bounds of the sizes used by `EstimateEncodedSize`, which cover both the new and the old row formats.
+const (
+	// estimatedRowHeaderSize is the size of the header of the new row format.
+	estimatedRowHeaderSize = 6
+	// estimatedChecksumSize is the size of the checksum header and at most two checksums.
+	estimatedChecksumSize = 1 + 4 + 4
+	// estimatedColIDSize is the size of a column id, which is a 4-byte id and a 4-byte offset in the new row format,
+	// and a flag and a varint in the old row format.
+	estimatedColIDSize = 1 + binary.MaxVarintLen64
+	// estimatedFixedValueSize is the size of a fixed-size value, which is a flag and a varint at most.
+	estimatedFixedValueSize = 1 + binary.MaxVarintLen64
+)
+
+// EstimateEncodedSize returns an upper bound of the size of the row encoded from the columns in the buffer, which
+// is computed from the column kinds without encoding. It is used to reject the rows exceeding the entry size limit
+// before paying for the encoding. The estimation never under-counts for both the new and the old row formats, and
+// the checksum is counted if `cfg.IsRowLevelChecksumEnabled`.
+// The values of the lazy columns not evaluated yet and the `cfg.Transforms` are not taken into account.
+func (b *EncodeRowBuffer) EstimateEncodedSize(cfg RowEncodingConfig) int {
+	size := estimatedRowHeaderSize
+	if cfg.IsRowLevelChecksumEnabled {
+		size += estimatedChecksumSize
+	}
+	for i := range b.row {
+		size += estimatedColIDSize
+		val := &b.row[i]
+		switch val.Kind() {
+		case types.KindNull:
+			size++
+		case types.KindString, types.KindBytes:
+			size += 1 + binary.MaxVarintLen64 + len(val.GetBytes())
+		case types.KindMysqlDecimal:
+			size += 1 + types.MyDecimalStructSize
+		case types.KindMysqlJSON:
+			size += 2 + len(val.GetMysqlJSON().Value)
+		case types.KindVectorFloat32:
+			size += 1 + val.GetVectorFloat32().SerializedSize()
+		default:
+			size += estimatedFixedValueSize
+		}
+	}
+	return size
+}
+
+// prepareForEncode evaluates the lazy columns, applies the transforms and validates the row before it is encoded.
+func (b *EncodeRowBuffer) prepareForEncode(cfg RowEncodingConfig, ec errctx.Context) error {
+	if err := b.evalLazyColVals(); err != nil {
+		return err
+	}
+
+	if err := b.applyTransforms(cfg.Transforms); err != nil {
+		return err
+	}
+
+	var utf8Cols map[int64]string
+	if cfg.ValidateUTF8 {
+		utf8Cols = cfg.UTF8Columns
+	}
+	if err := b.normalizeValues(ec, utf8Cols); err != nil {
+		return err
+	}
+
+	if cfg.CheckNotNull {
+		if err := b.CheckNotNullCols(cfg.NotNullColumns); err != nil {
+			return err
+		}
+	} else if intest.EnableAssert {
+		intest.AssertNoError(b.CheckNotNullCols(cfg.NotNullColumns))
+	}
+	return nil
+}
+
+// EncodeTo encodes the row in the buffer and appends it to `dst`, growing it as needed, and returns the extended
+// slice. Unlike `WriteMemBufferEncoded`, it does not touch the `WriteStmtBufs` of the session, so the buffer can be
+// used outside a session context, e.g. by the import path encoding into its own arena.
+// The row is validated like `WriteMemBufferEncoded`, but the row level checksum is not encoded because there is no
+// handle.
+func (b *EncodeRowBuffer) EncodeTo(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context, dst []byte,
+) ([]byte, error) {
+	if err := b.prepareForEncode(cfg, ec); err != nil {
+		return nil, err
+	}
+
+	b.encodeToValues = ensureCapacityAndResetWithStats(&b.reuse, b.encodeToValues, len(b.row)*2)
+	// encode into the spare capacity of `dst`, so the append below copies nothing unless the encoding grew it
+	encoded, err := tablecodec.EncodeRow(loc, b.row, b.colIDs, dst[len(dst):], b.encodeToValues, nil, cfg.RowEncoder)
+	if err = ec.HandleError(err); err != nil {
+		return nil, err
+	}
+	return append(dst, encoded...), nil
+}
+
+// EncodeIntoFixed is similar to `EncodeTo`, but it encodes the row into the caller-provided `dst` without growing it,
+// e.g. a region of a memory-mapped file, and returns the count of the bytes used from the start of `dst`.
+// If the row does not fit in `dst`, it returns the size needed with `ErrFixedBufferTooSmall`, so the caller can retry
+// with a larger region. In that case, the content of `dst` is undefined, but nothing beyond `len(dst)` is written.
+func (b *EncodeRowBuffer) EncodeIntoFixed(
+	dst []byte, cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+) (int, error) {
+	if err := b.prepareForEncode(cfg, ec); err != nil {
+		return 0, err
+	}
+
+	b.encodeToValues = ensureCapacityAndResetWithStats(&b.reuse, b.encodeToValues, len(b.row)*2)
+	// limit the capacity to `len(dst)`, so the encoding reallocates instead of writing beyond `dst`
+	encoded, err := tablecodec.EncodeRow(loc, b.row, b.colIDs, dst[:0:len(dst)], b.encodeToValues, nil, cfg.RowEncoder)
+	if err = ec.HandleError(err); err != nil {
+		return 0, err
+	}
+	if len(encoded) > len(dst) {
+		return len(encoded), ErrFixedBufferTooSmall
+	}
+	// the row fitting in `dst` is encoded in place, and the copy only guards an encoder building it elsewhere
+	return copy(dst, encoded), nil
+}
+
+// WouldBeNoOp encodes the row in the buffer to a scratch like `EncodeTo` and reports whether it equals to the
+// `existing` value, so the caller can skip the write without touching the memBuffer. The values are compared in bytes,
+// and the row level checksum is not encoded, so an existing value with the checksum is never regarded as equal.
+func (b *EncodeRowBuffer) WouldBeNoOp(
+	existing []byte, cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+) (bool, error) {
+	encoded, err := b.EncodeTo(cfg, loc, ec, b.noOpBuf[:0])
+	if err != nil {
+		return false, err
+	}
+	b.noOpBuf = encoded
+	return bytes.Equal(encoded, existing), nil
+}
+
+// encodeForWrite validates and encodes the row to be written to the `key` for `WriteMemBufferEncoded`.
+// The returned slice references `WriteStmtBufs.RowValBuf`.
+func (b *EncodeRowBuffer) encodeForWrite(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context, key kv.Key, handle kv.Handle,
+) ([]byte, error) {
+	if intest.EnableAssert && b.hasTableID {
+		keyTableID := tablecodec.DecodeTableID(key)
+		// the key of a partitioned table is encoded with the partition id of the handle, see `RecordKey`
+		if ph, ok := handle.(kv.PartitionHandle); ok {
+			intest.Assert(keyTableID == b.tableID || keyTableID == ph.PartitionID,
+				"the buffer is configured for table %d and the handle is of partition %d, but writes to the key of table %d",
+				b.tableID, ph.PartitionID, keyTableID)
+		} else {
+			intest.Assert(keyTableID == b.tableID,
+				"the buffer is configured for table %d, but writes to the key of table %d", b.tableID, keyTableID)
+		}
+	}
+
+	if err := b.prepareForEncode(cfg, ec); err != nil {
+		return nil, err
+	}
+
+	if intest.EnableAssert && b.commonHandlePK.Index != nil {
+		b.assertCommonHandle(loc, handle)
+	}
+
 	var checksum rowcodec.Checksum
 	if cfg.IsRowLevelChecksumEnabled {
 		checksum = rowcodec.RawChecksum{Handle: handle}
@@ -66,25 +1005,301 @@ func (b *EncodeRowBuffer) WriteMemBufferEncoded(
 	// so the correct length is rowLen * 2.
 	// If the inserting row has null value,
 	// AddRecord will skip it, so the rowLen will be different, so we need to adjust it.
-	stmtBufs.AddRowValues = ensureCapacityAndReset(stmtBufs.AddRowValues, len(b.row)*2)
+	stmtBufs.AddRowValues = ensureCapacityAndResetWithStats(&b.reuse, stmtBufs.AddRowValues, len(b.row)*2)
+
+	if err := b.injectFault(FaultStageEncode); err != nil {
+		return nil, err
+	}
 
 	encoded, err := tablecodec.EncodeRow(
 		loc, b.row, b.colIDs, stmtBufs.RowValBuf, stmtBufs.AddRowValues, checksum, cfg.RowEncoder,
 	)
 	if err = ec.HandleError(err); err != nil {
-		return err
+		return nil, err
 	}
 	stmtBufs.RowValBuf = encoded
+	b.checksumWritten = cfg.IsRowLevelChecksumEnabled
+	b.encodedLoc = loc
+	return encoded, nil
+}
 
-	if len(flags) == 0 {
-		return memBuffer.Set(key, encoded)
+// assertCommonHandle asserts `handle` equals to the common handle encoded from the values of the primary key set by
+// `SetCommonHandlePK` like `AddRecord`, that is, the values are truncated to the prefix lengths and encoded as a key.
+func (b *EncodeRowBuffer) assertCommonHandle(loc *time.Location, handle kv.Handle) {
+	if ph, ok := handle.(kv.PartitionHandle); ok {
+		handle = ph.Handle
+	}
+	pk := b.commonHandlePK
+	if err := b.fillIndexedValues(pk, handle); err != nil {
+		// some primary key columns are not added
+		return
+	}
+	tablecodec.TruncateIndexValues(pk.Table, pk.Index, b.indexVals)
+	expected, err := codec.EncodeKey(loc, nil, b.indexVals...)
+	if err != nil {
+		// the values fail to encode, which is reported by the encoding of the row
+		return
+	}
+	intest.Assert(!handle.IsInt() && bytes.Equal(expected, handle.Encoded()),
+		"the handle %s mismatches the primary key values of the row, which is encoded as %x", handle, expected)
+}
+
+// MinimalUpdate encodes the row in the buffer as the new value of an UPDATE and compares it with the `before` row,
+// so only the indexes of the changed columns need to be maintained. It returns the ids of the changed columns in the
+// order they were added and the new encoded value, which references `WriteStmtBufs.RowValBuf` like
+// `WriteMemBufferEncoded` and is only valid until the next encoding.
+// `fts` provides the field types of the columns to decode. The buffer should contain all the columns of the row,
+// and a column missing in the `before` row is regarded as NULL. The `before` row should not reference
+// `WriteStmtBufs.RowValBuf`, because it is overwritten by the encoding. Both rows are decoded before comparison, so the
+// values are compared regardless of the row formats, and the strings are compared in binary.
+func (b *EncodeRowBuffer) MinimalUpdate(
+	before []byte, fts map[int64]*types.FieldType, cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+	key kv.Key, handle kv.Handle,
+) (changedColIDs []int64, newValue []byte, err error) {
+	newValue, err = b.encodeForWrite(cfg, loc, ec, key, handle)
+	if err != nil {
+		return nil, nil, err
+	}
+	beforeRow, err := tablecodec.DecodeRowToDatumMap(before, fts, loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	afterRow, err := tablecodec.DecodeRowToDatumMap(newValue, fts, loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, colID := range b.colIDs {
+		beforeVal, afterVal := beforeRow[colID], afterRow[colID]
+		res, err := beforeVal.Compare(types.DefaultStmtNoWarningContext, &afterVal, collate.GetBinaryCollator())
+		if err != nil {
+			return nil, nil, err
+		}
+		if res != 0 {
+			changedColIDs = append(changedColIDs, colID)
+		}
+	}
+	return changedColIDs, newValue, nil
+}
+
+// EncodeBoth encodes the added columns to both the new row format and the old row format, which is used by the
+// dual-write migration to write the new format while shipping the old format to a legacy consumer.
+// The new format is encoded by `cfg.RowEncoder`, which must be enabled, and the row level checksum is not encoded.
+// The row is validated like `WriteMemBufferEncoded`.
+// The returned slices reference the inner buffers, so they are only valid until the next encoding.
+func (b *EncodeRowBuffer) EncodeBoth(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+) (newFormat, oldFormat []byte, err error) {
+	if cfg.RowEncoder == nil || !cfg.RowEncoder.Enable {
+		return nil, nil, errors.New("EncodeBoth requires an enabled row encoder for the new row format")
+	}
+	if err = b.prepareForEncode(cfg, ec); err != nil {
+		return nil, nil, err
+	}
+
+	stmtBufs := b.writeStmtBufs
+	newFormat, err = cfg.RowEncoder.Encode(loc, b.colIDs, b.row, nil, stmtBufs.RowValBuf[:0])
+	if err = ec.HandleError(err); err != nil {
+		return nil, nil, err
+	}
+	stmtBufs.RowValBuf = newFormat
+	b.checksumWritten = false
+	b.encodedLoc = loc
+
+	stmtBufs.AddRowValues = ensureCapacityAndResetWithStats(&b.reuse, stmtBufs.AddRowValues, len(b.row)*2)
+	oldFormat, err = tablecodec.EncodeOldRow(loc, b.row, b.colIDs, b.oldFormatBuf, stmtBufs.AddRowValues)
+	if err = ec.HandleError(err); err != nil {
+		return nil, nil, err
+	}
+	b.oldFormatBuf = oldFormat
+	return newFormat, oldFormat, nil
+}
+
+// EncodeColumnChunk encodes the added columns as a one-row column chunk, which is used by the HTAP consistency tests
+// to compare the row written to TiKV with the columnar representation read from TiFlash.
+// It is an approximation of the TiFlash columnar storage: the format is the TiDB chunk encoding returned by TiFlash
+// for the chunk encode type (see `chunk.Codec`), rather than the on-disk format of TiFlash. The chunk has a column
+// for each of the added columns in order, whose type is the same position of `fts`, and the column ids are not
+// encoded. The values must match their field types, as they do after being cast for the write.
+func (b *EncodeRowBuffer) EncodeColumnChunk(fts []*types.FieldType) ([]byte, error) {
+	if len(fts) != len(b.row) {
+		return nil, errors.Errorf("the count of field types %d mismatches the count of columns %d",
+			len(fts), len(b.row))
+	}
+	if err := b.evalLazyColVals(); err != nil {
+		return nil, err
+	}
+	chk := chunk.NewChunkWithCapacity(fts, 1)
+	for i := range b.row {
+		switch b.row[i].Kind() {
+		case types.KindMinNotNull, types.KindMaxValue, types.KindInterface:
+			return nil, errors.Errorf("column %d of kind %d can not be encoded to a column chunk",
+				b.colIDs[i], b.row[i].Kind())
+		}
+		chk.AppendDatum(i, &b.row[i])
+	}
+	return chunk.NewCodec(fts).Encode(chk), nil
+}
+
+// AssertDeterministic encodes the added columns `runs` times and returns an error if any two encodings differ
+// byte-for-byte. It is a test utility to guard against nondeterministic encoding, e.g. map iteration leaking into
+// the output. Each run encodes into a fresh buffer so that a run can not reuse the output of the previous one.
+// The row is validated like `WriteMemBufferEncoded`, and the row level checksum is not encoded because there is no
+// handle.
+func (b *EncodeRowBuffer) AssertDeterministic(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context, runs int,
+) error {
+	if runs < 2 {
+		return errors.Errorf("AssertDeterministic requires at least 2 runs, got %d", runs)
+	}
+	if err := b.prepareForEncode(cfg, ec); err != nil {
+		return err
+	}
+
+	var first []byte
+	for i := range runs {
+		values := make([]types.Datum, len(b.row)*2)
+		encoded, err := tablecodec.EncodeRow(loc, b.row, b.colIDs, nil, values, nil, cfg.RowEncoder)
+		if err = ec.HandleError(err); err != nil {
+			return err
+		}
+		if i == 0 {
+			first = encoded
+			continue
+		}
+		if !bytes.Equal(first, encoded) {
+			return errors.Errorf("nondeterministic row encoding: run 0 got %s, run %d got %s",
+				hex.EncodeToString(first), i, hex.EncodeToString(encoded))
+		}
 	}
-	return memBuffer.SetWithFlags(key, encoded, flags...)
+	return nil
+}
+
+// WriteTxnEncoded is similar to `WriteMemBufferEncoded`,
+// but it writes the encoded row to the memBuffer of the transaction.
+func (b *EncodeRowBuffer) WriteTxnEncoded(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+	txn kv.Transaction, key kv.Key, handle kv.Handle, flags ...kv.FlagsOp,
+) error {
+	return b.WriteMemBufferEncoded(cfg, loc, ec, txn.GetMemBuffer(), key, handle, flags...)
+}
+
+// RowDecodeCursor iterates the columns of the row written by the last `EncodeRowBuffer.WriteMemBufferEncoded`.
+type RowDecodeCursor struct {
+	colIDs []int64
+	row    map[int64]types.Datum
+	pos    int
+	err    error
+}
+
+// Next returns the next decoded column. The columns are returned in the order they were added to the buffer,
+// and the columns without field types are skipped. `ok` is false when there are no more columns or an error occurs.
+func (c *RowDecodeCursor) Next() (colID int64, val types.Datum, ok bool) {
+	for c.err == nil && c.pos < len(c.colIDs) {
+		colID = c.colIDs[c.pos]
+		c.pos++
+		if val, ok = c.row[colID]; ok {
+			return colID, val, true
+		}
+	}
+	return 0, types.Datum{}, false
+}
+
+// Err returns the error occurred when decoding the row.
+func (c *RowDecodeCursor) Err() error {
+	return c.err
+}
+
+// NewDecodeCursor returns a cursor to decode the row written by the last `WriteMemBufferEncoded`,
+// which is used to validate the written row, for example, read-your-writes validation.
+// `fts` provides the field types of the columns to decode.
+// The returned cursor is reused by the buffer, so it is only valid until the next call of this method,
+// and it should not be used after the buffer is reset.
+func (b *EncodeRowBuffer) NewDecodeCursor(fts map[int64]*types.FieldType) *RowDecodeCursor {
+	c := &b.cursor
+	c.colIDs, c.pos, c.err = b.colIDs, 0, nil
+	if c.row == nil {
+		c.row = make(map[int64]types.Datum, len(fts))
+	} else {
+		clear(c.row)
+	}
+	encoded := b.writeStmtBufs.RowValBuf
+	if len(encoded) > 0 && rowcodec.IsNewFormat(encoded) {
+		_, c.err = tablecodec.DecodeRowWithMapNew(encoded, fts, b.encodedLoc, c.row)
+	} else {
+		_, c.err = tablecodec.DecodeRowWithMap(encoded, fts, b.encodedLoc, c.row)
+	}
+	return c
+}
+
+// ColumnOffsetIndex returns an index of the last row encoded by `WriteMemBufferEncoded` or `EncodeBoth`
+// (the new row format), which enables the readers to read a column without decoding the whole row.
+// The key of the index is the column id, and the value is the start offset and the length of the column value in
+// the encoded row. The values of the new row format are encoded in the compact form of `rowcodec`, and the values
+// of the old row format are encoded by `codec.EncodeValue`. The NULL columns are not included in the index.
+func (b *EncodeRowBuffer) ColumnOffsetIndex() (map[int64][2]int, error) {
+	if b.encodedLoc == nil {
+		return nil, errors.New("no row is encoded in the buffer")
+	}
+	return columnOffsets(b.writeStmtBufs.RowValBuf, len(b.colIDs))
+}
+
+// columnOffsets returns the start offset and the length of each non-NULL column value in the encoded row, see
+// `EncodeRowBuffer.ColumnOffsetIndex`. `sizeHint` is the expected count of the columns.
+func columnOffsets(rowData []byte, sizeHint int) (map[int64][2]int, error) {
+	if rowcodec.IsNewFormat(rowData) {
+		return rowcodec.ColumnOffsets(rowData)
+	}
+
+	// the old row format is `colID1, value1, colID2, value2, ...` encoded by `codec.EncodeValue`.
+	index := make(map[int64][2]int, sizeHint)
+	for remain := rowData; len(remain) > 0 && remain[0] != codec.NilFlag; {
+		idData, rest, err := codec.CutOne(remain)
+		if err != nil {
+			return nil, err
+		}
+		_, colID, err := codec.DecodeOne(idData)
+		if err != nil {
+			return nil, err
+		}
+		val, rest, err := codec.CutOne(rest)
+		if err != nil {
+			return nil, err
+		}
+		if val[0] != codec.NilFlag {
+			index[colID.GetInt64()] = [2]int{len(rowData) - len(rest) - len(val), len(val)}
+		}
+		remain = rest
+	}
+	return index, nil
+}
+
+// The attribute keys filled by `EncodeRowBuffer.FillSpanAttributes`.
+const (
+	// SpanAttrEncodedBytes is the size of the encoded row value.
+	SpanAttrEncodedBytes = "encoded_bytes"
+	// SpanAttrColumnCount is the count of the columns in the row.
+	SpanAttrColumnCount = "column_count"
+	// SpanAttrChecksumEnabled indicates whether the row level checksum is encoded.
+	SpanAttrChecksumEnabled = "checksum_enabled"
+)
+
+// FillSpanAttributes populates `attrs` with the attributes of the row written by the last `WriteMemBufferEncoded`.
+// It is used to feed a tracing span to observe the write amplification.
+func (b *EncodeRowBuffer) FillSpanAttributes(attrs map[string]any) {
+	attrs[SpanAttrEncodedBytes] = len(b.writeStmtBufs.RowValBuf)
+	attrs[SpanAttrColumnCount] = len(b.colIDs)
+	attrs[SpanAttrChecksumEnabled] = b.checksumWritten
 }
 
 // EncodeBinlogRowData encodes the row data for binlog and returns the encoded row value.
 // The returned slice is not referenced in the buffer, so you can cache and modify them freely.
 func (b *EncodeRowBuffer) EncodeBinlogRowData(loc *time.Location, ec errctx.Context) ([]byte, error) {
+	if err := b.evalLazyColVals(); err != nil {
+		return nil, err
+	}
+	if err := b.normalizeValues(ec, nil); err != nil {
+		return nil, err
+	}
 	value, err := tablecodec.EncodeOldRow(loc, b.row, b.colIDs, nil, nil)
 	err = ec.HandleError(err)
 	if err != nil {
@@ -93,24 +1308,272 @@ func (b *EncodeRowBuffer) EncodeBinlogRowData(loc *time.Location, ec errctx.Cont
 	return value, nil
 }
 
-// CheckRowBuffer is used to check row constraints
-type CheckRowBuffer struct {
-	rowToCheck []types.Datum
+// RecordKey returns the record key of the row with `handle` in the table configured by `ResetForTable`, which is
+// encoded by the `HandleEncoder` of the table. If `handle` is a `kv.PartitionHandle`, the partition id is used.
+// The returned key references the inner scratch of the buffer, so it is only valid until the next call.
+func (b *EncodeRowBuffer) RecordKey(handle kv.Handle) (kv.Key, error) {
+	if !b.hasTableID || b.handleEncoder == nil {
+		return nil, errors.New("the buffer is not configured with a handle encoder, please call ResetForTable first")
+	}
+	tableID := b.tableID
+	if ph, ok := handle.(kv.PartitionHandle); ok {
+		tableID, handle = ph.PartitionID, ph.Handle
+	}
+	key, err := b.handleEncoder.AppendRecordKey(b.keyBuf[:0], tableID, handle)
+	if err != nil {
+		return nil, err
+	}
+	b.keyBuf = key
+	return key, nil
+}
+
+// IndexSpec is an index of a table whose keys are computed by `EncodeRowBuffer.IndexDeleteKeys`.
+type IndexSpec struct {
+	// Table is the table of the index.
+	Table *model.TableInfo
+	// Index is the index.
+	Index *model.IndexInfo
+}
+
+// IndexDeleteKeys computes the keys of the indexes `indexes` to delete for the row with `handle` from the added
+// columns. The clustered primary key is skipped because it has no index entries. The key of a unique index does
+// not contain the handle unless the indexed values contain NULL, like `tablecodec.GenIndexKey`.
+// The indexed columns must be added except the integer handle column, whose value is taken from `handle`.
+// The keys are encoded in the table configured by `ResetForTable` or the table of the index, and the partition id
+// is used if `handle` is a `kv.PartitionHandle`. The keys of a global index are encoded in the logical table,
+// see `indexTableID`.
+// The returned keys reference the inner scratch of the buffer, so they are only valid until the next call.
+func (b *EncodeRowBuffer) IndexDeleteKeys(loc *time.Location, indexes []IndexSpec, handle kv.Handle) ([]kv.Key, error) {
+	if err := b.evalLazyColVals(); err != nil {
+		return nil, err
+	}
+	physicalID, hasPhysicalID, handle := b.physicalIDForHandle(handle)
+
+	b.indexKeysBuf = b.indexKeysBuf[:0]
+	ends := make([]int, 0, len(indexes))
+	for _, spec := range indexes {
+		if spec.isClusteredPrimary() {
+			continue
+		}
+		if err := b.fillIndexedValues(spec, handle); err != nil {
+			return nil, err
+		}
+		tableID := spec.Table.ID
+		if hasPhysicalID {
+			tableID = physicalID
+		}
+		key, _, err := tablecodec.GenIndexKey(
+			loc, spec.Table, spec.Index, indexTableID(spec, tableID), b.indexVals, handle, b.indexKeyBuf,
+		)
+		if err != nil {
+			return nil, err
+		}
+		b.indexKeyBuf = key
+		b.indexKeysBuf = append(b.indexKeysBuf, key...)
+		ends = append(ends, len(b.indexKeysBuf))
+	}
+
+	// the keys are sliced after all of them are appended, because the scratch may be reallocated
+	b.indexKeys = b.indexKeys[:0]
+	start := 0
+	for _, end := range ends {
+		b.indexKeys = append(b.indexKeys, b.indexKeysBuf[start:end:end])
+		start = end
+	}
+	return b.indexKeys, nil
 }
 
-// GetRowToCheck gets the row data for constraint check.
-func (b *CheckRowBuffer) GetRowToCheck() chunk.Row {
-	return chunk.MutRowFromDatums(b.rowToCheck).ToRow()
+// rawChecksumSize is the size of the checksum header and the checksum encoded by `rowcodec.RawChecksum`.
+const rawChecksumSize = 1 + 4
+
+// EstimateWriteAmplification estimates the total bytes written for the row with `handle`, that is, the record key
+// and the encoded row, plus the keys and the values of the entries of `indexes`. The row is encoded to a scratch
+// like `EncodeTo` without writing anything or touching the `WriteStmtBufs` of the session, so the added columns are
+// validated like `WriteMemBufferEncoded`, and the row level checksum is counted if it is enabled in `cfg`.
+// The record key is encoded by the `HandleEncoder` configured by `ResetForTable` if any.
+// The table and the indexes are resolved like `IndexDeleteKeys`, and the value of a global index contains the id of
+// the physical table. The restored data of the common handle is not
+// counted for the indexes of the tables whose common handle version is 1.
+func (b *EncodeRowBuffer) EstimateWriteAmplification(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context, indexes []IndexSpec, handle kv.Handle,
+) (int, error) {
+	if handle == nil {
+		return 0, errors.New("EstimateWriteAmplification requires the handle of the row")
+	}
+	physicalID, hasPhysicalID, handle := b.physicalIDForHandle(handle)
+	recordTableID := physicalID
+	if !hasPhysicalID && len(indexes) > 0 {
+		recordTableID = indexes[0].Table.ID
+	}
+	var recordKey kv.Key
+	if b.handleEncoder != nil {
+		key, err := b.handleEncoder.AppendRecordKey(b.keyBuf[:0], recordTableID, handle)
+		if err != nil {
+			return 0, err
+		}
+		recordKey = key
+	} else {
+		recordKey = appendRecordKey(b.keyBuf[:0], recordTableID, handle.Encoded())
+	}
+	b.keyBuf = recordKey
+	rowVal, err := b.EncodeTo(cfg, loc, ec, b.noOpBuf[:0])
+	if err != nil {
+		return 0, err
+	}
+	b.noOpBuf = rowVal
+	total := len(recordKey) + len(rowVal)
+	if cfg.IsRowLevelChecksumEnabled && cfg.RowEncoder.Enable {
+		total += rawChecksumSize
+	}
+
+	for _, spec := range indexes {
+		if spec.isClusteredPrimary() {
+			continue
+		}
+		if err := b.fillIndexedValues(spec, handle); err != nil {
+			return 0, err
+		}
+		tblInfo, idxInfo := spec.Table, spec.Index
+		tableID := tblInfo.ID
+		if hasPhysicalID {
+			tableID = physicalID
+		}
+		key, distinct, err := tablecodec.GenIndexKey(
+			loc, tblInfo, idxInfo, indexTableID(spec, tableID), b.indexVals, handle, b.indexKeyBuf,
+		)
+		if err != nil {
+			return 0, err
+		}
+		b.indexKeyBuf = key
+		needRestoredData := slices.ContainsFunc(idxInfo.Columns, func(idxCol *model.IndexColumn) bool {
+			return types.NeedRestoredData(&tblInfo.Columns[idxCol.Offset].FieldType)
+		})
+		val, err := tablecodec.GenIndexValuePortal(
+			loc, tblInfo, idxInfo, needRestoredData, distinct, false, b.indexVals, handle, tableID, nil, b.indexValBuf,
+		)
+		if err != nil {
+			return 0, err
+		}
+		b.indexValBuf = val
+		total += len(key) + len(val)
+	}
+	return total, nil
+}
+
+// physicalIDForHandle returns the id of the physical table of `handle`, that is, the partition id if `handle` is a
+// `kv.PartitionHandle`, or the table configured by `ResetForTable`. The second return value is false if neither
+// is available. The returned handle is unwrapped from the `kv.PartitionHandle`.
+func (b *EncodeRowBuffer) physicalIDForHandle(handle kv.Handle) (int64, bool, kv.Handle) {
+	if ph, ok := handle.(kv.PartitionHandle); ok {
+		return ph.PartitionID, true, ph.Handle
+	}
+	return b.tableID, b.hasTableID, handle
+}
+
+// indexTableID returns the id of the table the keys of the index are encoded in. Like `tables.index.GenIndexKey`,
+// the keys of a global index are encoded in the logical table, or in the new table of the partition reorganization
+// if the index is not public yet, and the keys of the other indexes are encoded in the physical table `physicalID`.
+func indexTableID(spec IndexSpec, physicalID int64) int64 {
+	if !spec.Index.Global {
+		return physicalID
+	}
+	if pi := spec.Table.GetPartitionInfo(); pi != nil && pi.NewTableID != 0 && spec.Index.State != model.StatePublic {
+		return pi.NewTableID
+	}
+	return spec.Table.ID
+}
+
+// isClusteredPrimary returns whether the index is the clustered primary key, which has no index entries.
+func (s IndexSpec) isClusteredPrimary() bool {
+	return s.Index.Primary && (s.Table.IsCommonHandle || s.Table.PKIsHandle)
+}
+
+// fillIndexedValues fills `indexVals` with the values of the columns of the index taken from the added columns.
+// The value of the integer handle column is taken from `handle` if it is not added.
+func (b *EncodeRowBuffer) fillIndexedValues(spec IndexSpec, handle kv.Handle) error {
+	tblInfo, idxInfo := spec.Table, spec.Index
+	b.indexVals = b.indexVals[:0]
+	for _, idxCol := range idxInfo.Columns {
+		col := tblInfo.Columns[idxCol.Offset]
+		if idx := slices.Index(b.colIDs, col.ID); idx >= 0 {
+			b.indexVals = append(b.indexVals, b.row[idx])
+			continue
+		}
+		if !tblInfo.PKIsHandle || !mysql.HasPriKeyFlag(col.GetFlag()) || !handle.IsInt() {
+			return errors.Errorf("the column %s of the index %s is not added", col.Name.O, idxInfo.Name.O)
+		}
+		if mysql.HasUnsignedFlag(col.GetFlag()) {
+			b.indexVals = append(b.indexVals, types.NewUintDatum(uint64(handle.IntValue())))
+		} else {
+			b.indexVals = append(b.indexVals, types.NewIntDatum(handle.IntValue()))
+		}
+	}
+	return nil
+}
+
+// RecordKeyRange returns the key range [start, end) which covers exactly the record key of the row with `handle`
+// in the table `tableID`. If `handle` is a `kv.PartitionHandle`, the partition id is used instead of `tableID`.
+// The returned keys reference the inner scratch of the buffer, so they are only valid until the next call.
+func (b *EncodeRowBuffer) RecordKeyRange(tableID int64, handle kv.Handle) (start, end kv.Key) {
+	if ph, ok := handle.(kv.PartitionHandle); ok {
+		tableID = ph.PartitionID
+	}
+	// the smallest key after the record key is the record key appending a zero byte.
+	buf := appendRecordKey(b.keyBuf[:0], tableID, handle.Encoded())
+	keyLen := len(buf)
+	buf = append(buf, buf...)
+	buf = append(buf, 0)
+	b.keyBuf = buf
+	return buf[:keyLen:keyLen], buf[keyLen:]
+}
+
+// GoldenEncodingVersion is the format version of `EncodeRowBuffer.GoldenEncoding`.
+// It should be bumped once the golden encoding of the same row changes.
+const GoldenEncodingVersion byte = 1
+
+// GoldenEncoding encodes the added columns in a stable form which can be compared with the golden bytes committed
+// by an older version, see `FormatGoldenEncoding` and `CompareGoldenEncoding`.
+// The row is always encoded in the new row format with `time.UTC` and without checksum. The columns are ordered by
+// the ascending column ids no matter in which order they are added. The first byte is `GoldenEncodingVersion`.
+func (b *EncodeRowBuffer) GoldenEncoding() ([]byte, error) {
+	if err := b.evalLazyColVals(); err != nil {
+		return nil, err
+	}
+	encoder := &rowcodec.Encoder{Enable: true}
+	return encoder.Encode(time.UTC, b.colIDs, b.row, nil, []byte{GoldenEncodingVersion})
 }
 
-// AddColVal adds a column value to the buffer for checking.
-func (b *CheckRowBuffer) AddColVal(val types.Datum) {
-	b.rowToCheck = append(b.rowToCheck, val)
+// FormatGoldenEncoding formats the bytes returned by `EncodeRowBuffer.GoldenEncoding` to the text committed as
+// the golden file. The text is like "version: 1\n<hex>\n".
+func FormatGoldenEncoding(encoded []byte) string {
+	if len(encoded) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("version: %d\n%s\n", encoded[0], hex.EncodeToString(encoded[1:]))
 }
 
-// Reset resets the inner buffer to a capacity.
-func (b *CheckRowBuffer) Reset(capacity int) {
-	b.rowToCheck = ensureCapacityAndReset(b.rowToCheck, 0, capacity)
+// CompareGoldenEncoding compares the bytes returned by `EncodeRowBuffer.GoldenEncoding` with the golden text
+// produced by `FormatGoldenEncoding`. It returns an error describing the difference if they are not the same.
+func CompareGoldenEncoding(golden string, encoded []byte) error {
+	versionLine, hexLine, ok := strings.Cut(strings.TrimSpace(golden), "\n")
+	if !ok {
+		return errors.New("invalid golden encoding, expect a version line and a hex line")
+	}
+	version, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(versionLine, "version:")), 10, 8)
+	if err != nil {
+		return errors.Annotate(err, "invalid golden encoding version")
+	}
+	expected, err := hex.DecodeString(strings.TrimSpace(hexLine))
+	if err != nil {
+		return errors.Annotate(err, "invalid golden encoding")
+	}
+	if len(encoded) == 0 || encoded[0] != byte(version) {
+		return errors.Errorf("golden encoding version mismatch, expected %d, got %s", version, FormatGoldenEncoding(encoded))
+	}
+	if !bytes.Equal(expected, encoded[1:]) {
+		return errors.Errorf("golden encoding mismatch, expected %x, got %x", expected, encoded[1:])
+	}
+	return nil
 }
 
 // MutateBuffers is a memory pool for table related memory allocation that aims to reuse memory
@@ -123,6 +1586,8 @@ type MutateBuffers struct {
 	stmtBufs  *variable.WriteStmtBufs
 	encodeRow *EncodeRowBuffer
 	checkRow  *CheckRowBuffer
+	// encodeRowPair is the buffers returned by `GetEncodeRowBufferPair`, which are created at the first call.
+	encodeRowPair [2]*EncodeRowBuffer
 }
 
 // NewMutateBuffers creates a new `MutateBuffers`.
@@ -137,6 +1602,26 @@ func NewMutateBuffers(stmtBufs *variable.WriteStmtBufs) *MutateBuffers {
 	}
 }
 
+// CapacityProfile describes the characteristic row width of a workload, which is used to presize the buffers
+// of `MutateBuffers` to avoid the reallocations when the buffers are used for the first few times.
+type CapacityProfile struct {
+	// Columns is the expected number of the columns in a row.
+	Columns int
+	// RowBytes is the expected size of an encoded row in bytes.
+	RowBytes int
+}
+
+// NewMutateBuffersWithProfile creates a new `MutateBuffers` with the buffers presized by the `profile`.
+func NewMutateBuffersWithProfile(stmtBufs *variable.WriteStmtBufs, profile CapacityProfile) *MutateBuffers {
+	buffers := NewMutateBuffers(stmtBufs)
+	buffers.encodeRow.Reset(profile.Columns)
+	buffers.checkRow.Reset(profile.Columns)
+	// AddRowValues stores the column ids and values for the old row format, see `WriteMemBufferEncoded`.
+	stmtBufs.AddRowValues = ensureCapacityAndReset(stmtBufs.AddRowValues, 0, profile.Columns*2)
+	stmtBufs.RowValBuf = ensureCapacityAndReset(stmtBufs.RowValBuf, 0, profile.RowBytes)
+	return buffers
+}
+
 // GetEncodeRowBufferWithCap gets the buffer to encode a row.
 // Usage:
 // 1. Call `MutateBuffers.GetEncodeRowBufferWithCap` to get the buffer.
@@ -150,6 +1635,27 @@ func (b *MutateBuffers) GetEncodeRowBufferWithCap(capacity int) *EncodeRowBuffer
 	return buffer
 }
 
+// GetEncodeRowBufferPair gets two buffers to encode the rows concurrently, for example, to encode the handle columns
+// and the value columns of a clustered index table in parallel goroutines.
+// The two buffers share nothing mutable with each other or with the buffer of `GetEncodeRowBufferWithCap`:
+// each of them has its own `WriteStmtBufs` instead of the one of the session, so `GetWriteStmtBufs` does not reflect
+// their encoded rows. Each buffer is still not safe for concurrent use, and the goroutines should not share the
+// `RowEncodingConfig.RowEncoder`, which is stateful.
+// Like `GetEncodeRowBufferWithCap`, the buffers are reset and reused by the next call.
+func (b *MutateBuffers) GetEncodeRowBufferPair() (first, second *EncodeRowBuffer) {
+	for i, buffer := range b.encodeRowPair {
+		if buffer == nil {
+			buffer = &EncodeRowBuffer{writeStmtBufs: &variable.WriteStmtBufs{}}
+			b.encodeRowPair[i] = buffer
+		}
+		buffer.Reset(0)
+		buffer.faultInjector = b.encodeRow.faultInjector
+		buffer.copyOnAdd = b.encodeRow.copyOnAdd
+		buffer.setInternStrings(b.encodeRow.internStrings)
+	}
+	return b.encodeRowPair[0], b.encodeRowPair[1]
+}
+
 // GetCheckRowBufferWithCap gets the buffer to check row constraints.
 // Usage:
 // 1. Call `GetCheckRowBufferWithCap` to get the buffer.
@@ -163,11 +1669,122 @@ func (b *MutateBuffers) GetCheckRowBufferWithCap(capacity int) *CheckRowBuffer {
 	return buffer
 }
 
+// BatchEncoder gets an encoder to encode multiple rows with the shared `cfg`, `loc` and `ec`, see `BatchEncoder`.
+// It uses the same buffer as `GetEncodeRowBufferWithCap`, so the two should not be used at the same time.
+func (b *MutateBuffers) BatchEncoder(cfg RowEncodingConfig, loc *time.Location, ec errctx.Context) *BatchEncoder {
+	return &BatchEncoder{buffer: b.encodeRow, cfg: cfg, loc: loc, ec: ec}
+}
+
+// ShrinkIfIdle shrinks the buffer to encode a row if it is much larger than recently used,
+// see `EncodeRowBuffer.ShrinkIfIdle`. It should be called between statements.
+func (b *MutateBuffers) ShrinkIfIdle(threshold int) bool {
+	return b.encodeRow.ShrinkIfIdle(threshold)
+}
+
+// SetFaultInjector sets a hook which is called at the named stages of `EncodeRowBuffer.WriteMemBufferEncoded`,
+// see `FaultStageEncode` and `FaultStageSet`. If the hook returns an error, the write fails with it at that stage.
+// It is used to test the error paths of the write layer and only works in test. Pass nil to remove the hook.
+func (b *MutateBuffers) SetFaultInjector(fn func(stage string) error) {
+	intest.Assert(intest.InTest, "SetFaultInjector should only be used in test")
+	b.encodeRow.faultInjector = fn
+}
+
+// SetCopyOnAdd sets whether the buffers to encode a row copy the values sharing the memory with the source, such as
+// the string, BLOB, BIT and JSON values, when they are added by `EncodeRowBuffer.AddColVal`, `AddColVals` or
+// `AddColValFromChunk`.
+// By default, the values are stored as is, so they share the memory with the caller until the buffer is reset, and the
+// caller should not modify the source before the row is encoded. The callers reusing their source buffers for the
+// next values can enable it to be safe, at the cost of an allocation and a copy for each string value added.
+// The mode is kept across the resets of the buffers, and is cleared by `ReleaseMutateBuffers`.
+func (b *MutateBuffers) SetCopyOnAdd(copyOnAdd bool) {
+	b.encodeRow.copyOnAdd = copyOnAdd
+}
+
+// SetInternStrings sets whether the buffers to encode a row intern the short string values added by
+// `EncodeRowBuffer.AddColVal`, `AddColVals` or `AddColValFromChunk`: a value equal to a recently added one reuses
+// its backing array, otherwise a copy of it is interned. It saves the allocations of `SetCopyOnAdd` for the
+// low-cardinality string columns, such as the enum-like values repeated in the wide append-only tables, but it
+// costs a lookup for each string value and an allocation for each new value, so it should not be enabled for the
+// high-cardinality data. Like `SetCopyOnAdd`, the interned values do not share the memory of the caller, while the
+// strings too long to intern are still shared unless `SetCopyOnAdd` is enabled.
+// The interned strings are kept across the resets of the buffers, and are dropped when it is disabled or by
+// `ReleaseMutateBuffers`.
+func (b *MutateBuffers) SetInternStrings(intern bool) {
+	b.encodeRow.setInternStrings(intern)
+}
+
+// ReuseStats returns how many times the inner slices of the buffers are reused and reallocated since the buffers are
+// created or acquired by `AcquireMutateBuffers`. A high reallocation count compared to the reuse hits indicates the
+// buffers are not sized properly.
+func (b *MutateBuffers) ReuseStats() (hits, reallocations uint64) {
+	hits = b.encodeRow.reuse.hits + b.checkRow.reuse.hits
+	reallocations = b.encodeRow.reuse.reallocations + b.checkRow.reuse.reallocations
+	for _, buffer := range b.encodeRowPair {
+		if buffer != nil {
+			hits += buffer.reuse.hits
+			reallocations += buffer.reuse.reallocations
+		}
+	}
+	return hits, reallocations
+}
+
+// MutateBuffersSnapshot is a read-only copy of the current state of `MutateBuffers`.
+// It is used to be included in the diagnostics such as panic messages.
+type MutateBuffersSnapshot struct {
+	// EncodeColIDs is the column ids added to the buffer to encode a row.
+	EncodeColIDs []int64
+	// EncodeDatumKinds is the kinds of the datums added to the buffer to encode a row.
+	EncodeDatumKinds []byte
+	// CheckRowWidth is the count of the columns added to the buffer to check row constraints.
+	CheckRowWidth int
+}
+
+// String implements the fmt.Stringer interface.
+func (s MutateBuffersSnapshot) String() string {
+	return fmt.Sprintf("{encodeColIDs: %v, encodeDatumKinds: %v, checkRowWidth: %d}",
+		s.EncodeColIDs, s.EncodeDatumKinds, s.CheckRowWidth)
+}
+
+// DebugSnapshot returns a snapshot of the current buffers for debugging.
+// The returned snapshot does not reference any inner buffer, so it is still safe to log after the buffers are reset.
+func (b *MutateBuffers) DebugSnapshot() MutateBuffersSnapshot {
+	kinds := make([]byte, len(b.encodeRow.row))
+	for i := range b.encodeRow.row {
+		kinds[i] = b.encodeRow.row[i].Kind()
+	}
+	return MutateBuffersSnapshot{
+		EncodeColIDs:     slices.Clone(b.encodeRow.colIDs),
+		EncodeDatumKinds: kinds,
+		CheckRowWidth:    len(b.checkRow.rowToCheck),
+	}
+}
+
 // GetWriteStmtBufs returns the `*variable.WriteStmtBufs`
 func (b *MutateBuffers) GetWriteStmtBufs() *variable.WriteStmtBufs {
 	return b.stmtBufs
 }
 
+// reuseStats counts the inner slices of a buffer reused and reallocated, see `MutateBuffers.ReuseStats`.
+// The buffers are owned by a session, so the counters are not atomic.
+type reuseStats struct {
+	hits          uint64
+	reallocations uint64
+}
+
+// ensureCapacityAndResetWithStats is similar to `ensureCapacityAndReset`, but it also counts the reuse in `stats`.
+func ensureCapacityAndResetWithStats[T any](stats *reuseStats, slice []T, size int, optCap ...int) []T {
+	capacity := size
+	if len(optCap) > 0 {
+		capacity = optCap[0]
+	}
+	if cap(slice) < capacity {
+		stats.reallocations++
+	} else {
+		stats.hits++
+	}
+	return ensureCapacityAndReset(slice, size, capacity)
+}
+
 // ensureCapacityAndReset is similar to the built-in make(),
 // but it reuses the given slice if it has enough capacity.
 func ensureCapacityAndReset[T any](slice []T, size int, optCap ...int) []T {
@@ -15,16 +15,34 @@
 package tblctx
 
 import (
+	"bytes"
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/pkg/errctx"
 	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/meta/model"
+	"github.com/pingcap/tidb/pkg/parser/ast"
 	"github.com/pingcap/tidb/pkg/parser/mysql"
 	"github.com/pingcap/tidb/pkg/sessionctx/variable"
 	"github.com/pingcap/tidb/pkg/tablecodec"
 	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/codec"
+	"github.com/pingcap/tidb/pkg/util/collate"
+	"github.com/pingcap/tidb/pkg/util/dbterror/plannererrors"
+	"github.com/pingcap/tidb/pkg/util/hack"
+	"github.com/pingcap/tidb/pkg/util/intest"
 	"github.com/pingcap/tidb/pkg/util/rowcodec"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -45,6 +63,46 @@ func (b *mockMemBuffer) Set(key kv.Key, value []byte) error {
 	return args.Error(0)
 }
 
+// mapMemBuffer is a memBuffer storing the values in a map.
+type mapMemBuffer struct {
+	kv.MemBuffer
+	values map[string][]byte
+}
+
+func (b *mapMemBuffer) Set(key kv.Key, value []byte) error {
+	b.values[string(key)] = slices.Clone(value)
+	return nil
+}
+
+func (b *mapMemBuffer) Get(_ context.Context, key kv.Key) ([]byte, error) {
+	val, ok := b.values[string(key)]
+	if !ok {
+		return nil, kv.ErrNotExist
+	}
+	return val, nil
+}
+
+func (b *mapMemBuffer) Delete(key kv.Key) error {
+	delete(b.values, string(key))
+	return nil
+}
+
+// batchGetterFunc adapts a function to `kv.BatchGetter`.
+type batchGetterFunc func(ctx context.Context, keys []kv.Key) (map[string][]byte, error)
+
+func (f batchGetterFunc) BatchGet(ctx context.Context, keys []kv.Key) (map[string][]byte, error) {
+	return f(ctx, keys)
+}
+
+type mockTxn struct {
+	kv.Transaction
+	memBuffer kv.MemBuffer
+}
+
+func (txn *mockTxn) GetMemBuffer() kv.MemBuffer {
+	return txn.memBuffer
+}
+
 type mockMutateCtx struct {
 	MutateContext
 	buffers *MutateBuffers
@@ -182,23 +240,1516 @@ func TestEncodeBufferReserve(t *testing.T) {
 	require.Equal(t, encodedCap, cap(buffer.writeStmtBufs.RowValBuf))
 }
 
-func TestCheckRowBuffer(t *testing.T) {
-	buffer := &CheckRowBuffer{}
-	buffer.Reset(6)
-	require.Equal(t, 0, len(buffer.rowToCheck))
-	require.Equal(t, 6, cap(buffer.rowToCheck))
-	buffer.AddColVal(types.NewIntDatum(1))
-	buffer.AddColVal(types.NewIntDatum(2))
-	require.Equal(t, []types.Datum{types.NewIntDatum(1), types.NewIntDatum(2)}, buffer.rowToCheck)
-	rowToCheck := buffer.GetRowToCheck()
-	require.Equal(t, 2, rowToCheck.Len())
-	require.Equal(t, int64(1), rowToCheck.GetInt64(0))
-	require.Equal(t, int64(2), rowToCheck.GetInt64(1))
+func TestEncodeRowBufferRecordKeyRange(t *testing.T) {
+	buffer := &EncodeRowBuffer{}
+	newCommonHandle := func(vals ...any) kv.Handle {
+		encoded, err := codec.EncodeKey(time.UTC, nil, types.MakeDatums(vals...)...)
+		require.NoError(t, err)
+		h, err := kv.NewCommonHandle(encoded)
+		require.NoError(t, err)
+		return h
+	}
+	for _, c := range []struct {
+		tableID    int64
+		handle     kv.Handle
+		nextHandle kv.Handle
+	}{
+		{1, kv.IntHandle(10), kv.IntHandle(11)},
+		{2, kv.IntHandle(-1), kv.IntHandle(0)},
+		{3, newCommonHandle("abc", 1), newCommonHandle("abc", 2)},
+	} {
+		start, end := buffer.RecordKeyRange(c.tableID, c.handle)
+		key := tablecodec.EncodeRowKeyWithHandle(c.tableID, c.handle)
+		require.Equal(t, key, start)
+		require.Less(t, key.Cmp(end), 0)
+		keyRange := kv.KeyRange{StartKey: start, EndKey: end}
+		require.True(t, keyRange.IsPoint())
+		nextKey := tablecodec.EncodeRowKeyWithHandle(c.tableID, c.nextHandle)
+		require.GreaterOrEqual(t, nextKey.Cmp(end), 0)
+	}
 
-	// reset should not shrink the capacity
+	// the partition id should be used for a partition handle
+	start, end := buffer.RecordKeyRange(1, kv.NewPartitionHandle(100, kv.IntHandle(10)))
+	require.Equal(t, tablecodec.EncodeRowKeyWithHandle(100, kv.IntHandle(10)), start)
+	require.Equal(t, tablecodec.EncodeRowKeyWithHandle(100, kv.IntHandle(10)).Next(), end)
+}
+
+func TestEncodeRowBufferAddUserColVal(t *testing.T) {
+	buffer := &EncodeRowBuffer{}
+	buffer.Reset(2)
+	generatedCols := map[int64]string{2: "c2"}
+	require.NoError(t, buffer.AddUserColVal(1, types.NewIntDatum(1), generatedCols, "t"))
+	err := buffer.AddUserColVal(2, types.NewIntDatum(2), generatedCols, "t")
+	require.True(t, plannererrors.ErrBadGeneratedColumn.Equal(err))
+	require.EqualError(t, err, "[planner:3105]The value specified for generated column 'c2' in table 't' is not allowed.")
+	// the value of the generated column should not be added
+	require.Equal(t, []int64{1}, buffer.colIDs)
+	require.Equal(t, []types.Datum{types.NewIntDatum(1)}, buffer.row)
+
+	// no generated columns
+	require.NoError(t, buffer.AddUserColVal(2, types.NewIntDatum(2), nil, "t"))
+	require.Equal(t, []int64{1, 2}, buffer.colIDs)
+}
+
+func TestEncodeRowBufferAddColVals(t *testing.T) {
+	buffer := &EncodeRowBuffer{}
+	buffer.Reset(1)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVals([]int64{2, 3}, []types.Datum{types.NewStringDatum("abc"), types.NewDatum(nil)})
+	require.Equal(t, []int64{1, 2, 3}, buffer.colIDs)
+	require.Equal(t, []types.Datum{
+		types.NewIntDatum(1), types.NewStringDatum("abc"), types.NewDatum(nil),
+	}, buffer.row)
+
+	// mismatched lengths should be detected in test
+	if intest.EnableAssert {
+		require.PanicsWithValue(t, "assert failed, the count of column ids 2 mismatches the count of values 1",
+			func() {
+				buffer.AddColVals([]int64{4, 5}, []types.Datum{types.NewIntDatum(4)})
+			})
+	}
+}
+
+func TestEncodeRowBufferAddColValFromChunk(t *testing.T) {
+	unsignedFt := types.NewFieldType(mysql.TypeLonglong)
+	unsignedFt.AddFlag(mysql.UnsignedFlag)
+	decimalFt := types.NewFieldType(mysql.TypeNewDecimal)
+	decimalFt.SetFlen(10)
+	decimalFt.SetDecimal(2)
+	fts := []*types.FieldType{
+		types.NewFieldType(mysql.TypeLonglong),
+		unsignedFt,
+		types.NewFieldType(mysql.TypeFloat),
+		types.NewFieldType(mysql.TypeDouble),
+		types.NewFieldType(mysql.TypeVarchar),
+		decimalFt,
+		types.NewFieldType(mysql.TypeDatetime),
+		types.NewFieldType(mysql.TypeDuration),
+		types.NewFieldType(mysql.TypeJSON),
+		types.NewFieldType(mysql.TypeLonglong),
+	}
+	datums := []types.Datum{
+		types.NewIntDatum(-1),
+		types.NewUintDatum(1 << 63),
+		types.NewFloat32Datum(1.5),
+		types.NewFloat64Datum(2.5),
+		types.NewStringDatum("abc"),
+		types.NewDecimalDatum(types.NewDecFromStringForTest("12.34")),
+		types.NewTimeDatum(types.NewTime(types.FromDate(2021, 1, 1, 1, 2, 3, 0), mysql.TypeDatetime, 0)),
+		types.NewDurationDatum(types.Duration{Duration: time.Hour}),
+		types.NewJSONDatum(types.CreateBinaryJSON("abc")),
+		types.NewDatum(nil),
+	}
+	chk := chunk.NewChunkWithCapacity(fts, 1)
+	chk.AppendRow(chunk.MutRowFromDatums(datums).ToRow())
+	colIDs := make([]int64, len(fts))
+	for i := range colIDs {
+		colIDs[i] = int64(i + 1)
+	}
+
+	// the encoding should be the same as the datum route
+	encodeByChunk := &EncodeRowBuffer{}
+	encodeByChunk.Reset(len(fts))
+	encodeByDatum := &EncodeRowBuffer{}
+	encodeByDatum.Reset(len(fts))
+	row := chk.GetRow(0)
+	for i, ft := range fts {
+		require.NoError(t, encodeByChunk.AddColValFromChunk(colIDs[i], chk.Column(i), 0, ft))
+		encodeByDatum.AddColVal(colIDs[i], row.GetDatum(i, ft))
+	}
+	require.Equal(t, encodeByDatum.colIDs, encodeByChunk.colIDs)
+	require.Equal(t, encodeByDatum.row, encodeByChunk.row)
+	require.True(t, encodeByChunk.row[len(fts)-1].IsNull())
+
+	// round trip
+	encoded, err := tablecodec.EncodeRow(time.UTC, encodeByChunk.row, encodeByChunk.colIDs, nil, nil, nil,
+		&rowcodec.Encoder{Enable: true})
+	require.NoError(t, err)
+	ftMap := make(map[int64]*types.FieldType, len(fts))
+	for i, ft := range fts {
+		ftMap[colIDs[i]] = ft
+	}
+	decoded, err := tablecodec.DecodeRowToDatumMap(encoded, ftMap, time.UTC)
+	require.NoError(t, err)
+	for i, ft := range fts {
+		d := decoded[colIDs[i]]
+		cmp, err := d.Compare(types.DefaultStmtNoWarningContext, &datums[i], collate.GetCollator(ft.GetCollate()))
+		require.NoError(t, err)
+		require.Equal(t, 0, cmp, "column %d", i)
+	}
+
+	// the unsupported type is an error, and the column is not added
+	geometryFt := types.NewFieldType(mysql.TypeGeometry)
+	geometryChk := chunk.NewChunkWithCapacity([]*types.FieldType{geometryFt}, 1)
+	geometryChk.AppendBytes(0, []byte("point"))
+	err = encodeByChunk.AddColValFromChunk(100, geometryChk.Column(0), 0, geometryFt)
+	require.ErrorContains(t, err, "does not support the type")
+	require.Len(t, encodeByChunk.colIDs, len(fts))
+	require.Len(t, encodeByChunk.row, len(fts))
+}
+
+func BenchmarkAddColValFromChunk(b *testing.B) {
+	fts := []*types.FieldType{types.NewFieldType(mysql.TypeLonglong), types.NewFieldType(mysql.TypeDouble)}
+	chk := chunk.NewChunkWithCapacity(fts, 1024)
+	for i := 0; i < 1024; i++ {
+		chk.AppendInt64(0, int64(i))
+		chk.AppendFloat64(1, float64(i))
+	}
+	buffer := &EncodeRowBuffer{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rowIdx := i % 1024
+		buffer.Reset(2)
+		if err := buffer.AddColValFromChunk(1, chk.Column(0), rowIdx, fts[0]); err != nil {
+			b.Fatal(err)
+		}
+		if err := buffer.AddColValFromChunk(2, chk.Column(1), rowIdx, fts[1]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddColValFromDatum(b *testing.B) {
+	fts := []*types.FieldType{types.NewFieldType(mysql.TypeLonglong), types.NewFieldType(mysql.TypeDouble)}
+	chk := chunk.NewChunkWithCapacity(fts, 1024)
+	for i := 0; i < 1024; i++ {
+		chk.AppendInt64(0, int64(i))
+		chk.AppendFloat64(1, float64(i))
+	}
+	buffer := &EncodeRowBuffer{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		row := chk.GetRow(i % 1024)
+		buffer.Reset(2)
+		buffer.AddColVal(1, row.GetDatum(0, fts[0]))
+		buffer.AddColVal(2, row.GetDatum(1, fts[1]))
+	}
+}
+
+func TestEncodeRowBufferLazyColVal(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	called := 0
+	lazyFn := func() (types.Datum, error) {
+		called++
+		return types.NewIntDatum(3), nil
+	}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+
+	// fn should not be called if the validation fails before encoding
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddLazyColVal(2, lazyFn)
+	validate := func() error { return errors.New("mock validation error") }
+	require.EqualError(t, validate(), "mock validation error")
+	require.Equal(t, 0, called)
+
+	// reset should clear the lazy columns
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	require.Empty(t, buffer.lazyCols)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddLazyColVal(2, lazyFn)
+	require.Equal(t, 0, called)
+
+	expectedVal, err := tablecodec.EncodeRow(
+		time.UTC, []types.Datum{types.NewIntDatum(1), types.NewIntDatum(3)}, []int64{1, 2},
+		nil, nil, nil, &rowcodec.Encoder{Enable: true},
+	)
+	require.NoError(t, err)
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), expectedVal).Return(nil).Once()
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	memBuffer.AssertExpectations(t)
+	require.Equal(t, 1, called)
+
+	// fn should be evaluated only once
+	_, err = buffer.EncodeBinlogRowData(time.UTC, errctx.StrictNoWarningContext)
+	require.NoError(t, err)
+	require.Equal(t, 1, called)
+
+	// error returned by fn should be returned directly
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(1)
+	buffer.AddLazyColVal(1, func() (types.Datum, error) {
+		return types.Datum{}, errors.New("mock eval error")
+	})
+	err = buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	)
+	require.EqualError(t, err, "mock eval error")
+}
+
+func TestEncodeRowBufferAddColValWithDefaultExpr(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	called := 0
+	defaultExpr := func() (types.Datum, error) {
+		called++
+		return types.NewStringDatum("default"), nil
+	}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+	fts := map[int64]*types.FieldType{1: types.NewFieldType(mysql.TypeVarchar)}
+
+	for _, c := range []struct {
+		supplied types.Datum
+		isNull   bool
+		expected types.Datum
+		called   int
+	}{
+		// the expression should not run if the value is supplied
+		{types.NewStringDatum("supplied"), false, types.NewStringDatum("supplied"), 0},
+		// the expression should run only once for the null case
+		{types.Datum{}, true, types.NewStringDatum("default"), 1},
+	} {
+		called = 0
+		buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(1)
+		buffer.AddColValWithDefaultExpr(1, c.supplied, c.isNull, defaultExpr)
+		require.Equal(t, 0, called)
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key"), kv.IntHandle(1),
+		))
+		_, err := buffer.EncodeBinlogRowData(time.UTC, errctx.StrictNoWarningContext)
+		require.NoError(t, err)
+		require.Equal(t, c.called, called)
+		row, err := tablecodec.DecodeRowToDatumMap(memBuffer.values["key"], fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{1: c.expected}, row)
+	}
+}
+
+func TestEncodeRowBufferAddHashColVal(t *testing.T) {
+	hashOf := func(source []types.Datum, buckets int) (int64, error) {
+		buffer := &EncodeRowBuffer{}
+		buffer.Reset(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddHashColVal(2, source, buckets)
+		if err := buffer.evalLazyColVals(); err != nil {
+			return 0, err
+		}
+		require.Equal(t, []int64{1, 2}, buffer.colIDs)
+		return buffer.row[1].GetInt64(), nil
+	}
+
+	sources := [][]types.Datum{
+		types.MakeDatums(1, "abc"),
+		types.MakeDatums(2, "abc"),
+		types.MakeDatums("abc", 1),
+		types.MakeDatums(nil),
+		types.MakeDatums(),
+	}
+	hashes := make(map[int64]struct{})
+	for _, source := range sources {
+		h1, err := hashOf(source, 1024)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, h1, int64(0))
+		require.Less(t, h1, int64(1024))
+		// equal source datums yield equal hash values
+		h2, err := hashOf(types.CloneRow(source), 1024)
+		require.NoError(t, err)
+		require.Equal(t, h1, h2)
+		hashes[h1] = struct{}{}
+
+		h, err := hashOf(source, 1)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), h)
+	}
+	// different source datums are distributed to different buckets in this case
+	require.Len(t, hashes, len(sources))
+
+	_, err := hashOf(sources[0], 0)
+	require.ErrorContains(t, err, "invalid buckets 0 of the hash column 2")
+}
+
+func TestEncodeRowBufferNaNAndInf(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	ignoreTruncateCtx := errctx.StrictNoWarningContext.WithErrGroupLevel(errctx.ErrGroupTruncate, errctx.LevelIgnore)
+	expectedVal, err := tablecodec.EncodeRow(
+		time.UTC, []types.Datum{types.NewIntDatum(1), types.NewFloat64Datum(0)}, []int64{1, 2},
+		nil, nil, nil, &rowcodec.Encoder{Enable: true},
+	)
+	require.NoError(t, err)
+	expectedOldVal, err := tablecodec.EncodeOldRow(
+		time.UTC, []types.Datum{types.NewIntDatum(1), types.NewFloat64Datum(0)}, []int64{1, 2}, nil, nil,
+	)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		val    float64
+		errMsg string
+	}{
+		{val: math.Inf(1), errMsg: "DOUBLE value is out of range in '+Inf'"},
+		{val: math.Inf(-1), errMsg: "DOUBLE value is out of range in '-Inf'"},
+		{val: math.NaN(), errMsg: "DOUBLE value is out of range in 'NaN'"},
+	} {
+		// report an error in strict mode
+		memBuffer := &mockMemBuffer{}
+		buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewFloat64Datum(c.val))
+		err := buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+		)
+		require.EqualError(t, err, "[types:1690]"+c.errMsg)
+		_, err = buffer.EncodeBinlogRowData(time.UTC, errctx.StrictNoWarningContext)
+		require.EqualError(t, err, "[types:1690]"+c.errMsg)
+		memBuffer.AssertExpectations(t)
+
+		// encode as 0 if the error is ignored
+		memBuffer.On("Set", kv.Key("key1"), expectedVal).Return(nil).Once()
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, ignoreTruncateCtx, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+		))
+		memBuffer.AssertExpectations(t)
+
+		buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewFloat64Datum(c.val))
+		encoded, err := buffer.EncodeBinlogRowData(time.UTC, ignoreTruncateCtx)
+		require.NoError(t, err)
+		require.Equal(t, expectedOldVal, encoded)
+	}
+}
+
+func TestEncodeRowBufferValidateUTF8(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	cfg := RowEncodingConfig{
+		RowEncoder:   &rowcodec.Encoder{Enable: true},
+		ValidateUTF8: true,
+		UTF8Columns:  map[int64]string{2: "c2", 3: "c3"},
+	}
+	invalid := []byte{'a', 0xff, 0xfe, 'b'}
+
+	// the invalid string in a utf8mb4 column should be rejected
+	memBuffer := &mockMemBuffer{}
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	buffer.AddColVal(1, types.NewStringDatum("abc"))
+	buffer.AddColVal(2, types.NewStringDatum("你好"))
+	buffer.AddColVal(3, types.NewStringDatum(string(invalid)))
+	err := buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	)
+	require.True(t, ErrTruncatedWrongValueForField.Equal(err))
+	require.EqualError(t, err, "[table:1366]Incorrect string value '\\xFF\\xFE\\x62' for column 'c3'")
+	memBuffer.AssertExpectations(t)
+
+	// the columns which are not listed and the binary values are not validated
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Twice()
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	buffer.AddColVal(1, types.NewStringDatum(string(invalid)))
+	buffer.AddColVal(2, types.NewBytesDatum(invalid))
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+
+	// no validation if ValidateUTF8 is false
+	cfg.ValidateUTF8 = false
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	buffer.AddColVal(3, types.NewStringDatum(string(invalid)))
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	memBuffer.AssertExpectations(t)
+}
+
+func TestEncodeRowBufferTransforms(t *testing.T) {
+	stmtBufs, ctx := newMockMutateCtx()
+	trim := func(d types.Datum) (types.Datum, error) {
+		if d.Kind() != types.KindString {
+			return d, nil
+		}
+		return types.NewStringDatum(strings.TrimSpace(d.GetString())), nil
+	}
+	cfg := RowEncodingConfig{
+		RowEncoder: &rowcodec.Encoder{Enable: true},
+		Transforms: map[int64]func(types.Datum) (types.Datum, error){2: trim, 3: trim},
+	}
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Once()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	buffer.AddColVal(1, types.NewStringDatum("  a  "))
+	buffer.AddColVal(2, types.NewStringDatum("  b  "))
+	buffer.AddColVal(3, types.Datum{})
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	memBuffer.AssertExpectations(t)
+
+	// only the columns in the transforms are transformed
+	row, err := tablecodec.DecodeRowToDatumMap(stmtBufs.RowValBuf, map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeVarchar),
+		2: types.NewFieldType(mysql.TypeVarchar),
+		3: types.NewFieldType(mysql.TypeVarchar),
+	}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, map[int64]types.Datum{
+		1: types.NewStringDatum("  a  "),
+		2: types.NewStringDatum("b"),
+		3: {},
+	}, row)
+
+	// the values are transformed once even if the row is encoded more than once
+	suffix := func(d types.Datum) (types.Datum, error) {
+		return types.NewStringDatum(d.GetString() + "-x"), nil
+	}
+	suffixCfg := RowEncodingConfig{
+		RowEncoder: &rowcodec.Encoder{Enable: true},
+		Transforms: map[int64]func(types.Datum) (types.Datum, error){1: suffix, 2: suffix},
+	}
+	fts := map[int64]*types.FieldType{1: types.NewFieldType(mysql.TypeVarchar), 2: types.NewFieldType(mysql.TypeVarchar)}
+	memBuffer = &mockMemBuffer{}
+	memBuffer.On("Set", mock.Anything, mock.Anything).Return(nil)
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewStringDatum("a"))
+	_, err = buffer.WouldBeNoOp(nil, suffixCfg, time.UTC, errctx.StrictNoWarningContext)
+	require.NoError(t, err)
+	for range 2 {
+		require.NoError(t, buffer.WriteMemBufferEncodedFiltered(func(int64) bool { return true },
+			suffixCfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+		))
+	}
+	// the column added after the encoding is transformed, but the encoded ones are not transformed again
+	buffer.AddColVal(2, types.NewStringDatum("b"))
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		suffixCfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	row, err = tablecodec.DecodeRowToDatumMap(stmtBufs.RowValBuf, fts, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, map[int64]types.Datum{1: types.NewStringDatum("a-x"), 2: types.NewStringDatum("b-x")}, row)
+	// reset clears the transformed columns
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(1)
+	buffer.AddColVal(1, types.NewStringDatum("c"))
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		suffixCfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	row, err = tablecodec.DecodeRowToDatumMap(stmtBufs.RowValBuf, fts, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, map[int64]types.Datum{1: types.NewStringDatum("c-x")}, row)
+
+	// the error should name the column
+	memBuffer = &mockMemBuffer{}
+	cfg.Transforms[1] = func(types.Datum) (types.Datum, error) {
+		return types.Datum{}, errors.New("mock transform error")
+	}
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(1)
+	buffer.AddColVal(1, types.NewStringDatum("a"))
+	err = buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	)
+	require.EqualError(t, err, "failed to transform the value of column 1: mock transform error")
+	_, _, err = buffer.EncodeBoth(cfg, time.UTC, errctx.StrictNoWarningContext)
+	require.EqualError(t, err, "failed to transform the value of column 1: mock transform error")
+	memBuffer.AssertExpectations(t)
+}
+
+func TestEncodeRowBufferCheckNotNull(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	notNullCols := map[int64]string{1: "c1"}
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+
+	// empty string is not NULL
+	buffer.AddColVal(1, types.NewStringDatum(""))
+	buffer.AddColVal(2, types.NewDatum(nil))
+	require.NoError(t, buffer.CheckNotNullCols(notNullCols))
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Twice()
+	for _, check := range []bool{true, false} {
+		require.NoError(t, buffer.WriteMemBufferEncoded(RowEncodingConfig{
+			RowEncoder:     &rowcodec.Encoder{Enable: true},
+			CheckNotNull:   check,
+			NotNullColumns: notNullCols,
+		}, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1)))
+	}
+	memBuffer.AssertExpectations(t)
+
+	// NULL for a NOT NULL column
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewDatum(nil))
+	buffer.AddColVal(2, types.NewStringDatum(""))
+	err := buffer.CheckNotNullCols(notNullCols)
+	require.True(t, ErrColumnCantNull.Equal(err))
+	require.EqualError(t, err, "[table:1048]Column 'c1' cannot be null")
+	require.NoError(t, buffer.CheckNotNullCols(nil))
+	cfg := RowEncodingConfig{
+		RowEncoder:     &rowcodec.Encoder{Enable: true},
+		CheckNotNull:   true,
+		NotNullColumns: notNullCols,
+	}
+	err = buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	)
+	require.True(t, ErrColumnCantNull.Equal(err))
+
+	// assert in test if the runtime check is disabled
+	if intest.EnableAssert {
+		cfg.CheckNotNull = false
+		require.Panics(t, func() {
+			_ = buffer.WriteMemBufferEncoded(
+				cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+			)
+		})
+	}
+}
+
+func TestEncodeRowBufferCheckFitTargetTypes(t *testing.T) {
+	intType := types.NewFieldType(mysql.TypeLong)
+	varcharType := types.NewFieldType(mysql.TypeVarchar)
+	varcharType.SetFlen(3)
+	targets := map[int64]*types.FieldType{1: intType, 2: intType, 3: varcharType}
+	tc := types.DefaultStmtNoWarningContext
+
+	buffer := &EncodeRowBuffer{}
+	buffer.Reset(4)
+	buffer.AddColVal(1, types.NewIntDatum(math.MaxInt32))
+	buffer.AddColVal(2, types.Datum{})
+	buffer.AddColVal(3, types.NewStringDatum("abc"))
+	// the columns not in targets are not checked
+	buffer.AddColVal(4, types.NewIntDatum(math.MaxInt64))
+	require.NoError(t, buffer.CheckFitTargetTypes(tc, targets))
+
+	// narrow BIGINT to INT with an overflowing value
 	buffer.Reset(2)
-	require.Equal(t, 0, len(buffer.rowToCheck))
-	require.Equal(t, 6, cap(buffer.rowToCheck))
+	buffer.AddColVal(1, types.NewIntDatum(math.MaxInt32))
+	buffer.AddColVal(2, types.NewIntDatum(math.MaxInt32+1))
+	err := buffer.CheckFitTargetTypes(tc, targets)
+	require.True(t, types.ErrWarnDataOutOfRange.Equal(err))
+	require.EqualError(t, err, "[types:1264]Out of range value 2147483648 for column 2 of type int(11)")
+
+	buffer.Reset(1)
+	buffer.AddColVal(1, types.NewIntDatum(math.MinInt32-1))
+	err = buffer.CheckFitTargetTypes(tc, targets)
+	require.True(t, types.ErrWarnDataOutOfRange.Equal(err))
+	require.EqualError(t, err, "[types:1264]Out of range value -2147483649 for column 1 of type int(11)")
+
+	// other errors
+	buffer.Reset(1)
+	buffer.AddColVal(3, types.NewStringDatum("abcd"))
+	err = buffer.CheckFitTargetTypes(tc, targets)
+	require.True(t, types.ErrDataTooLong.Equal(err))
+	require.ErrorContains(t, err, "the value of column 3 does not fit type varchar(3)")
+}
+
+func TestEncodeRowBufferZeroTime(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeDate),
+		2: types.NewFieldType(mysql.TypeDatetime),
+		3: types.NewFieldType(mysql.TypeTimestamp),
+	}
+	zeroDate := types.NewTime(types.ZeroCoreTime, mysql.TypeDate, 0)
+	zeroDatetime := types.NewTime(types.ZeroCoreTime, mysql.TypeDatetime, 0)
+	zeroTimestamp := types.NewTime(types.ZeroCoreTime, mysql.TypeTimestamp, 0)
+	for _, loc := range []*time.Location{time.UTC, time.FixedZone("fixed", 8*3600)} {
+		for _, newFormat := range []bool{true, false} {
+			buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+			buffer.AddColVal(1, types.NewTimeDatum(zeroDate))
+			buffer.AddColVal(2, types.NewTimeDatum(zeroDatetime))
+			buffer.AddColVal(3, types.NewTimeDatum(zeroTimestamp))
+
+			var encoded []byte
+			memBuffer := &mockMemBuffer{}
+			memBuffer.On("Set", kv.Key("key1"), mock.Anything).Run(func(args mock.Arguments) {
+				encoded = args.Get(1).([]byte)
+			}).Return(nil).Once()
+			require.NoError(t, buffer.WriteMemBufferEncoded(RowEncodingConfig{
+				RowEncoder: &rowcodec.Encoder{Enable: newFormat},
+			}, loc, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1)))
+			memBuffer.AssertExpectations(t)
+			require.Equal(t, newFormat, rowcodec.IsNewFormat(encoded))
+
+			binlogEncoded, err := buffer.EncodeBinlogRowData(loc, errctx.StrictNoWarningContext)
+			require.NoError(t, err)
+
+			for _, val := range [][]byte{encoded, binlogEncoded} {
+				decoded, err := tablecodec.DecodeRowToDatumMap(val, fts, loc)
+				require.NoError(t, err)
+				require.Len(t, decoded, 3)
+				for colID, expected := range map[int64]types.Time{1: zeroDate, 2: zeroDatetime, 3: zeroTimestamp} {
+					d := decoded[colID]
+					require.Equal(t, types.KindMysqlTime, d.Kind())
+					require.True(t, d.GetMysqlTime().IsZero())
+					require.Equal(t, expected, d.GetMysqlTime(), "column %d, loc %s", colID, loc)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeRowBufferCopyDatums(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	src := []byte("abc")
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVal(2, types.NewBytesDatum(src))
+	copied := buffer.CopyDatums()
+	require.Equal(t, []types.Datum{types.NewIntDatum(1), types.NewBytesDatum([]byte("abc"))}, copied)
+
+	// reuse the buffer and overwrite the original data
+	copy(src, "xyz")
+	buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(3, types.NewIntDatum(2))
+	buffer.AddColVal(4, types.NewBytesDatum(src))
+	require.Equal(t, []byte("xyz"), buffer.row[1].GetBytes())
+	require.Equal(t, []types.Datum{types.NewIntDatum(1), types.NewBytesDatum([]byte("abc"))}, copied)
+}
+
+func TestEncodeRowBufferConfiguredTableID(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(1)
+	_, ok := buffer.ConfiguredTableID()
+	require.False(t, ok)
+
+	buffer.ResetForTable(10, IntHandleEncoder, 1)
+	tableID, ok := buffer.ConfiguredTableID()
+	require.True(t, ok)
+	require.Equal(t, int64(10), tableID)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	memBuffer := &mockMemBuffer{}
+	key := tablecodec.EncodeRowKeyWithHandle(10, kv.IntHandle(1))
+	memBuffer.On("Set", key, mock.Anything).Return(nil).Once()
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+	))
+	memBuffer.AssertExpectations(t)
+
+	// mismatched table id should be detected in test
+	if intest.EnableAssert {
+		require.PanicsWithValue(t, "assert failed, the buffer is configured for table 10, but writes to the key of table 11",
+			func() {
+				_ = buffer.WriteMemBufferEncoded(
+					cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer,
+					tablecodec.EncodeRowKeyWithHandle(11, kv.IntHandle(1)), kv.IntHandle(1),
+				)
+			},
+		)
+	}
+
+	// the key of a partition is accepted for the handle of the partition
+	partitionHandle := kv.NewPartitionHandle(11, kv.IntHandle(1))
+	partitionKey, err := buffer.RecordKey(partitionHandle)
+	require.NoError(t, err)
+	require.Equal(t, tablecodec.EncodeRowKeyWithHandle(11, kv.IntHandle(1)), partitionKey)
+	memBuffer.On("Set", partitionKey, mock.Anything).Return(nil).Once()
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, partitionKey, partitionHandle,
+	))
+	memBuffer.AssertExpectations(t)
+	if intest.EnableAssert {
+		require.PanicsWithValue(t, "assert failed, the buffer is configured for table 10 and the handle is of "+
+			"partition 11, but writes to the key of table 12",
+			func() {
+				_ = buffer.WriteMemBufferEncoded(
+					cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer,
+					tablecodec.EncodeRowKeyWithHandle(12, kv.IntHandle(1)), partitionHandle,
+				)
+			},
+		)
+	}
+
+	// reset should clear the table id
+	buffer.Reset(1)
+	_, ok = buffer.ConfiguredTableID()
+	require.False(t, ok)
+}
+
+func TestEncodeRowBufferAssertCommonHandle(t *testing.T) {
+	newCol := func(id int64, name string, tp byte) *model.ColumnInfo {
+		return &model.ColumnInfo{ID: id, Name: ast.NewCIStr(name), Offset: int(id - 1), FieldType: *types.NewFieldType(tp)}
+	}
+	tblInfo := &model.TableInfo{
+		ID:             10,
+		IsCommonHandle: true,
+		Columns: []*model.ColumnInfo{
+			newCol(1, "a", mysql.TypeVarchar),
+			newCol(2, "b", mysql.TypeLonglong),
+			newCol(3, "c", mysql.TypeLonglong),
+		},
+	}
+	// PRIMARY KEY(a(2), b)
+	pk := IndexSpec{Table: tblInfo, Index: &model.IndexInfo{
+		ID: 1, Name: ast.NewCIStr("primary"), Unique: true, Primary: true,
+		Columns: []*model.IndexColumn{{Offset: 0, Length: 2}, {Offset: 1, Length: types.UnspecifiedLength}},
+	}}
+	newHandle := func(vals ...any) kv.Handle {
+		encoded, err := codec.EncodeKey(time.UTC, nil, types.MakeDatums(vals...)...)
+		require.NoError(t, err)
+		handle, err := kv.NewCommonHandle(encoded)
+		require.NoError(t, err)
+		return handle
+	}
+
+	_, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	buffer.ResetForTable(10, CommonHandleEncoder, 3)
+	buffer.SetCommonHandlePK(pk)
+	buffer.AddColVal(1, types.NewStringDatum("abc"))
+	buffer.AddColVal(2, types.NewIntDatum(1))
+	buffer.AddColVal(3, types.NewIntDatum(2))
+
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", mock.Anything, mock.Anything).Return(nil)
+	write := func(handle kv.Handle) error {
+		return buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, tablecodec.EncodeRowKeyWithHandle(10, handle), handle,
+		)
+	}
+	// the prefix column is truncated like `AddRecord`
+	handle := newHandle("ab", 1)
+	require.NoError(t, write(handle))
+	// the partition handle is unwrapped
+	require.NoError(t, write(kv.NewPartitionHandle(11, handle)))
+
+	if intest.EnableAssert {
+		for _, mismatched := range []kv.Handle{newHandle("abc", 1), newHandle("ab", 2), kv.IntHandle(1)} {
+			require.Panics(t, func() {
+				_ = write(mismatched)
+			})
+		}
+	}
+
+	// the check is skipped if a primary key column is not added
+	require.NoError(t, buffer.WriteMemBufferEncodedFiltered(
+		func(colID int64) bool { return colID != 1 }, cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer,
+		tablecodec.EncodeRowKeyWithHandle(10, handle), newHandle("xy", 1),
+	))
+
+	// the index which is not the clustered primary key is ignored, and reset clears the primary key
+	buffer.SetCommonHandlePK(IndexSpec{Table: tblInfo, Index: &model.IndexInfo{ID: 2, Name: ast.NewCIStr("idx_c")}})
+	require.Equal(t, pk, buffer.commonHandlePK)
+	buffer.Reset(3)
+	require.Nil(t, buffer.commonHandlePK.Index)
+}
+
+func TestEncodeRowBufferHandleEncoder(t *testing.T) {
+	encoded, err := codec.EncodeKey(time.UTC, nil, types.MakeDatums("abc", 1)...)
+	require.NoError(t, err)
+	commonHandle, err := kv.NewCommonHandle(encoded)
+	require.NoError(t, err)
+
+	require.Equal(t, IntHandleEncoder, HandleEncoderForTable(&model.TableInfo{PKIsHandle: true}))
+	require.Equal(t, CommonHandleEncoder, HandleEncoderForTable(&model.TableInfo{IsCommonHandle: true}))
+	require.Equal(t, ExtraHandleEncoder, HandleEncoderForTable(&model.TableInfo{}))
+
+	buffer := &EncodeRowBuffer{}
+	_, err = buffer.RecordKey(kv.IntHandle(1))
+	require.ErrorContains(t, err, "not configured with a handle encoder")
+
+	for _, c := range []struct {
+		encoder HandleEncoder
+		handle  kv.Handle
+		invalid kv.Handle
+	}{
+		{IntHandleEncoder, kv.IntHandle(1), commonHandle},
+		{ExtraHandleEncoder, kv.IntHandle(-1), commonHandle},
+		{CommonHandleEncoder, commonHandle, kv.IntHandle(1)},
+	} {
+		buffer.ResetForTable(10, c.encoder, 1)
+		key, err := buffer.RecordKey(c.handle)
+		require.NoError(t, err)
+		require.Equal(t, tablecodec.EncodeRowKeyWithHandle(10, c.handle), key)
+
+		// the partition id should be used for a partition handle
+		key, err = buffer.RecordKey(kv.NewPartitionHandle(100, c.handle))
+		require.NoError(t, err)
+		require.Equal(t, tablecodec.EncodeRowKeyWithHandle(100, c.handle), key)
+
+		_, err = buffer.RecordKey(c.invalid)
+		require.ErrorContains(t, err, "handle encoder expects")
+	}
+
+	// reset should clear the handle encoder
+	buffer.Reset(1)
+	_, err = buffer.RecordKey(kv.IntHandle(1))
+	require.ErrorContains(t, err, "not configured with a handle encoder")
+}
+
+func TestEncodeRowBufferIndexDeleteKeys(t *testing.T) {
+	newCol := func(id int64, name string, tp byte, flag uint) *model.ColumnInfo {
+		col := &model.ColumnInfo{ID: id, Name: ast.NewCIStr(name), Offset: int(id - 1), FieldType: *types.NewFieldType(tp)}
+		col.AddFlag(flag)
+		return col
+	}
+	tblInfo := &model.TableInfo{
+		ID:         10,
+		PKIsHandle: true,
+		Columns: []*model.ColumnInfo{
+			newCol(1, "a", mysql.TypeLonglong, mysql.PriKeyFlag|mysql.NotNullFlag),
+			newCol(2, "b", mysql.TypeVarchar, 0),
+			newCol(3, "c", mysql.TypeLonglong, 0),
+			newCol(4, "d", mysql.TypeLonglong, 0),
+		},
+	}
+	newIndex := func(id int64, name string, unique, primary bool, offsets ...int) IndexSpec {
+		idxInfo := &model.IndexInfo{ID: id, Name: ast.NewCIStr(name), Unique: unique, Primary: primary}
+		for _, offset := range offsets {
+			idxInfo.Columns = append(idxInfo.Columns, &model.IndexColumn{Offset: offset, Length: types.UnspecifiedLength})
+		}
+		return IndexSpec{Table: tblInfo, Index: idxInfo}
+	}
+	indexes := []IndexSpec{
+		newIndex(1, "idx_b", false, false, 1),
+		// the value of the handle column should be taken from the handle
+		newIndex(2, "uk_ac", true, false, 0, 2),
+		// the clustered primary key should be skipped
+		newIndex(3, "primary", true, true, 0),
+		// the unique index with NULL should contain the handle
+		newIndex(4, "uk_d", true, false, 3),
+	}
+
+	buffer := &EncodeRowBuffer{}
+	buffer.Reset(3)
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	buffer.AddColVal(3, types.NewIntDatum(7))
+	buffer.AddColVal(4, types.NewDatum(nil))
+	expected := func(physicalID, indexID int64, vals ...types.Datum) kv.Key {
+		encoded, err := codec.EncodeKey(time.UTC, nil, vals...)
+		require.NoError(t, err)
+		return tablecodec.EncodeIndexSeekKey(physicalID, indexID, encoded)
+	}
+	keys, err := buffer.IndexDeleteKeys(time.UTC, indexes, kv.IntHandle(5))
+	require.NoError(t, err)
+	require.Equal(t, []kv.Key{
+		expected(10, 1, types.NewStringDatum("abc"), types.NewIntDatum(5)),
+		expected(10, 2, types.NewIntDatum(5), types.NewIntDatum(7)),
+		expected(10, 4, types.NewDatum(nil), types.NewIntDatum(5)),
+	}, keys)
+
+	// the partition id should be used for a partition handle
+	keys, err = buffer.IndexDeleteKeys(time.UTC, indexes[:1], kv.NewPartitionHandle(100, kv.IntHandle(5)))
+	require.NoError(t, err)
+	require.Equal(t, []kv.Key{expected(100, 1, types.NewStringDatum("abc"), types.NewIntDatum(5))}, keys)
+
+	// the keys of a global index are encoded in the logical table, or in the new table of the reorganization
+	// if the index is not public yet
+	partitioned := *tblInfo
+	partitioned.Partition = &model.PartitionInfo{Enable: true}
+	global := IndexSpec{Table: &partitioned, Index: &model.IndexInfo{
+		ID: 5, Name: ast.NewCIStr("g_b"), Global: true, State: model.StatePublic,
+		Columns: []*model.IndexColumn{{Offset: 1, Length: types.UnspecifiedLength}},
+	}}
+	partitionHandle := kv.NewPartitionHandle(100, kv.IntHandle(5))
+	keys, err = buffer.IndexDeleteKeys(time.UTC, []IndexSpec{indexes[0], global}, partitionHandle)
+	require.NoError(t, err)
+	require.Equal(t, []kv.Key{
+		expected(100, 1, types.NewStringDatum("abc"), types.NewIntDatum(5)),
+		expected(10, 5, types.NewStringDatum("abc"), types.NewIntDatum(5)),
+	}, keys)
+	partitioned.Partition.NewTableID = 20
+	keys, err = buffer.IndexDeleteKeys(time.UTC, []IndexSpec{global}, partitionHandle)
+	require.NoError(t, err)
+	require.Equal(t, []kv.Key{expected(10, 5, types.NewStringDatum("abc"), types.NewIntDatum(5))}, keys)
+	global.Index.State = model.StateWriteReorganization
+	keys, err = buffer.IndexDeleteKeys(time.UTC, []IndexSpec{global}, partitionHandle)
+	require.NoError(t, err)
+	require.Equal(t, []kv.Key{expected(20, 5, types.NewStringDatum("abc"), types.NewIntDatum(5))}, keys)
+
+	// the indexed columns must be added
+	buffer.Reset(1)
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	_, err = buffer.IndexDeleteKeys(time.UTC, indexes, kv.IntHandle(5))
+	require.ErrorContains(t, err, "the column c of the index uk_ac is not added")
+}
+
+func TestEncodeRowBufferEstimateWriteAmplification(t *testing.T) {
+	tblInfo := &model.TableInfo{ID: 10, PKIsHandle: true}
+	for i, name := range []string{"a", "b", "c"} {
+		col := &model.ColumnInfo{ID: int64(i + 1), Name: ast.NewCIStr(name), Offset: i}
+		col.FieldType = *types.NewFieldType(mysql.TypeLonglong)
+		if name == "a" {
+			col.AddFlag(mysql.PriKeyFlag | mysql.NotNullFlag)
+		}
+		tblInfo.Columns = append(tblInfo.Columns, col)
+	}
+	newIndex := func(id int64, unique, primary bool, offset int) IndexSpec {
+		idxInfo := &model.IndexInfo{ID: id, Unique: unique, Primary: primary, Columns: []*model.IndexColumn{
+			{Offset: offset, Length: types.UnspecifiedLength},
+		}}
+		return IndexSpec{Table: tblInfo, Index: idxInfo}
+	}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	handle := kv.IntHandle(5)
+
+	_, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.ResetForTable(10, IntHandleEncoder, 2)
+	buffer.AddColVal(2, types.NewIntDatum(7))
+	buffer.AddColVal(3, types.NewIntDatum(8))
+
+	// the actual bytes of the record
+	memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+	recordKey := tablecodec.EncodeRowKeyWithHandle(10, handle)
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, recordKey, handle,
+	))
+	recordBytes := len(recordKey) + len(memBuffer.values[string(recordKey)])
+	estimate, err := buffer.EstimateWriteAmplification(cfg, time.UTC, errctx.StrictNoWarningContext, nil, handle)
+	require.NoError(t, err)
+	require.Equal(t, recordBytes, estimate)
+
+	// the index prefix "t[tableID]_i[indexID]" has 19 bytes, and an encoded int value or an int handle has 9 bytes
+	indexes := []IndexSpec{
+		// the key of a non-unique index contains the handle, and the value is "0"
+		newIndex(1, false, false, 1),
+		// the value of a unique index is the handle
+		newIndex(2, true, false, 2),
+		// the clustered primary key has no index entries
+		newIndex(3, true, true, 0),
+	}
+	estimate, err = buffer.EstimateWriteAmplification(cfg, time.UTC, errctx.StrictNoWarningContext, indexes, handle)
+	require.NoError(t, err)
+	require.Equal(t, recordBytes+(19+9+9+1)+(19+9+8), estimate)
+
+	// the value of a global index contains the partition id, and its key is in the logical table
+	partitioned := *tblInfo
+	partitioned.Partition = &model.PartitionInfo{Enable: true}
+	global := IndexSpec{Table: &partitioned, Index: &model.IndexInfo{
+		ID: 4, Unique: true, Global: true, State: model.StatePublic,
+		Columns: []*model.IndexColumn{{Offset: 2, Length: types.UnspecifiedLength}},
+	}}
+	partitionHandle := kv.NewPartitionHandle(100, handle)
+	globalKey, distinct, err := tablecodec.GenIndexKey(
+		time.UTC, &partitioned, global.Index, 10, []types.Datum{types.NewIntDatum(8)}, handle, nil,
+	)
+	require.NoError(t, err)
+	globalVal, err := tablecodec.GenIndexValuePortal(time.UTC, &partitioned, global.Index, false, distinct, false,
+		[]types.Datum{types.NewIntDatum(8)}, handle, 100, nil, nil)
+	require.NoError(t, err)
+	estimate, err = buffer.EstimateWriteAmplification(
+		cfg, time.UTC, errctx.StrictNoWarningContext, []IndexSpec{global}, partitionHandle,
+	)
+	require.NoError(t, err)
+	partitionRecordKey := tablecodec.EncodeRowKeyWithHandle(100, handle)
+	require.Equal(t, len(partitionRecordKey)+len(memBuffer.values[string(recordKey)])+len(globalKey)+len(globalVal),
+		estimate)
+
+	// nothing should be written, and the buffers of the session are untouched
+	require.Len(t, memBuffer.values, 1)
+	require.Equal(t, memBuffer.values[string(recordKey)], ctx.GetMutateBuffers().GetWriteStmtBufs().RowValBuf)
+
+	// the checksum is counted like the written record
+	checksumCfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}, IsRowLevelChecksumEnabled: true}
+	estimate, err = buffer.EstimateWriteAmplification(checksumCfg, time.UTC, errctx.StrictNoWarningContext, nil, handle)
+	require.NoError(t, err)
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		checksumCfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, recordKey, handle,
+	))
+	require.Equal(t, len(recordKey)+len(memBuffer.values[string(recordKey)]), estimate)
+
+	// the record key is encoded by the configured handle encoder
+	encoded, err := codec.EncodeKey(time.UTC, nil, types.NewStringDatum("abc"))
+	require.NoError(t, err)
+	commonHandle, err := kv.NewCommonHandle(encoded)
+	require.NoError(t, err)
+	_, err = buffer.EstimateWriteAmplification(cfg, time.UTC, errctx.StrictNoWarningContext, nil, commonHandle)
+	require.ErrorContains(t, err, "expects an int handle")
+	_, err = buffer.EstimateWriteAmplification(cfg, time.UTC, errctx.StrictNoWarningContext, nil, nil)
+	require.ErrorContains(t, err, "requires the handle")
+}
+
+func TestEncodeRowBufferPresenceSummary(t *testing.T) {
+	schema := make([]int64, 20)
+	for i := range schema {
+		schema[i] = int64(i + 1)
+	}
+	buffer := &EncodeRowBuffer{}
+	buffer.Reset(20)
+	present, absent := buffer.PresenceSummary()
+	require.Equal(t, 0, present)
+	require.Equal(t, 0, absent)
+
+	buffer.SetSchemaColIDs(schema)
+	// a sparse row with 3 non-NULL columns and 2 NULL columns
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVal(5, types.NewStringDatum(""))
+	buffer.AddColVal(8, types.NewDatum(nil))
+	buffer.AddColVal(13, types.NewFloat64Datum(1.5))
+	buffer.AddColVal(20, types.NewDatum(nil))
+	present, absent = buffer.PresenceSummary()
+	require.Equal(t, 3, present)
+	require.Equal(t, 17, absent)
+
+	// reset should clear the schema
+	buffer.Reset(20)
+	present, absent = buffer.PresenceSummary()
+	require.Equal(t, 0, present)
+	require.Equal(t, 0, absent)
+}
+
+func TestEncodeRowBufferDecodeCursor(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	loc := time.FixedZone("fixed", 3600)
+	tm := types.NewTime(types.FromDate(2021, 1, 1, 1, 2, 3, 0), mysql.TypeTimestamp, 0)
+	colIDs := []int64{3, 1, 2, 4}
+	datums := []types.Datum{
+		types.NewIntDatum(10), types.NewStringDatum("abc"), types.NewTimeDatum(tm), types.NewDatum(nil),
+	}
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeVarchar),
+		2: types.NewFieldType(mysql.TypeTimestamp),
+		3: types.NewFieldType(mysql.TypeLonglong),
+		4: types.NewFieldType(mysql.TypeLonglong),
+	}
+	for _, newFormat := range []bool{true, false} {
+		buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(len(colIDs))
+		for i, colID := range colIDs {
+			buffer.AddColVal(colID, datums[i])
+		}
+		memBuffer := &mockMemBuffer{}
+		memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Once()
+		require.NoError(t, buffer.WriteMemBufferEncoded(RowEncodingConfig{
+			RowEncoder: &rowcodec.Encoder{Enable: newFormat},
+		}, loc, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1)))
+
+		cursor := buffer.NewDecodeCursor(fts)
+		for i := range colIDs {
+			colID, val, ok := cursor.Next()
+			require.True(t, ok)
+			require.Equal(t, colIDs[i], colID)
+			if datums[i].IsNull() {
+				require.True(t, val.IsNull())
+				continue
+			}
+			cmp, err := val.Compare(types.DefaultStmtNoWarningContext, &datums[i], collate.GetBinaryCollator())
+			require.NoError(t, err)
+			require.Equal(t, 0, cmp, "column %d", colID)
+		}
+		_, _, ok := cursor.Next()
+		require.False(t, ok)
+		require.NoError(t, cursor.Err())
+
+		// the cursor is reused and only decodes the columns with field types
+		cursor2 := buffer.NewDecodeCursor(map[int64]*types.FieldType{1: fts[1]})
+		require.Same(t, cursor, cursor2)
+		colID, val, ok := cursor2.Next()
+		require.True(t, ok)
+		require.Equal(t, int64(1), colID)
+		require.Equal(t, "abc", val.GetString())
+		_, _, ok = cursor2.Next()
+		require.False(t, ok)
+	}
+}
+
+func TestEncodeRowBufferFillRandomRow(t *testing.T) {
+	newFieldType := func(tp byte, flag uint) *types.FieldType {
+		ft := types.NewFieldType(tp)
+		ft.AddFlag(flag)
+		return ft
+	}
+	fts := []*types.FieldType{
+		newFieldType(mysql.TypeTiny, mysql.NotNullFlag),
+		newFieldType(mysql.TypeLonglong, mysql.UnsignedFlag),
+		types.NewFieldType(mysql.TypeDouble),
+		types.NewFieldType(mysql.TypeNewDecimal),
+		types.NewFieldType(mysql.TypeVarchar),
+		types.NewFieldType(mysql.TypeBlob),
+		types.NewFieldType(mysql.TypeDate),
+		types.NewFieldType(mysql.TypeTimestamp),
+		types.NewFieldType(mysql.TypeDuration),
+		types.NewFieldType(mysql.TypeJSON),
+	}
+	_, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(20)
+	buffer.FillRandomRow(1, 20, fts)
+	row1 := buffer.CopyDatums()
+	require.Len(t, row1, 20)
+	for i, val := range row1 {
+		if i%len(fts) == 0 {
+			// the value of the NOT NULL column should fit the type
+			require.False(t, val.IsNull())
+			require.GreaterOrEqual(t, val.GetInt64(), int64(math.MinInt8))
+			require.LessOrEqual(t, val.GetInt64(), int64(math.MaxInt8))
+		}
+		if i%len(fts) == len(fts)-1 {
+			// the unsupported type should be NULL
+			require.True(t, val.IsNull())
+		}
+	}
+
+	// the same seed should yield the identical row
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	encoded1, _, err := buffer.EncodeBoth(cfg, time.UTC, errctx.StrictNoWarningContext)
+	require.NoError(t, err)
+	encoded1 = slices.Clone(encoded1)
+	buffer.FillRandomRow(1, 20, fts)
+	require.Equal(t, row1, buffer.CopyDatums())
+	encoded2, _, err := buffer.EncodeBoth(cfg, time.UTC, errctx.StrictNoWarningContext)
+	require.NoError(t, err)
+	require.Equal(t, encoded1, encoded2)
+
+	// another seed should yield another row
+	buffer.FillRandomRow(2, 20, fts)
+	require.NotEqual(t, row1, buffer.CopyDatums())
+}
+
+func TestEncodeRowBufferEstimateEncodedSize(t *testing.T) {
+	json, err := types.ParseBinaryJSONFromString(`{"a": [1, "abc", null], "b": {"c": 1.5}}`)
+	require.NoError(t, err)
+	rows := map[string][]types.Datum{
+		"int": {
+			types.NewIntDatum(1), types.NewIntDatum(math.MinInt64), types.NewUintDatum(math.MaxUint64),
+		},
+		"string": {
+			types.NewStringDatum(""), types.NewStringDatum("abc"), types.NewBytesDatum(make([]byte, 1000)),
+		},
+		"decimal": {
+			types.NewDecimalDatum(types.NewDecFromInt(1)),
+			types.NewDecimalDatum(types.NewDecFromStringForTest("-12345678901234567890.123456789")),
+		},
+		"json": {
+			types.NewJSONDatum(json), types.NewDatum(nil),
+		},
+	}
+	key := tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(1))
+	for name, row := range rows {
+		for _, colIDBase := range []int64{1, 1000} {
+			for _, cfg := range []RowEncodingConfig{
+				{RowEncoder: &rowcodec.Encoder{Enable: false}},
+				{RowEncoder: &rowcodec.Encoder{Enable: true}},
+				{RowEncoder: &rowcodec.Encoder{Enable: true}, IsRowLevelChecksumEnabled: true},
+			} {
+				_, mutateCtx := newMockMutateCtx()
+				buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(len(row))
+				for i, val := range row {
+					buffer.AddColVal(colIDBase+int64(i), val)
+				}
+				estimated := buffer.EstimateEncodedSize(cfg)
+				encoded, err := buffer.encodeForWrite(
+					cfg, time.UTC, errctx.StrictNoWarningContext, key, kv.IntHandle(1),
+				)
+				require.NoError(t, err)
+				require.GreaterOrEqual(t, estimated, len(encoded),
+					"%s, new format: %v, checksum: %v", name, cfg.RowEncoder.Enable, cfg.IsRowLevelChecksumEnabled)
+			}
+		}
+	}
+
+	// the checksum is counted
+	buffer := &EncodeRowBuffer{}
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	require.Greater(t,
+		buffer.EstimateEncodedSize(RowEncodingConfig{IsRowLevelChecksumEnabled: true}),
+		buffer.EstimateEncodedSize(RowEncodingConfig{}))
+}
+
+func TestEncodeRowBufferMinimalUpdate(t *testing.T) {
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+		3: types.NewFieldType(mysql.TypeLonglong),
+	}
+	key := tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(1))
+	for _, newFormat := range []bool{true, false} {
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: newFormat}}
+		_, mutateCtx := newMockMutateCtx()
+		buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		buffer.AddColVal(3, types.NewIntDatum(3))
+		before, err := buffer.encodeForWrite(cfg, time.UTC, errctx.StrictNoWarningContext, key, kv.IntHandle(1))
+		require.NoError(t, err)
+		before = slices.Clone(before)
+
+		// only the column 2 is changed
+		buffer = mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abd"))
+		buffer.AddColVal(3, types.NewIntDatum(3))
+		changed, newValue, err := buffer.MinimalUpdate(
+			before, fts, cfg, time.UTC, errctx.StrictNoWarningContext, key, kv.IntHandle(1),
+		)
+		require.NoError(t, err)
+		require.Equal(t, []int64{2}, changed)
+		row, err := tablecodec.DecodeRowToDatumMap(newValue, fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, types.NewStringDatum("abd"), row[2])
+
+		// nothing is changed
+		changed, _, err = buffer.MinimalUpdate(
+			slices.Clone(newValue), fts, cfg, time.UTC, errctx.StrictNoWarningContext, key, kv.IntHandle(1),
+		)
+		require.NoError(t, err)
+		require.Empty(t, changed)
+	}
+}
+
+func TestEncodeRowBufferEncodeBoth(t *testing.T) {
+	stmtBufs, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	buffer.AddColVal(3, types.NewDatum(nil))
+
+	_, _, err := buffer.EncodeBoth(RowEncodingConfig{RowEncoder: &rowcodec.Encoder{}}, time.UTC, errctx.StrictNoWarningContext)
+	require.ErrorContains(t, err, "requires an enabled row encoder")
+
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	newFormat, oldFormat, err := buffer.EncodeBoth(cfg, time.UTC, errctx.StrictNoWarningContext)
+	require.NoError(t, err)
+	require.True(t, rowcodec.IsNewFormat(newFormat))
+	require.False(t, rowcodec.IsNewFormat(oldFormat))
+	// the new format should be encoded in the statement buffer
+	require.Equal(t, unsafe.SliceData(stmtBufs.RowValBuf), unsafe.SliceData(newFormat))
+
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+		3: types.NewFieldType(mysql.TypeLonglong),
+	}
+	for _, encoded := range [][]byte{newFormat, oldFormat} {
+		row, err := tablecodec.DecodeRowToDatumMap(encoded, fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{
+			1: types.NewIntDatum(1),
+			2: types.NewStringDatum("abc"),
+			3: {},
+		}, row)
+	}
+
+	// the buffers should be reused
+	buffer.Reset(1)
+	buffer.AddColVal(1, types.NewIntDatum(2))
+	newFormat2, oldFormat2, err := buffer.EncodeBoth(cfg, time.UTC, errctx.StrictNoWarningContext)
+	require.NoError(t, err)
+	require.Equal(t, unsafe.SliceData(newFormat), unsafe.SliceData(newFormat2))
+	require.Equal(t, unsafe.SliceData(oldFormat), unsafe.SliceData(oldFormat2))
+
+	// the row is validated like the write
+	buffer.Reset(1)
+	buffer.AddColVal(1, types.NewDatum(nil))
+	notNullCfg := RowEncodingConfig{
+		RowEncoder: &rowcodec.Encoder{Enable: true}, CheckNotNull: true, NotNullColumns: map[int64]string{1: "a"},
+	}
+	_, _, err = buffer.EncodeBoth(notNullCfg, time.UTC, errctx.StrictNoWarningContext)
+	require.ErrorContains(t, err, "Column 'a' cannot be null")
+}
+
+func TestEncodeRowBufferAssertDeterministic(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(5)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	buffer.AddColVal(3, types.NewDatum(nil))
+	buffer.AddColVal(4, types.NewFloat64Datum(1.5))
+	buffer.AddColVal(5, types.NewTimeDatum(types.NewTime(
+		types.FromDate(2024, 1, 2, 3, 4, 5, 0), mysql.TypeTimestamp, 0)))
+
+	loc := time.FixedZone("UTC+8", 8*3600)
+	for _, cfg := range []RowEncodingConfig{
+		{RowEncoder: &rowcodec.Encoder{Enable: true}},
+		{RowEncoder: &rowcodec.Encoder{}},
+	} {
+		require.NoError(t, buffer.AssertDeterministic(cfg, loc, errctx.StrictNoWarningContext, 5))
+	}
+
+	err := buffer.AssertDeterministic(
+		RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}, loc, errctx.StrictNoWarningContext, 1)
+	require.ErrorContains(t, err, "at least 2 runs")
+
+	// the row is validated like the write
+	buffer.Reset(1)
+	buffer.AddColVal(1, types.NewStringDatum("\xff"))
+	utf8Cfg := RowEncodingConfig{
+		RowEncoder: &rowcodec.Encoder{Enable: true}, ValidateUTF8: true, UTF8Columns: map[int64]string{1: "a"},
+	}
+	err = buffer.AssertDeterministic(utf8Cfg, loc, errctx.StrictNoWarningContext, 2)
+	require.ErrorContains(t, err, "Incorrect string value '\\xFF' for column 'a'")
+}
+
+func TestEncodeRowBufferColumnOffsetIndex(t *testing.T) {
+	stmtBufs, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	_, err := buffer.ColumnOffsetIndex()
+	require.ErrorContains(t, err, "no row is encoded")
+
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil)
+	for _, c := range []struct {
+		newFormat bool
+		checksum  bool
+		colIDs    []int64
+	}{
+		{newFormat: true, colIDs: []int64{3, 1, 2}},
+		{newFormat: true, checksum: true, colIDs: []int64{3, 1, 2}},
+		// large row
+		{newFormat: true, colIDs: []int64{300, 1, 2}},
+		{newFormat: false, colIDs: []int64{3, 1, 2}},
+	} {
+		buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+		buffer.AddColVal(c.colIDs[0], types.NewIntDatum(300))
+		buffer.AddColVal(c.colIDs[1], types.NewStringDatum("abc"))
+		buffer.AddColVal(c.colIDs[2], types.Datum{})
+		require.NoError(t, buffer.WriteMemBufferEncoded(RowEncodingConfig{
+			RowEncoder:                &rowcodec.Encoder{Enable: c.newFormat},
+			IsRowLevelChecksumEnabled: c.checksum,
+		}, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1)))
+		index, err := buffer.ColumnOffsetIndex()
+		require.NoError(t, err)
+		require.Len(t, index, 2)
+		require.NotContains(t, index, c.colIDs[2])
+		valueOf := func(colID int64) []byte {
+			offset := index[colID]
+			return stmtBufs.RowValBuf[offset[0] : offset[0]+offset[1]]
+		}
+		if c.newFormat {
+			// the values are in the compact form of the new row format
+			require.Equal(t, []byte{0x2c, 0x01}, valueOf(c.colIDs[0]))
+			require.Equal(t, []byte("abc"), valueOf(c.colIDs[1]))
+			continue
+		}
+		for i, expected := range []types.Datum{types.NewIntDatum(300), types.NewBytesDatum([]byte("abc"))} {
+			remain, d, err := codec.DecodeOne(valueOf(c.colIDs[i]))
+			require.NoError(t, err)
+			require.Empty(t, remain)
+			require.Equal(t, expected, d)
+		}
+	}
+}
+
+func TestEncodeRowBufferWriteFiltered(t *testing.T) {
+	memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+		3: types.NewFieldType(mysql.TypeLonglong),
+	}
+	for _, newFormat := range []bool{true, false} {
+		_, mutateCtx := newMockMutateCtx()
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: newFormat}}
+		buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		buffer.AddLazyColVal(3, func() (types.Datum, error) { return types.NewIntDatum(3), nil })
+
+		// only the included columns should be encoded
+		key := kv.Key("partial")
+		require.NoError(t, buffer.WriteMemBufferEncodedFiltered(
+			func(colID int64) bool { return colID != 2 },
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+		))
+		row, err := tablecodec.DecodeRowToDatumMap(memBuffer.values[string(key)], fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{1: types.NewIntDatum(1), 3: types.NewIntDatum(3)}, row)
+
+		// the added columns should be kept in the buffer
+		require.Equal(t, []types.Datum{
+			types.NewIntDatum(1), types.NewStringDatum("abc"), types.NewIntDatum(3),
+		}, buffer.CopyDatums())
+		key = kv.Key("full")
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+		))
+		row, err = tablecodec.DecodeRowToDatumMap(memBuffer.values[string(key)], fts, time.UTC)
+		require.NoError(t, err)
+		require.Len(t, row, 3)
+	}
+}
+
+func TestEncodeRowBufferWriteTxn(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	expectedVal, err := tablecodec.EncodeRow(
+		time.UTC, []types.Datum{types.NewIntDatum(1), types.NewStringDatum("abc")}, []int64{1, 2},
+		nil, nil, nil, &rowcodec.Encoder{Enable: true},
+	)
+	require.NoError(t, err)
+
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), expectedVal).Return(nil).Once()
+	memBuffer.On("SetWithFlags", kv.Key("key2"), expectedVal, []kv.FlagsOp{kv.SetPresumeKeyNotExists}).
+		Return(nil).Once()
+	txn := &mockTxn{memBuffer: memBuffer}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	require.NoError(t, buffer.WriteTxnEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, txn, kv.Key("key1"), kv.IntHandle(1),
+	))
+	require.NoError(t, buffer.WriteTxnEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, txn, kv.Key("key2"), kv.IntHandle(1), kv.SetPresumeKeyNotExists,
+	))
+	memBuffer.AssertExpectations(t)
+}
+
+func TestEncodeRowBufferSpanAttributes(t *testing.T) {
+	stmtBufs, ctx := newMockMutateCtx()
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Twice()
+	for _, checksum := range []bool{false, true} {
+		buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		require.NoError(t, buffer.WriteMemBufferEncoded(RowEncodingConfig{
+			RowEncoder:                &rowcodec.Encoder{Enable: true},
+			IsRowLevelChecksumEnabled: checksum,
+		}, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1)))
+		attrs := make(map[string]any)
+		buffer.FillSpanAttributes(attrs)
+		require.Equal(t, map[string]any{
+			SpanAttrEncodedBytes:    len(stmtBufs.RowValBuf),
+			SpanAttrColumnCount:     2,
+			SpanAttrChecksumEnabled: checksum,
+		}, attrs)
+		require.Greater(t, attrs[SpanAttrEncodedBytes], 0)
+	}
+	memBuffer.AssertExpectations(t)
+}
+
+func TestEncodeRowBufferGoldenEncoding(t *testing.T) {
+	golden, err := os.ReadFile(filepath.Join("testdata", "golden_row_v1.txt"))
+	require.NoError(t, err)
+
+	tm, err := types.ParseTime(types.DefaultStmtNoWarningContext, "2024-01-02 03:04:05.678", mysql.TypeDatetime, 3)
+	require.NoError(t, err)
+	dur, _, err := types.ParseDuration(types.DefaultStmtNoWarningContext, "12:34:56", 0)
+	require.NoError(t, err)
+	dec := types.NewDecFromStringForTest("-123.456")
+	j, err := types.ParseBinaryJSONFromString(`{"a": [1, "b"]}`)
+	require.NoError(t, err)
+	cols := []struct {
+		id  int64
+		val types.Datum
+	}{
+		{1, types.NewIntDatum(-1)},
+		{2, types.NewUintDatum(math.MaxUint64)},
+		{3, types.NewFloat64Datum(1.5)},
+		{4, types.NewStringDatum("golden")},
+		{5, types.NewDecimalDatum(dec)},
+		{6, types.NewTimeDatum(tm)},
+		{7, types.NewDurationDatum(dur)},
+		{8, types.NewJSONDatum(j)},
+	}
+
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+	// the encoding should be stable no matter in which order the columns are added
+	for _, order := range [][]int{{0, 1, 2, 3, 4, 5, 6, 7}, {7, 6, 5, 4, 3, 2, 1, 0}, {3, 0, 7, 5, 1, 6, 2, 4}} {
+		buffer := buffers.GetEncodeRowBufferWithCap(len(cols))
+		for _, i := range order {
+			buffer.AddColVal(cols[i].id, cols[i].val)
+		}
+		encoded, err := buffer.GoldenEncoding()
+		require.NoError(t, err)
+		require.Equal(t, GoldenEncodingVersion, encoded[0])
+		require.NoError(t, CompareGoldenEncoding(string(golden), encoded), FormatGoldenEncoding(encoded))
+		require.Equal(t, string(golden), FormatGoldenEncoding(encoded))
+	}
+
+	// a different value should not match the golden
+	buffer := buffers.GetEncodeRowBufferWithCap(len(cols))
+	for _, col := range cols {
+		buffer.AddColVal(col.id, col.val)
+	}
+	buffer.AddColVal(9, types.NewIntDatum(9))
+	encoded, err := buffer.GoldenEncoding()
+	require.NoError(t, err)
+	require.ErrorContains(t, CompareGoldenEncoding(string(golden), encoded), "golden encoding mismatch")
+
+	// a different version should not match the golden
+	encoded[0] = GoldenEncodingVersion + 1
+	require.ErrorContains(t, CompareGoldenEncoding(string(golden), encoded), "golden encoding version mismatch")
+	require.ErrorContains(t, CompareGoldenEncoding("abc", encoded), "invalid golden encoding")
 }
 
 func TestMutateBuffersGetter(t *testing.T) {
@@ -215,6 +1766,383 @@ func TestMutateBuffersGetter(t *testing.T) {
 	require.Same(t, stmtBufs, buffers.GetWriteStmtBufs())
 }
 
+func TestMutateBuffersGetEncodeRowBufferPair(t *testing.T) {
+	stmtBufs := &variable.WriteStmtBufs{}
+	buffers := NewMutateBuffers(stmtBufs)
+	first, second := buffers.GetEncodeRowBufferPair()
+	require.NotSame(t, first, second)
+	require.NotSame(t, buffers.encodeRow, first)
+	require.NotSame(t, buffers.encodeRow, second)
+	require.NotSame(t, first.writeStmtBufs, second.writeStmtBufs)
+	require.NotSame(t, stmtBufs, first.writeStmtBufs)
+	require.NotSame(t, stmtBufs, second.writeStmtBufs)
+
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+	}
+	encode := func(buffer *EncodeRowBuffer, i int) ([]byte, error) {
+		// the row encoder is stateful, so it is not shared by the goroutines
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+		for j := 0; j < 100; j++ {
+			buffer.Reset(2)
+			buffer.AddColVal(1, types.NewIntDatum(int64(i)))
+			buffer.AddColVal(2, types.NewStringDatum(strconv.Itoa(i)))
+			if _, err := buffer.encodeForWrite(
+				cfg, time.UTC, errctx.StrictNoWarningContext, kv.Key("key"), kv.IntHandle(i),
+			); err != nil {
+				return nil, err
+			}
+		}
+		return slices.Clone(buffer.writeStmtBufs.RowValBuf), nil
+	}
+	var wg sync.WaitGroup
+	results := make([][]byte, 2)
+	errs := make([]error, 2)
+	for i, buffer := range []*EncodeRowBuffer{first, second} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = encode(buffer, i)
+		}()
+	}
+	wg.Wait()
+	for i := range results {
+		require.NoError(t, errs[i])
+		row, err := tablecodec.DecodeRowToDatumMap(results[i], fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{
+			1: types.NewIntDatum(int64(i)), 2: types.NewStringDatum(strconv.Itoa(i)),
+		}, row)
+	}
+	// the session buffers are not touched
+	require.Empty(t, stmtBufs.RowValBuf)
+
+	// the pair is reused by the next call
+	first.AddColVal(3, types.NewIntDatum(3))
+	reusedFirst, reusedSecond := buffers.GetEncodeRowBufferPair()
+	require.Same(t, first, reusedFirst)
+	require.Same(t, second, reusedSecond)
+	require.Empty(t, reusedFirst.colIDs)
+}
+
+func TestNewMutateBuffersWithProfile(t *testing.T) {
+	stmtBufs := &variable.WriteStmtBufs{}
+	buffers := NewMutateBuffersWithProfile(stmtBufs, CapacityProfile{Columns: 8, RowBytes: 256})
+	require.Same(t, stmtBufs, buffers.GetWriteStmtBufs())
+	require.Equal(t, 8, cap(buffers.encodeRow.colIDs))
+	require.Equal(t, 8, cap(buffers.encodeRow.row))
+	require.Equal(t, 8, cap(buffers.checkRow.rowToCheck))
+	require.Equal(t, 16, cap(stmtBufs.AddRowValues))
+	require.Equal(t, 256, cap(stmtBufs.RowValBuf))
+
+	// the presized buffers should be reused when the row fits the profile
+	encodeBuf := buffers.GetEncodeRowBufferWithCap(8)
+	require.Equal(t, unsafe.SliceData(buffers.encodeRow.colIDs), unsafe.SliceData(encodeBuf.colIDs))
+	rowValBuf := unsafe.SliceData(stmtBufs.RowValBuf)
+	for i := int64(1); i <= 8; i++ {
+		encodeBuf.AddColVal(i, types.NewIntDatum(i))
+	}
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Once()
+	require.NoError(t, encodeBuf.WriteMemBufferEncoded(
+		RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}, time.UTC, errctx.StrictNoWarningContext,
+		memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	memBuffer.AssertExpectations(t)
+	require.Equal(t, rowValBuf, unsafe.SliceData(stmtBufs.RowValBuf))
+}
+
+func TestMutateBuffersFaultInjector(t *testing.T) {
+	if !intest.InTest {
+		t.Skip("fault injection only works in test")
+	}
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+	stages := make([]string, 0, 2)
+	buffers.SetFaultInjector(func(stage string) error {
+		stages = append(stages, stage)
+		if stage == FaultStageSet {
+			return errors.New("mock set error")
+		}
+		return nil
+	})
+
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	memBuffer := &mockMemBuffer{}
+	buffer := buffers.GetEncodeRowBufferWithCap(1)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	err := buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	)
+	require.EqualError(t, err, "mock set error")
+	require.Equal(t, []string{FaultStageEncode, FaultStageSet}, stages)
+	// the memBuffer should not be written
+	memBuffer.AssertExpectations(t)
+
+	// remove the injector
+	buffers.SetFaultInjector(nil)
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Once()
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	memBuffer.AssertExpectations(t)
+	require.Len(t, stages, 2)
+}
+
+func TestMutateBuffersCopyOnAdd(t *testing.T) {
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeVarchar),
+		2: types.NewFieldType(mysql.TypeBlob),
+		3: types.NewFieldType(mysql.TypeVarchar),
+		4: types.NewFieldType(mysql.TypeLonglong),
+		5: types.NewFieldType(mysql.TypeBit),
+	}
+	fts[5].SetFlen(24)
+	chk := chunk.NewChunkWithCapacity([]*types.FieldType{fts[3], fts[5]}, 1)
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+	// encode adds the values sourced from the caller's buffers, then mutates the sources before the row is encoded
+	encode := func(buffer *EncodeRowBuffer) []string {
+		strSource, blobSource := []byte("abc"), []byte("blob")
+		chk.Reset()
+		chk.AppendString(0, "chunk")
+		chk.AppendBytes(1, []byte("bit"))
+		buffer.AddColVal(1, types.NewStringDatum(string(hack.String(strSource))))
+		buffer.AddColVals([]int64{2, 4}, []types.Datum{types.NewBytesDatum(blobSource), types.NewIntDatum(1)})
+		require.NoError(t, buffer.AddColValFromChunk(3, chk.Column(0), 0, fts[3]))
+		require.NoError(t, buffer.AddColValFromChunk(5, chk.Column(1), 0, fts[5]))
+		strSource[0], blobSource[0], chk.Column(0).GetBytes(0)[0] = 'x', 'x', 'x'
+		chk.Column(1).GetBytes(0)[0] = 'x'
+
+		memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+		))
+		row, err := tablecodec.DecodeRowToDatumMap(memBuffer.values["key1"], fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, types.NewIntDatum(1), row[4])
+		strs := make([]string, 0, 4)
+		for _, colID := range []int64{1, 2, 3, 5} {
+			d := row[colID]
+			strs = append(strs, d.GetString())
+		}
+		return strs
+	}
+
+	// by default, the values share the memory with the caller
+	require.Equal(t, []string{"xbc", "xlob", "xhunk", "xit"}, encode(buffers.GetEncodeRowBufferWithCap(5)))
+
+	// the copied values are not affected by the mutations of the sources, and the mode is kept across the resets
+	buffers.SetCopyOnAdd(true)
+	for range 2 {
+		require.Equal(t, []string{"abc", "blob", "chunk", "bit"}, encode(buffers.GetEncodeRowBufferWithCap(5)))
+	}
+	first, second := buffers.GetEncodeRowBufferPair()
+	require.True(t, first.copyOnAdd)
+	require.True(t, second.copyOnAdd)
+	require.Equal(t, []string{"abc", "blob", "chunk", "bit"}, encode(first))
+
+	buffers.SetCopyOnAdd(false)
+	require.Equal(t, []string{"xbc", "xlob", "xhunk", "xit"}, encode(buffers.GetEncodeRowBufferWithCap(5)))
+
+	// the mode is not kept in the pool
+	buffers = AcquireMutateBuffers(&variable.WriteStmtBufs{})
+	buffers.SetCopyOnAdd(true)
+	buffers.GetEncodeRowBufferPair()
+	ReleaseMutateBuffers(buffers)
+	require.False(t, buffers.encodeRow.copyOnAdd)
+	require.False(t, buffers.encodeRowPair[0].copyOnAdd)
+}
+
+func TestMutateBuffersInternStrings(t *testing.T) {
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeVarchar),
+		2: types.NewFieldType(mysql.TypeVarchar),
+		3: types.NewFieldType(mysql.TypeBlob),
+	}
+	chk := chunk.NewChunkWithCapacity([]*types.FieldType{fts[2]}, 1)
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+	buffers.SetInternStrings(true)
+	// add adds the values sourced from the caller's buffers, then mutates the sources
+	add := func(buffer *EncodeRowBuffer, str, fromChunk string) {
+		strSource := []byte(str)
+		chk.Reset()
+		chk.AppendString(0, fromChunk)
+		buffer.AddColVal(1, types.NewCollationStringDatum(string(hack.String(strSource)), "utf8mb4_bin"))
+		require.NoError(t, buffer.AddColValFromChunk(2, chk.Column(0), 0, fts[2]))
+		buffer.AddColVals([]int64{3}, []types.Datum{types.NewBytesDatum([]byte("blob"))})
+		strSource[0], chk.Column(0).GetBytes(0)[0] = 'x', 'x'
+	}
+
+	buffer := buffers.GetEncodeRowBufferWithCap(3)
+	add(buffer, "abc", "abc")
+	require.Equal(t, "abc", buffer.row[0].GetString())
+	require.Equal(t, "utf8mb4_bin", buffer.row[0].Collation())
+	require.Equal(t, "abc", buffer.row[1].GetString())
+	// the equal values share the interned string
+	require.Same(t, unsafe.StringData(buffer.row[0].GetString()), unsafe.StringData(buffer.row[1].GetString()))
+	interned := unsafe.StringData(buffer.row[0].GetString())
+	// the bytes values are not interned
+	require.Equal(t, types.KindBytes, buffer.row[2].Kind())
+
+	// the interned strings are kept across the resets
+	buffer = buffers.GetEncodeRowBufferWithCap(3)
+	add(buffer, "abc", "def")
+	require.Same(t, interned, unsafe.StringData(buffer.row[0].GetString()))
+	require.Equal(t, "def", buffer.row[1].GetString())
+	require.Len(t, buffer.interned, 2)
+	first, _ := buffers.GetEncodeRowBufferPair()
+	require.True(t, first.internStrings)
+
+	// the long strings are not interned, and they are shared unless copy on add is enabled
+	long := strings.Repeat("a", maxInternedStringLen+1)
+	buffer = buffers.GetEncodeRowBufferWithCap(3)
+	add(buffer, long, long)
+	require.Equal(t, "x"+long[1:], buffer.row[0].GetString())
+	buffers.SetCopyOnAdd(true)
+	buffer = buffers.GetEncodeRowBufferWithCap(3)
+	add(buffer, long, long)
+	require.Equal(t, long, buffer.row[0].GetString())
+	require.Len(t, buffer.interned, 2)
+
+	// the interned strings are dropped when the count reaches the limit
+	for i := range maxInternedStrings - 2 {
+		buffer.Reset(1)
+		buffer.AddColVal(1, types.NewStringDatum(strconv.Itoa(i)))
+	}
+	require.Len(t, buffer.interned, maxInternedStrings)
+	require.Contains(t, buffer.interned, "abc")
+	buffer.AddColVal(1, types.NewStringDatum("new"))
+	require.Equal(t, map[string]string{"new": "new"}, buffer.interned)
+
+	// the interned strings are dropped when disabled or released
+	buffers.SetInternStrings(false)
+	require.Nil(t, buffer.interned)
+	buffer = buffers.GetEncodeRowBufferWithCap(1)
+	buffer.AddColVal(1, types.NewStringDatum("abc"))
+	require.Nil(t, buffer.interned)
+	buffers = AcquireMutateBuffers(&variable.WriteStmtBufs{})
+	buffers.SetInternStrings(true)
+	first, _ = buffers.GetEncodeRowBufferPair()
+	first.AddColVal(1, types.NewStringDatum("abc"))
+	ReleaseMutateBuffers(buffers)
+	require.False(t, buffers.encodeRow.internStrings)
+	require.False(t, first.internStrings)
+	require.Nil(t, first.interned)
+}
+
+func TestMutateBuffersDebugSnapshot(t *testing.T) {
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+	encodeBuffer := buffers.GetEncodeRowBufferWithCap(3)
+	encodeBuffer.AddColVal(1, types.NewIntDatum(1))
+	encodeBuffer.AddColVal(2, types.NewStringDatum("abc"))
+	encodeBuffer.AddColVal(3, types.NewDatum(nil))
+	checkBuffer := buffers.GetCheckRowBufferWithCap(3)
+	checkBuffer.AddColVal(types.NewIntDatum(1))
+	checkBuffer.AddColVal(types.NewIntDatum(2))
+
+	snapshot := buffers.DebugSnapshot()
+	expected := MutateBuffersSnapshot{
+		EncodeColIDs:     []int64{1, 2, 3},
+		EncodeDatumKinds: []byte{types.KindInt64, types.KindString, types.KindNull},
+		CheckRowWidth:    2,
+	}
+	require.Equal(t, expected, snapshot)
+	require.Equal(t, "{encodeColIDs: [1 2 3], encodeDatumKinds: [1 5 0], checkRowWidth: 2}", snapshot.String())
+
+	// the snapshot should be stable after the buffers are reset and reused
+	encodeBuffer = buffers.GetEncodeRowBufferWithCap(3)
+	encodeBuffer.AddColVal(4, types.NewFloat64Datum(1))
+	buffers.GetCheckRowBufferWithCap(3)
+	require.Equal(t, expected, snapshot)
+}
+
+func TestMutateBuffersShrinkIfIdle(t *testing.T) {
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+	// a wide batch load inflates the buffer
+	buffers.GetEncodeRowBufferWithCap(500)
+	require.False(t, buffers.ShrinkIfIdle(1))
+
+	// not shrunk before enough resets
+	for range 3 {
+		buffer := buffers.GetEncodeRowBufferWithCap(10)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+	}
+	require.False(t, buffers.ShrinkIfIdle(5))
+	require.Equal(t, 500, cap(buffers.encodeRow.colIDs))
+
+	// shrunk after the narrow inserts, and the columns in the buffer are kept
+	for range 2 {
+		buffer := buffers.GetEncodeRowBufferWithCap(10)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+	}
+	require.True(t, buffers.ShrinkIfIdle(5))
+	require.Equal(t, 10, cap(buffers.encodeRow.colIDs))
+	require.Equal(t, 10, cap(buffers.encodeRow.row))
+	require.Equal(t, []int64{1}, buffers.encodeRow.colIDs)
+	require.Equal(t, []types.Datum{types.NewIntDatum(1)}, buffers.encodeRow.row)
+
+	// the columns appended beyond the requested capacity are counted in the peak
+	buffer := buffers.GetEncodeRowBufferWithCap(0)
+	for colID := int64(1); colID <= 10; colID++ {
+		buffer.AddColVal(colID, types.NewIntDatum(colID))
+	}
+	require.False(t, buffers.ShrinkIfIdle(1))
+	require.Len(t, buffers.encodeRow.colIDs, 10)
+}
+
+func TestReuseStats(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	buffers := ctx.GetMutateBuffers()
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	key := tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(1))
+	writeRow := func(i int) {
+		encodeBuffer := buffers.GetEncodeRowBufferWithCap(3)
+		checkBuffer := buffers.GetCheckRowBufferWithCap(3)
+		for colID := int64(1); colID <= 3; colID++ {
+			val := types.NewIntDatum(int64(i) + colID)
+			encodeBuffer.AddColVal(colID, val)
+			checkBuffer.AddColVal(val)
+		}
+		require.NoError(t, encodeBuffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, discardMemBuffer{}, key, kv.IntHandle(1),
+		))
+	}
+
+	// the buffers are allocated in the first row
+	hits, reallocations := buffers.ReuseStats()
+	writeRow(0)
+	warmupHits, warmupReallocations := buffers.ReuseStats()
+	require.Greater(t, warmupReallocations, reallocations)
+
+	// the steady-width rows should reuse the buffers
+	for i := 1; i <= 10; i++ {
+		writeRow(i)
+	}
+	steadyHits, steadyReallocations := buffers.ReuseStats()
+	require.Equal(t, warmupReallocations, steadyReallocations)
+	require.Greater(t, steadyHits, warmupHits)
+	require.GreaterOrEqual(t, warmupHits, hits)
+
+	// a wider row should reallocate the buffers
+	buffers.GetEncodeRowBufferWithCap(4)
+	_, reallocations = buffers.ReuseStats()
+	require.Greater(t, reallocations, steadyReallocations)
+
+	// the stats are per buffers, and are cleared by release
+	other := NewMutateBuffers(&variable.WriteStmtBufs{})
+	hits, reallocations = other.ReuseStats()
+	require.Zero(t, hits)
+	require.Zero(t, reallocations)
+	other.GetEncodeRowBufferPair()
+	hits, _ = other.ReuseStats()
+	require.Equal(t, uint64(4), hits)
+	ReleaseMutateBuffers(other)
+	hits, reallocations = other.ReuseStats()
+	require.Zero(t, hits)
+	require.Zero(t, reallocations)
+}
+
 func TestEnsureCapacityAndReset(t *testing.T) {
 	slice := ensureCapacityAndReset([]int(nil), 0)
 	require.Nil(t, slice)
@@ -261,3 +2189,316 @@ func TestEnsureCapacityAndReset(t *testing.T) {
 	require.Equal(t, 4, len(slice))
 	require.Equal(t, 5, cap(slice))
 }
+
+// corruptMemBuffer is a faulty memBuffer flipping the last byte of the values on `Set`.
+type corruptMemBuffer struct {
+	mapMemBuffer
+}
+
+func (b *corruptMemBuffer) Set(key kv.Key, value []byte) error {
+	value = slices.Clone(value)
+	value[len(value)-1] ^= 0xff
+	return b.mapMemBuffer.Set(key, value)
+}
+
+func TestEncodeRowBufferVerifyAfterWrite(t *testing.T) {
+	_, mutateCtx := newMockMutateCtx()
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}, VerifyAfterWrite: true}
+	buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+
+	// verification passes on a correct memBuffer
+	memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	require.Len(t, memBuffer.values, 1)
+
+	// verification fails on a faulty memBuffer
+	faulty := &corruptMemBuffer{mapMemBuffer{values: make(map[string][]byte)}}
+	err := buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, faulty, kv.Key("key1"), kv.IntHandle(1),
+	)
+	require.ErrorContains(t, err, "mismatches the written one")
+
+	// nothing is read back if verification is disabled
+	cfg.VerifyAfterWrite = false
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, faulty, kv.Key("key1"), kv.IntHandle(1),
+	))
+}
+
+func TestEncodeRowBufferNullColumnCount(t *testing.T) {
+	_, ctx := newMockMutateCtx()
+	memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(10)
+	require.Zero(t, buffer.NullColumnCount())
+	for i := range 10 {
+		if i%3 == 0 {
+			buffer.AddColVal(int64(i+1), types.Datum{})
+		} else {
+			buffer.AddColVal(int64(i+1), types.NewIntDatum(int64(i)))
+		}
+	}
+	// the count is computed while writing
+	require.Zero(t, buffer.NullColumnCount())
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	require.Equal(t, 4, buffer.NullColumnCount())
+
+	// the count is computed while the row is prepared, so it also covers the lazy values and `EncodeTo`
+	buffer.Reset(2)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddLazyColVal(2, func() (types.Datum, error) { return types.Datum{}, nil })
+	_, err := buffer.EncodeTo(cfg, time.UTC, errctx.StrictNoWarningContext, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, buffer.NullColumnCount())
+
+	buffer.Reset(10)
+	require.Zero(t, buffer.NullColumnCount())
+}
+
+func TestEncodeRowBufferEncodeIntoFixed(t *testing.T) {
+	for _, newFormat := range []bool{true, false} {
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: newFormat}}
+		buffer := &EncodeRowBuffer{}
+		buffer.Reset(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		expected, err := buffer.EncodeTo(cfg, time.UTC, errctx.StrictNoWarningContext, nil)
+		require.NoError(t, err)
+
+		// the row is encoded in place, and the bytes beyond the used ones are untouched
+		region := bytes.Repeat([]byte{0xFF}, len(expected)+8)
+		n, err := buffer.EncodeIntoFixed(region[:len(expected)+4], cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.NoError(t, err)
+		require.Equal(t, len(expected), n)
+		require.Equal(t, expected, region[:n])
+		require.Equal(t, bytes.Repeat([]byte{0xFF}, 8), region[n:])
+
+		// the region too small returns the size needed without writing beyond it
+		region = bytes.Repeat([]byte{0xFF}, len(expected))
+		n, err = buffer.EncodeIntoFixed(region[:len(expected)-1], cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.ErrorIs(t, err, ErrFixedBufferTooSmall)
+		require.Equal(t, len(expected), n)
+		require.Equal(t, byte(0xFF), region[len(expected)-1])
+		n, err = buffer.EncodeIntoFixed(nil, cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.ErrorIs(t, err, ErrFixedBufferTooSmall)
+		require.Equal(t, len(expected), n)
+
+		// the error of the encoding is returned
+		buffer.Reset(1)
+		buffer.AddColVal(1, types.NewFloat64Datum(math.NaN()))
+		n, err = buffer.EncodeIntoFixed(make([]byte, 64), cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrFixedBufferTooSmall)
+		require.Zero(t, n)
+	}
+}
+
+func TestEncodeRowBufferEncodeTo(t *testing.T) {
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+	}
+	for _, newFormat := range []bool{true, false} {
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: newFormat}}
+		// the buffer is not bound to the statement buffers of a session
+		buffer := &EncodeRowBuffer{}
+		buffer.Reset(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+
+		arena := append(make([]byte, 0, 4), "pre"...)
+		encoded, err := buffer.EncodeTo(cfg, time.UTC, errctx.StrictNoWarningContext, arena)
+		require.NoError(t, err)
+		require.Equal(t, "pre", string(encoded[:3]))
+		row, err := tablecodec.DecodeRowToDatumMap(encoded[3:], fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{1: types.NewIntDatum(1), 2: types.NewStringDatum("abc")}, row)
+
+		// the result is the same as the written one, and it is appended in place if `dst` has enough capacity
+		_, ctx := newMockMutateCtx()
+		writeBuffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		writeBuffer.AddColVal(1, types.NewIntDatum(1))
+		writeBuffer.AddColVal(2, types.NewStringDatum("abc"))
+		memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+		require.NoError(t, writeBuffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+		))
+		require.Equal(t, memBuffer.values["key1"], encoded[3:])
+		arena = make([]byte, 0, 128)
+		encoded, err = writeBuffer.EncodeTo(cfg, time.UTC, errctx.StrictNoWarningContext, arena)
+		require.NoError(t, err)
+		require.Equal(t, memBuffer.values["key1"], encoded)
+		require.Same(t, unsafe.SliceData(arena[:1]), unsafe.SliceData(encoded))
+		require.Equal(t, memBuffer.values["key1"], ctx.GetMutateBuffers().GetWriteStmtBufs().RowValBuf)
+
+		// the error of the encoding is returned
+		buffer.Reset(1)
+		buffer.AddColVal(1, types.NewFloat64Datum(math.NaN()))
+		_, err = buffer.EncodeTo(cfg, time.UTC, errctx.StrictNoWarningContext, nil)
+		require.Error(t, err)
+	}
+}
+
+func TestEncodeRowBufferWouldBeNoOp(t *testing.T) {
+	for _, newFormat := range []bool{true, false} {
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: newFormat}}
+		_, ctx := newMockMutateCtx()
+		buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+		))
+		existing := slices.Clone(memBuffer.values["key1"])
+
+		// the equal row is a no-op, and the memBuffer and the statement buffers are not touched
+		buffer = ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		noOp, err := buffer.WouldBeNoOp(existing, cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.NoError(t, err)
+		require.True(t, noOp)
+		require.Equal(t, map[string][]byte{"key1": existing}, memBuffer.values)
+		require.Equal(t, existing, ctx.GetMutateBuffers().GetWriteStmtBufs().RowValBuf)
+
+		// the differing rows are not
+		buffer.Reset(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abd"))
+		noOp, err = buffer.WouldBeNoOp(existing, cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.NoError(t, err)
+		require.False(t, noOp)
+		buffer.Reset(1)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		noOp, err = buffer.WouldBeNoOp(existing, cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.NoError(t, err)
+		require.False(t, noOp)
+
+		// the row level checksum of the existing value is not encoded
+		checksumCfg := cfg
+		checksumCfg.IsRowLevelChecksumEnabled = true
+		buffer.Reset(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			checksumCfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key2"), kv.IntHandle(1),
+		))
+		noOp, err = buffer.WouldBeNoOp(memBuffer.values["key2"], checksumCfg, time.UTC, errctx.StrictNoWarningContext)
+		require.NoError(t, err)
+		require.Equal(t, !newFormat, noOp)
+
+		// the error of the encoding is returned
+		buffer.Reset(1)
+		buffer.AddColVal(1, types.NewFloat64Datum(math.NaN()))
+		_, err = buffer.WouldBeNoOp(existing, cfg, time.UTC, errctx.StrictNoWarningContext)
+		require.Error(t, err)
+	}
+}
+
+// decodeColumnChunk decodes the one-row column chunk encoded by `EncodeRowBuffer.EncodeColumnChunk`.
+func decodeColumnChunk(t *testing.T, data []byte, fts []*types.FieldType) []types.Datum {
+	chk, remained := chunk.NewCodec(fts).Decode(data)
+	require.Empty(t, remained)
+	require.Equal(t, 1, chk.NumRows())
+	return chk.GetRow(0).GetDatumRow(fts)
+}
+
+func TestEncodeRowBufferEncodeColumnChunk(t *testing.T) {
+	uintType := types.NewFieldType(mysql.TypeLonglong)
+	uintType.AddFlag(mysql.UnsignedFlag)
+	enumType := types.NewFieldType(mysql.TypeEnum)
+	enumType.SetElems([]string{"a", "b"})
+	fts := []*types.FieldType{
+		types.NewFieldType(mysql.TypeLonglong),
+		uintType,
+		types.NewFieldType(mysql.TypeDouble),
+		types.NewFieldType(mysql.TypeVarchar),
+		types.NewFieldType(mysql.TypeNewDecimal),
+		types.NewFieldType(mysql.TypeDatetime),
+		types.NewFieldType(mysql.TypeDuration),
+		types.NewFieldType(mysql.TypeJSON),
+		enumType,
+		types.NewFieldType(mysql.TypeVarchar),
+	}
+	row := []types.Datum{
+		types.NewIntDatum(-1),
+		types.NewUintDatum(math.MaxUint64),
+		types.NewFloat64Datum(1.5),
+		types.NewStringDatum("abc"),
+		types.NewDecimalDatum(types.NewDecFromStringForTest("12.34")),
+		types.NewTimeDatum(types.NewTime(types.FromDate(2021, 1, 1, 1, 2, 3, 0), mysql.TypeDatetime, 0)),
+		types.NewDurationDatum(types.Duration{Duration: time.Hour}),
+		types.NewJSONDatum(types.CreateBinaryJSON("abc")),
+		types.NewMysqlEnumDatum(types.Enum{Name: "b", Value: 2}),
+		types.NewDatum(nil),
+	}
+
+	buffer := &EncodeRowBuffer{}
+	buffer.Reset(len(row))
+	for i := range row {
+		buffer.AddColVal(int64(i+1), row[i])
+	}
+	encoded, err := buffer.EncodeColumnChunk(fts)
+	require.NoError(t, err)
+	decoded := decodeColumnChunk(t, encoded, fts)
+	require.Len(t, decoded, len(row))
+	for i := range row {
+		require.Equal(t, row[i].Kind(), decoded[i].Kind(), "column %d", i)
+		cmp, err := row[i].Compare(types.DefaultStmtNoWarningContext, &decoded[i], collate.GetBinaryCollator())
+		require.NoError(t, err)
+		require.Zero(t, cmp, "column %d: %v != %v", i, row[i], decoded[i])
+	}
+
+	// the field types must be aligned with the columns
+	_, err = buffer.EncodeColumnChunk(fts[:1])
+	require.ErrorContains(t, err, "the count of field types 1 mismatches the count of columns 10")
+	buffer.Reset(1)
+	buffer.AddColVal(1, types.MaxValueDatum())
+	_, err = buffer.EncodeColumnChunk(fts[:1])
+	require.ErrorContains(t, err, "can not be encoded to a column chunk")
+}
+
+func TestEncodeRowBufferWriteReturning(t *testing.T) {
+	stmtBufs, mutateCtx := newMockMutateCtx()
+	memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	encoded, err := buffer.WriteMemBufferEncodedReturning(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	)
+	require.NoError(t, err)
+	require.Equal(t, memBuffer.values["key1"], encoded)
+	require.True(t, rowcodec.IsNewFormat(encoded))
+
+	// the returned value is still valid after the inner buffer is overwritten
+	buffer = mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewIntDatum(2))
+	buffer.AddColVal(2, types.NewStringDatum("def"))
+	_, err = buffer.WriteMemBufferEncodedReturning(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key2"), kv.IntHandle(2),
+	)
+	require.NoError(t, err)
+	require.NotEqual(t, stmtBufs.RowValBuf, encoded)
+	require.Equal(t, memBuffer.values["key1"], encoded)
+
+	// nothing is returned if the write fails, the fault injection only works in test
+	if intest.InTest {
+		mutateCtx.GetMutateBuffers().SetFaultInjector(func(stage string) error {
+			return errors.Errorf("mock error at stage %s", stage)
+		})
+		encoded, err = buffer.WriteMemBufferEncodedReturning(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key3"), kv.IntHandle(3),
+		)
+		require.EqualError(t, err, "mock error at stage encode")
+		require.Nil(t, encoded)
+	}
+}
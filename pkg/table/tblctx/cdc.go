@@ -0,0 +1,119 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/types"
+)
+
+// CDCOpType is the type of the change of a `CDCEvent`.
+type CDCOpType byte
+
+// The types of the changes of `CDCEvent`.
+const (
+	// CDCOpInsert is the insertion of a row, which has no before-image.
+	CDCOpInsert CDCOpType = iota + 1
+	// CDCOpUpdate is the update of a row.
+	CDCOpUpdate
+	// CDCOpDelete is the deletion of a row, whose after-image is empty.
+	CDCOpDelete
+)
+
+// String implements the `fmt.Stringer` interface.
+func (t CDCOpType) String() string {
+	switch t {
+	case CDCOpInsert:
+		return "insert"
+	case CDCOpUpdate:
+		return "update"
+	case CDCOpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// CDCEvent is a change event of a row built by `EncodeRowBuffer.BuildCDCEvent`.
+type CDCEvent struct {
+	Op CDCOpType
+	// TableID is the id of the table, or the partition id if the handle is a `kv.PartitionHandle`.
+	TableID int64
+	Key     kv.Key
+	Handle  kv.Handle
+	// ColIDs and After are the ids and the values of the columns after the change, which are empty for a delete.
+	ColIDs []int64
+	After  []types.Datum
+	// Before is the values of the columns before the change keyed by the column ids, which is nil for an insert.
+	// The values are sliced from the before-image in the format of `EncodeRowBuffer.ColumnOffsetIndex`, so they
+	// should be decoded by the consumer with the field types of the columns, and the NULL columns are not included.
+	Before map[int64][]byte
+}
+
+// BuildCDCEvent builds a change event of the row with `handle` from the added columns and the `before` image,
+// which is the encoded value of the row before the change. It is used to centralize the construction of the CDC
+// events, which is duplicated by the downstream consumers otherwise.
+// The buffer should be configured by `ResetForTable` to encode the key. `before` must be nil for an insert and not
+// nil for the others. The event does not reference the buffer or `before`, so it can be retained.
+func (b *EncodeRowBuffer) BuildCDCEvent(opType CDCOpType, before []byte, handle kv.Handle) (*CDCEvent, error) {
+	switch opType {
+	case CDCOpInsert:
+		if before != nil {
+			return nil, errors.New("the before-image of an insert event should be nil")
+		}
+	case CDCOpUpdate, CDCOpDelete:
+		if before == nil {
+			return nil, errors.Errorf("the before-image of the %s event is required", opType)
+		}
+	default:
+		return nil, errors.Errorf("invalid CDC op type %s", opType)
+	}
+
+	key, err := b.RecordKey(handle)
+	if err != nil {
+		return nil, err
+	}
+	event := &CDCEvent{
+		Op:      opType,
+		TableID: b.tableID,
+		Key:     slices.Clone(key),
+		Handle:  handle,
+	}
+	if ph, ok := handle.(kv.PartitionHandle); ok {
+		event.TableID = ph.PartitionID
+	}
+
+	if opType != CDCOpDelete {
+		if err = b.evalLazyColVals(); err != nil {
+			return nil, err
+		}
+		event.ColIDs = slices.Clone(b.colIDs)
+		event.After = b.CopyDatums()
+	}
+	if before != nil {
+		offsets, err := columnOffsets(before, len(b.colIDs))
+		if err != nil {
+			return nil, err
+		}
+		event.Before = make(map[int64][]byte, len(offsets))
+		for colID, offset := range offsets {
+			event.Before[colID] = slices.Clone(before[offset[0] : offset[0]+offset[1]])
+		}
+	}
+	return event, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/codec"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeRowBufferBuildCDCEvent(t *testing.T) {
+	handle := kv.IntHandle(5)
+	recordKey := tablecodec.EncodeRowKeyWithHandle(10, handle)
+	for _, newFormat := range []bool{true, false} {
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: newFormat}}
+		stmtBufs, ctx := newMockMutateCtx()
+		memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+		buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		_, err := buffer.BuildCDCEvent(CDCOpInsert, nil, handle)
+		require.ErrorContains(t, err, "please call ResetForTable first")
+
+		// insert
+		buffer.ResetForTable(10, IntHandleEncoder, 3)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		buffer.AddColVal(3, types.Datum{})
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, recordKey, handle,
+		))
+		event, err := buffer.BuildCDCEvent(CDCOpInsert, nil, handle)
+		require.NoError(t, err)
+		require.Equal(t, &CDCEvent{
+			Op:      CDCOpInsert,
+			TableID: 10,
+			Key:     recordKey,
+			Handle:  handle,
+			ColIDs:  []int64{1, 2, 3},
+			After:   []types.Datum{types.NewIntDatum(1), types.NewStringDatum("abc"), {}},
+		}, event)
+		before := slices.Clone(memBuffer.values[string(recordKey)])
+		offsets, err := buffer.ColumnOffsetIndex()
+		require.NoError(t, err)
+		beforeValues := make(map[int64][]byte, len(offsets))
+		for colID, offset := range offsets {
+			beforeValues[colID] = slices.Clone(stmtBufs.RowValBuf[offset[0] : offset[0]+offset[1]])
+		}
+
+		// update, the before values are sliced from the before-image and the NULL column is not included
+		buffer.ResetForTable(10, IntHandleEncoder, 3)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abd"))
+		buffer.AddColVal(3, types.NewIntDatum(3))
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, recordKey, handle,
+		))
+		event, err = buffer.BuildCDCEvent(CDCOpUpdate, before, handle)
+		require.NoError(t, err)
+		require.Equal(t, &CDCEvent{
+			Op:      CDCOpUpdate,
+			TableID: 10,
+			Key:     recordKey,
+			Handle:  handle,
+			ColIDs:  []int64{1, 2, 3},
+			After:   []types.Datum{types.NewIntDatum(1), types.NewStringDatum("abd"), types.NewIntDatum(3)},
+			Before:  beforeValues,
+		}, event)
+		require.Len(t, event.Before, 2)
+		if newFormat {
+			require.Equal(t, []byte("abc"), event.Before[2])
+		} else {
+			_, d, err := codec.DecodeOne(event.Before[2])
+			require.NoError(t, err)
+			require.Equal(t, "abc", string(d.GetBytes()))
+		}
+
+		// the event does not reference the buffer or the before-image
+		buffer.ResetForTable(10, IntHandleEncoder, 1)
+		buffer.AddColVal(1, types.NewIntDatum(100))
+		clear(before)
+		require.Equal(t, types.NewStringDatum("abd"), event.After[1])
+		require.Equal(t, beforeValues, event.Before)
+		require.Equal(t, recordKey, event.Key)
+	}
+
+	buffer := &EncodeRowBuffer{}
+	buffer.ResetForTable(10, IntHandleEncoder, 1)
+	buffer.AddColVal(1, types.NewIntDatum(1))
+	// delete of a partition
+	pHandle := kv.NewPartitionHandle(20, handle)
+	event, err := buffer.BuildCDCEvent(CDCOpDelete, []byte{codec.NilFlag}, pHandle)
+	require.NoError(t, err)
+	require.Equal(t, &CDCEvent{
+		Op:      CDCOpDelete,
+		TableID: 20,
+		Key:     tablecodec.EncodeRowKeyWithHandle(20, handle),
+		Handle:  pHandle,
+		Before:  map[int64][]byte{},
+	}, event)
+
+	_, err = buffer.BuildCDCEvent(CDCOpInsert, []byte{codec.NilFlag}, handle)
+	require.EqualError(t, err, "the before-image of an insert event should be nil")
+	_, err = buffer.BuildCDCEvent(CDCOpUpdate, nil, handle)
+	require.EqualError(t, err, "the before-image of the update event is required")
+	_, err = buffer.BuildCDCEvent(CDCOpType(9), nil, handle)
+	require.EqualError(t, err, "invalid CDC op type unknown(9)")
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/meta/model"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/collate"
+)
+
+// CheckRowBuffer is used to check row constraints
+type CheckRowBuffer struct {
+	rowToCheck []types.Datum
+	// mutRow is reused by `GetRowToCheck`, and mutRowKinds is the kinds of the values its columns are built for.
+	mutRow      chunk.MutRow
+	mutRowKinds []byte
+	// deferredKeys is the keys queued by `QueueForDeferredCheck`, which are kept across `Reset`.
+	deferredKeys []kv.Key
+	// reuse counts the reuse of the inner slices, see `MutateBuffers.ReuseStats`.
+	reuse reuseStats
+}
+
+// GetRowToCheck gets the row data for constraint check.
+// The inner row is reused and only rebuilt when the count or the kinds of the columns change, so the returned row
+// is valid until the buffer is reset, after which it may be overwritten by the next call.
+func (b *CheckRowBuffer) GetRowToCheck() chunk.Row {
+	if b.canReuseMutRow() {
+		b.mutRow.SetDatums(b.rowToCheck...)
+		return b.mutRow.ToRow()
+	}
+	b.mutRow = chunk.MutRowFromDatums(b.rowToCheck)
+	b.mutRowKinds = b.mutRowKinds[:0]
+	for i := range b.rowToCheck {
+		b.mutRowKinds = append(b.mutRowKinds, b.rowToCheck[i].Kind())
+	}
+	return b.mutRow.ToRow()
+}
+
+// canReuseMutRow returns whether the columns of `mutRow` can hold the row in the buffer, that is, the count of the
+// columns is the same and every non-NULL value has the kind its column is built for. A NULL can be set to any column.
+func (b *CheckRowBuffer) canReuseMutRow() bool {
+	if b.mutRow == (chunk.MutRow{}) || len(b.mutRowKinds) != len(b.rowToCheck) {
+		return false
+	}
+	for i := range b.rowToCheck {
+		if kind := b.rowToCheck[i].Kind(); kind != types.KindNull && kind != b.mutRowKinds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AddColVal adds a column value to the buffer for checking.
+func (b *CheckRowBuffer) AddColVal(val types.Datum) {
+	b.rowToCheck = append(b.rowToCheck, val)
+}
+
+// DiffersFrom reports whether the row in the buffer differs from the `existing` row in the columns of offsets `cols`.
+// It is used by `INSERT ... ON DUPLICATE KEY UPDATE` to check whether the row is changed.
+// The values are compared by `types.Datum.Compare` with the binary collator like `updateRecord` in the executor, so
+// the values of different representations, e.g. the decimals of different fractions, are regarded as equal, but the
+// strings equal only under the collation of the column, e.g. 'a' and 'A' under a `_ci` collation, are regarded as
+// different because the stored value changes. Two NULLs are regarded as equal and a NULL is regarded as different
+// from any non-NULL value, like the NULL-safe equal operator `<=>`.
+// A `chunk.Row` does not carry the types of its columns, so the `existing` values are read by the field types `fts`
+// indexed by the column offsets, and the comparison needs `tc` and may fail, which is returned as the error.
+func (b *CheckRowBuffer) DiffersFrom(
+	tc types.Context, existing chunk.Row, fts []*types.FieldType, cols []int,
+) (bool, error) {
+	for _, col := range cols {
+		d := existing.GetDatum(col, fts[col])
+		cmp, err := b.rowToCheck[col].Compare(tc, &d, collate.GetBinaryCollator())
+		if err != nil || cmp != 0 {
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
+
+// NamedConstraint is a CHECK constraint evaluated by `CheckRowBuffer.EvalCheckConstraints`.
+type NamedConstraint struct {
+	// Name is the name of the constraint.
+	Name string
+	// Eval evaluates the constraint expression against the row.
+	Eval func(row chunk.Row) (val int64, isNull bool, err error)
+}
+
+// EvalCheckConstraints evaluates the CHECK constraints `cs` in order against the row in the buffer, which is built
+// only once for all the constraints. It returns the name of the first violated constraint and false if any.
+// Like `table.CheckRowConstraint`, a constraint is violated only if it evaluates to a non-NULL false value.
+func (b *CheckRowBuffer) EvalCheckConstraints(cs []NamedConstraint) (string, bool, error) {
+	if len(cs) == 0 {
+		return "", true, nil
+	}
+	row := b.GetRowToCheck()
+	for _, c := range cs {
+		val, isNull, err := c.Eval(row)
+		if err != nil {
+			return "", false, err
+		}
+		if val == 0 && !isNull {
+			return c.Name, false, nil
+		}
+	}
+	return "", true, nil
+}
+
+// ForeignKeyProbeKey builds the key to probe the referenced index `refIdx` of the table `refTbl` for a foreign key
+// whose columns are at the offsets `fkColPositions` of the row in the buffer.
+// The key is built by `tablecodec.GenIndexKey` like the index writes, that is, the values are encoded with the
+// collations of the referenced columns and truncated to the lengths of the prefix index columns.
+// The returned key is a seek key of the index prefix, so it can be used for both unique and non-unique indexes.
+// If any of the foreign key columns is NULL, the foreign key does not need to be checked and a nil key is returned.
+// The `loc` is used to convert the timestamp values to UTC like the index encoding does.
+// `refPhysicalID` is the id of the physical table holding the referenced row, that is, the partition located by the
+// caller for a partitioned referenced table, or `refTbl.ID` otherwise. It is ignored for a global index, which is
+// probed in the logical table like `IndexDeleteKeys`.
+// It takes the table and index infos rather than their ids, because the collations and the prefix lengths of the
+// referenced columns are needed to build a key matching the index writes.
+func (b *CheckRowBuffer) ForeignKeyProbeKey(
+	loc *time.Location, fkColPositions []int, refTbl *model.TableInfo, refIdx *model.IndexInfo, refPhysicalID int64,
+) (kv.Key, error) {
+	if !refIdx.Global && !isPhysicalTableOf(refTbl, refPhysicalID) {
+		return nil, errors.Errorf("%d is not a physical table id of the referenced table %s", refPhysicalID, refTbl.Name.O)
+	}
+	if len(fkColPositions) > len(refIdx.Columns) {
+		return nil, errors.Errorf("foreign key has %d columns, but the referenced index %s has only %d",
+			len(fkColPositions), refIdx.Name.O, len(refIdx.Columns))
+	}
+	vals := make([]types.Datum, 0, len(fkColPositions))
+	for i, pos := range fkColPositions {
+		if pos < 0 || pos >= len(b.rowToCheck) {
+			return nil, errors.Errorf("foreign key column offset %d out of range [0, %d)", pos, len(b.rowToCheck))
+		}
+		val := b.rowToCheck[pos]
+		if val.IsNull() {
+			return nil, nil
+		}
+		if val.Kind() == types.KindString {
+			val.SetCollation(refTbl.Columns[refIdx.Columns[i].Offset].GetCollate())
+		}
+		vals = append(vals, val)
+	}
+	tblID := indexTableID(IndexSpec{Table: refTbl, Index: refIdx}, refPhysicalID)
+	key, _, err := tablecodec.GenIndexKey(loc, refTbl, refIdx, tblID, vals, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// isPhysicalTableOf returns whether `physicalID` is the id of the table, or of a partition if it is partitioned.
+func isPhysicalTableOf(tbl *model.TableInfo, physicalID int64) bool {
+	pi := tbl.GetPartitionInfo()
+	if pi == nil {
+		return physicalID == tbl.ID
+	}
+	isDef := func(def model.PartitionDefinition) bool { return def.ID == physicalID }
+	return slices.ContainsFunc(pi.Definitions, isDef) || slices.ContainsFunc(pi.AddingDefinitions, isDef)
+}
+
+// ValidateEnumSet checks the value at the offset `colPos` of the row in the buffer is within the `domain`, that is,
+// the declared elements of an ENUM or SET column. It is done before the constraint checks so an out-of-domain value
+// is reported precisely instead of failing the checks later.
+// The strings are matched exactly, the integers are the 1-based positions of ENUM elements, and every item of a
+// SET value must be in the domain. NULL is always valid.
+func (b *CheckRowBuffer) ValidateEnumSet(colPos int, domain []string) error {
+	if colPos < 0 || colPos >= len(b.rowToCheck) {
+		return errors.Errorf("enum column offset %d out of range [0, %d)", colPos, len(b.rowToCheck))
+	}
+	val := b.rowToCheck[colPos]
+	var invalid string
+	valid := true
+	switch val.Kind() {
+	case types.KindNull:
+	case types.KindMysqlEnum:
+		enum := val.GetMysqlEnum()
+		invalid = enum.Name
+		valid = enum.Value >= 1 && enum.Value <= uint64(len(domain)) && domain[enum.Value-1] == enum.Name
+	case types.KindMysqlSet:
+		if name := val.GetMysqlSet().Name; name != "" {
+			for _, item := range strings.Split(name, ",") {
+				if !slices.Contains(domain, item) {
+					invalid, valid = item, false
+					break
+				}
+			}
+		}
+	case types.KindString, types.KindBytes:
+		invalid = val.GetString()
+		valid = slices.Contains(domain, invalid)
+	case types.KindInt64:
+		pos := val.GetInt64()
+		invalid = strconv.FormatInt(pos, 10)
+		valid = pos >= 1 && pos <= int64(len(domain))
+	case types.KindUint64:
+		pos := val.GetUint64()
+		invalid = strconv.FormatUint(pos, 10)
+		valid = pos >= 1 && pos <= uint64(len(domain))
+	default:
+		return errors.Errorf("unexpected kind %d of the enum column at offset %d", val.Kind(), colPos)
+	}
+	if !valid {
+		return ErrTruncatedWrongValueForField.FastGen(
+			"Invalid enum value '%s' for column at offset %d, expected one of ('%s')",
+			invalid, colPos, strings.Join(domain, "', '"))
+	}
+	return nil
+}
+
+// QueueForDeferredCheck queues the `key` of the row in the buffer to be checked at the end of the statement by
+// `EvalDeferredChecks`, which looks up all the queued keys in one batch instead of a round-trip for each row.
+// The key must be a point key, e.g. a unique index key or a record key, and it is copied so the caller can reuse it.
+// A nil key, e.g. the one returned by `ForeignKeyProbeKey` for NULL columns, is queued but never looked up, so the
+// positions of the results are always the order the rows are queued in.
+// The queued keys are kept across `Reset`, so a key can be queued for each row of the statement.
+func (b *CheckRowBuffer) QueueForDeferredCheck(key kv.Key) {
+	b.deferredKeys = append(b.deferredKeys, slices.Clone(key))
+}
+
+// DeferredCheckCount returns the count of the keys queued by `QueueForDeferredCheck`.
+func (b *CheckRowBuffer) DeferredCheckCount() int {
+	return len(b.deferredKeys)
+}
+
+// EvalDeferredChecks looks up the keys queued by `QueueForDeferredCheck` in one batch by `getter`, and returns
+// whether each key exists in the order they are queued. A nil key never exists. How the existence is checked is up
+// to the caller, e.g. a foreign key is violated if the referenced key does not exist, while a unique key is violated
+// if the key exists.
+// The queue is cleared if the keys are looked up successfully, and kept for a retry otherwise.
+func (b *CheckRowBuffer) EvalDeferredChecks(ctx context.Context, getter kv.BatchGetter) ([]bool, error) {
+	if len(b.deferredKeys) == 0 {
+		return nil, nil
+	}
+	keys := make([]kv.Key, 0, len(b.deferredKeys))
+	for _, key := range b.deferredKeys {
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	var values map[string][]byte
+	if len(keys) > 0 {
+		var err error
+		if values, err = getter.BatchGet(ctx, keys); err != nil {
+			return nil, err
+		}
+	}
+	exists := make([]bool, len(b.deferredKeys))
+	for i, key := range b.deferredKeys {
+		if key != nil {
+			_, exists[i] = values[string(key)]
+		}
+	}
+	b.ClearDeferredChecks()
+	return exists, nil
+}
+
+// ClearDeferredChecks removes the keys queued by `QueueForDeferredCheck` without checking them.
+func (b *CheckRowBuffer) ClearDeferredChecks() {
+	clear(b.deferredKeys)
+	b.deferredKeys = b.deferredKeys[:0]
+}
+
+// Reset resets the inner buffer to a capacity.
+func (b *CheckRowBuffer) Reset(capacity int) {
+	b.rowToCheck = ensureCapacityAndResetWithStats(&b.reuse, b.rowToCheck, 0, capacity)
+}
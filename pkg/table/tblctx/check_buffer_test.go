@@ -0,0 +1,414 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/meta/model"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	"github.com/pingcap/tidb/pkg/parser/charset"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/codec"
+	"github.com/pingcap/tidb/pkg/util/collate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRowBuffer(t *testing.T) {
+	buffer := &CheckRowBuffer{}
+	buffer.Reset(6)
+	require.Equal(t, 0, len(buffer.rowToCheck))
+	require.Equal(t, 6, cap(buffer.rowToCheck))
+	buffer.AddColVal(types.NewIntDatum(1))
+	buffer.AddColVal(types.NewIntDatum(2))
+	require.Equal(t, []types.Datum{types.NewIntDatum(1), types.NewIntDatum(2)}, buffer.rowToCheck)
+	rowToCheck := buffer.GetRowToCheck()
+	require.Equal(t, 2, rowToCheck.Len())
+	require.Equal(t, int64(1), rowToCheck.GetInt64(0))
+	require.Equal(t, int64(2), rowToCheck.GetInt64(1))
+
+	// reset should not shrink the capacity
+	buffer.Reset(2)
+	require.Equal(t, 0, len(buffer.rowToCheck))
+	require.Equal(t, 6, cap(buffer.rowToCheck))
+
+	// the inner row is reused for the values of the same kinds, and a NULL can be set to any column
+	buffer.AddColVal(types.NewIntDatum(3))
+	buffer.AddColVal(types.NewDatum(nil))
+	reused := buffer.GetRowToCheck()
+	require.Same(t, rowToCheck.Chunk(), reused.Chunk())
+	require.Equal(t, int64(3), reused.GetInt64(0))
+	require.True(t, reused.IsNull(1))
+	buffer.Reset(2)
+	buffer.AddColVal(types.NewIntDatum(4))
+	buffer.AddColVal(types.NewIntDatum(5))
+	reused = buffer.GetRowToCheck()
+	require.Same(t, rowToCheck.Chunk(), reused.Chunk())
+	require.Equal(t, int64(4), reused.GetInt64(0))
+	require.Equal(t, int64(5), reused.GetInt64(1))
+
+	// the inner row is rebuilt when the kinds or the count of the columns change
+	buffer.Reset(3)
+	buffer.AddColVal(types.NewDecimalDatum(types.NewDecFromInt(6)))
+	buffer.AddColVal(types.NewStringDatum("abc"))
+	rebuilt := buffer.GetRowToCheck()
+	require.NotSame(t, rowToCheck.Chunk(), rebuilt.Chunk())
+	require.Equal(t, "6", rebuilt.GetMyDecimal(0).String())
+	require.Equal(t, "abc", rebuilt.GetString(1))
+	buffer.AddColVal(types.NewIntDatum(7))
+	rowToCheck = buffer.GetRowToCheck()
+	require.NotSame(t, rebuilt.Chunk(), rowToCheck.Chunk())
+	require.Equal(t, 3, rowToCheck.Len())
+	require.Equal(t, int64(7), rowToCheck.GetInt64(2))
+	// the previous row is still valid before the buffer is reset
+	require.Equal(t, "abc", rebuilt.GetString(1))
+}
+
+func TestCheckRowBufferEvalCheckConstraints(t *testing.T) {
+	buffer := &CheckRowBuffer{}
+	buffer.Reset(2)
+	buffer.AddColVal(types.NewIntDatum(10))
+	buffer.AddColVal(types.NewIntDatum(20))
+	// greaterThan returns a constraint of `col > val`
+	evaluated := make([]string, 0, 3)
+	greaterThan := func(name string, col int, val int64) NamedConstraint {
+		return NamedConstraint{Name: name, Eval: func(row chunk.Row) (int64, bool, error) {
+			evaluated = append(evaluated, name)
+			if row.IsNull(col) {
+				return 0, true, nil
+			}
+			if row.GetInt64(col) > val {
+				return 1, false, nil
+			}
+			return 0, false, nil
+		}}
+	}
+
+	name, ok, err := buffer.EvalCheckConstraints(nil)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Empty(t, name)
+
+	name, ok, err = buffer.EvalCheckConstraints([]NamedConstraint{
+		greaterThan("c1", 0, 5), greaterThan("c2", 1, 5),
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Empty(t, name)
+	require.Equal(t, []string{"c1", "c2"}, evaluated)
+
+	// the second constraint fails
+	evaluated = evaluated[:0]
+	name, ok, err = buffer.EvalCheckConstraints([]NamedConstraint{
+		greaterThan("c1", 0, 5), greaterThan("c2", 1, 30), greaterThan("c3", 1, 40),
+	})
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, "c2", name)
+	require.Equal(t, []string{"c1", "c2"}, evaluated)
+
+	// NULL does not violate the constraint
+	buffer.Reset(2)
+	buffer.AddColVal(types.NewIntDatum(10))
+	buffer.AddColVal(types.Datum{})
+	name, ok, err = buffer.EvalCheckConstraints([]NamedConstraint{greaterThan("c2", 1, 30)})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Empty(t, name)
+
+	// the error should be returned
+	name, ok, err = buffer.EvalCheckConstraints([]NamedConstraint{{Name: "c4", Eval: func(chunk.Row) (int64, bool, error) {
+		return 0, false, errors.New("mock eval error")
+	}}})
+	require.EqualError(t, err, "mock eval error")
+	require.False(t, ok)
+	require.Empty(t, name)
+}
+
+func TestCheckRowBufferDiffersFrom(t *testing.T) {
+	tc := types.DefaultStmtNoWarningContext
+	fts := []*types.FieldType{
+		types.NewFieldType(mysql.TypeLonglong),
+		types.NewFieldType(mysql.TypeLonglong),
+		types.NewFieldType(mysql.TypeVarchar),
+	}
+	buffer := &CheckRowBuffer{}
+	buffer.Reset(3)
+	buffer.AddColVal(types.NewIntDatum(1))
+	buffer.AddColVal(types.NewDatum(nil))
+	buffer.AddColVal(types.NewStringDatum("abc"))
+	differs := func(existing chunk.Row, cols []int) bool {
+		d, err := buffer.DiffersFrom(tc, existing, fts, cols)
+		require.NoError(t, err)
+		return d
+	}
+
+	// NULL vs NULL should be equal
+	existing := chunk.MutRowFromDatums([]types.Datum{
+		types.NewIntDatum(1), types.NewDatum(nil), types.NewStringDatum("abc"),
+	}).ToRow()
+	require.False(t, differs(existing, []int{0, 1, 2}))
+
+	// NULL vs value should differ
+	existing = chunk.MutRowFromDatums([]types.Datum{
+		types.NewIntDatum(1), types.NewIntDatum(0), types.NewStringDatum("abc"),
+	}).ToRow()
+	require.True(t, differs(existing, []int{0, 1, 2}))
+	require.True(t, differs(existing, []int{1}))
+	// columns not in `cols` should be ignored
+	require.False(t, differs(existing, []int{0, 2}))
+
+	// value vs NULL should differ
+	existing = chunk.MutRowFromDatums([]types.Datum{
+		types.NewDatum(nil), types.NewDatum(nil), types.NewStringDatum("abc"),
+	}).ToRow()
+	require.True(t, differs(existing, []int{0}))
+
+	// value vs value
+	existing = chunk.MutRowFromDatums([]types.Datum{
+		types.NewIntDatum(1), types.NewDatum(nil), types.NewStringDatum("abd"),
+	}).ToRow()
+	require.True(t, differs(existing, []int{2}))
+	require.False(t, differs(existing, []int{0, 1}))
+
+	// the equal values of different representations should be equal
+	fts = []*types.FieldType{types.NewFieldType(mysql.TypeNewDecimal), types.NewFieldType(mysql.TypeDouble)}
+	buffer.Reset(2)
+	buffer.AddColVal(types.NewDecimalDatum(types.NewDecFromStringForTest("1.0")))
+	buffer.AddColVal(types.NewFloat64Datum(math.Copysign(0, -1)))
+	existing = chunk.MutRowFromDatums([]types.Datum{
+		types.NewDecimalDatum(types.NewDecFromStringForTest("1.00")), types.NewFloat64Datum(0),
+	}).ToRow()
+	require.False(t, differs(existing, []int{0, 1}))
+	existing = chunk.MutRowFromDatums([]types.Datum{
+		types.NewDecimalDatum(types.NewDecFromStringForTest("1.01")), types.NewFloat64Datum(0),
+	}).ToRow()
+	require.True(t, differs(existing, []int{0}))
+
+	// the strings equal under a `_ci` collation differ like `updateRecord`, because the stored value changes
+	collate.SetNewCollationEnabledForTest(true)
+	defer collate.SetNewCollationEnabledForTest(false)
+	ciType := types.NewFieldType(mysql.TypeVarchar)
+	ciType.SetCharset(charset.CharsetUTF8MB4)
+	ciType.SetCollate("utf8mb4_general_ci")
+	fts = []*types.FieldType{ciType}
+	buffer.Reset(1)
+	buffer.AddColVal(types.NewCollationStringDatum("A", "utf8mb4_general_ci"))
+	existing = chunk.MutRowFromDatums([]types.Datum{types.NewCollationStringDatum("a", "utf8mb4_general_ci")}).ToRow()
+	require.True(t, differs(existing, []int{0}))
+	existing = chunk.MutRowFromDatums([]types.Datum{types.NewCollationStringDatum("A", "utf8mb4_general_ci")}).ToRow()
+	require.False(t, differs(existing, []int{0}))
+}
+
+func TestCheckRowBufferValidateEnumSet(t *testing.T) {
+	domain := []string{"small", "medium", "large"}
+	buffer := &CheckRowBuffer{}
+	buffer.AddColVal(types.NewMysqlEnumDatum(types.Enum{Name: "medium", Value: 2}))
+	buffer.AddColVal(types.NewStringDatum("huge"))
+	buffer.AddColVal(types.NewIntDatum(3))
+	buffer.AddColVal(types.NewIntDatum(4))
+	buffer.AddColVal(types.NewMysqlSetDatum(types.Set{Name: "small,large", Value: 5}, ""))
+	buffer.AddColVal(types.NewMysqlSetDatum(types.Set{Name: "small,tiny", Value: 9}, ""))
+	buffer.AddColVal(types.NewDatum(nil))
+
+	require.NoError(t, buffer.ValidateEnumSet(0, domain))
+	err := buffer.ValidateEnumSet(1, domain)
+	require.True(t, ErrTruncatedWrongValueForField.Equal(err))
+	require.EqualError(t, err,
+		"[table:1366]Invalid enum value 'huge' for column at offset 1, expected one of ('small', 'medium', 'large')")
+	require.NoError(t, buffer.ValidateEnumSet(2, domain))
+	require.ErrorContains(t, buffer.ValidateEnumSet(3, domain), "Invalid enum value '4'")
+	require.NoError(t, buffer.ValidateEnumSet(4, domain))
+	require.ErrorContains(t, buffer.ValidateEnumSet(5, domain), "Invalid enum value 'tiny'")
+	require.NoError(t, buffer.ValidateEnumSet(6, domain))
+	require.ErrorContains(t, buffer.ValidateEnumSet(7, domain), "out of range")
+}
+
+// newForeignKeyRefTable returns the table 10 referenced by the foreign keys, which has the unique index 2 on `c3`
+// and the index 3 on `c1(2), c0`.
+func newForeignKeyRefTable() *model.TableInfo {
+	newCol := func(offset int, tp byte, collation string) *model.ColumnInfo {
+		col := &model.ColumnInfo{ID: int64(offset + 1), Offset: offset, FieldType: *types.NewFieldType(tp)}
+		col.SetCharset(charset.CharsetUTF8MB4)
+		col.SetCollate(collation)
+		return col
+	}
+	return &model.TableInfo{
+		ID: 10,
+		Columns: []*model.ColumnInfo{
+			newCol(0, mysql.TypeLonglong, charset.CollationBin),
+			newCol(1, mysql.TypeVarchar, "utf8mb4_general_ci"),
+			newCol(2, mysql.TypeLonglong, charset.CollationBin),
+			newCol(3, mysql.TypeLonglong, charset.CollationBin),
+		},
+		Indices: []*model.IndexInfo{
+			{ID: 2, Name: ast.NewCIStr("u3"), Unique: true, Columns: []*model.IndexColumn{
+				{Offset: 3, Length: types.UnspecifiedLength},
+			}},
+			{ID: 3, Name: ast.NewCIStr("i10"), Columns: []*model.IndexColumn{
+				{Offset: 1, Length: 2}, {Offset: 0, Length: types.UnspecifiedLength},
+			}},
+		},
+	}
+}
+
+func TestCheckRowBufferForeignKeyProbeKey(t *testing.T) {
+	collate.SetNewCollationEnabledForTest(true)
+	defer collate.SetNewCollationEnabledForTest(false)
+	refTbl := newForeignKeyRefTable()
+	buffer := &CheckRowBuffer{}
+	buffer.Reset(4)
+	buffer.AddColVal(types.NewIntDatum(1))
+	buffer.AddColVal(types.NewStringDatum("ABC"))
+	buffer.AddColVal(types.NewDatum(nil))
+	buffer.AddColVal(types.NewIntDatum(7))
+
+	// single column foreign key
+	key, err := buffer.ForeignKeyProbeKey(time.UTC, []int{3}, refTbl, refTbl.Indices[0], refTbl.ID)
+	require.NoError(t, err)
+	encoded, err := codec.EncodeKey(time.UTC, nil, types.NewIntDatum(7))
+	require.NoError(t, err)
+	require.Equal(t, tablecodec.EncodeIndexSeekKey(10, 2, encoded), key)
+
+	// composite foreign key, the column order follows the positions, and the string is encoded with the collation
+	// of the referenced column and truncated to the prefix length
+	key, err = buffer.ForeignKeyProbeKey(time.UTC, []int{1, 0}, refTbl, refTbl.Indices[1], refTbl.ID)
+	require.NoError(t, err)
+	encoded, err = codec.EncodeKey(time.UTC, nil,
+		types.NewCollationStringDatum("ab", "utf8mb4_general_ci"), types.NewIntDatum(1))
+	require.NoError(t, err)
+	require.Equal(t, tablecodec.EncodeIndexSeekKey(10, 3, encoded), key)
+	require.True(t, key.HasPrefix(tablecodec.EncodeTableIndexPrefix(10, 3)))
+	require.Equal(t, "ABC", buffer.rowToCheck[1].GetString())
+
+	// foreign key with NULL does not need to be checked
+	key, err = buffer.ForeignKeyProbeKey(time.UTC, []int{0, 2}, refTbl, refTbl.Indices[1], refTbl.ID)
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	// invalid offset
+	_, err = buffer.ForeignKeyProbeKey(time.UTC, []int{4}, refTbl, refTbl.Indices[1], refTbl.ID)
+	require.ErrorContains(t, err, "out of range")
+
+	// more columns than the referenced index
+	_, err = buffer.ForeignKeyProbeKey(time.UTC, []int{0, 3}, refTbl, refTbl.Indices[0], refTbl.ID)
+	require.ErrorContains(t, err, "has only 1")
+
+	// the physical table id must belong to the referenced table
+	_, err = buffer.ForeignKeyProbeKey(time.UTC, []int{3}, refTbl, refTbl.Indices[0], 11)
+	require.ErrorContains(t, err, "is not a physical table id")
+}
+
+func TestCheckRowBufferForeignKeyProbeKeyPartitioned(t *testing.T) {
+	refTbl := newForeignKeyRefTable()
+	refTbl.Partition = &model.PartitionInfo{
+		Type: ast.PartitionTypeHash, Num: 2, Enable: true,
+		Definitions: []model.PartitionDefinition{{ID: 11}, {ID: 12}},
+	}
+	globalIdx := refTbl.Indices[0].Clone()
+	globalIdx.ID, globalIdx.Global = 4, true
+	buffer := &CheckRowBuffer{}
+	buffer.Reset(4)
+	buffer.AddColVal(types.NewIntDatum(1))
+	buffer.AddColVal(types.NewStringDatum("ABC"))
+	buffer.AddColVal(types.NewDatum(nil))
+	buffer.AddColVal(types.NewIntDatum(7))
+	encoded, err := codec.EncodeKey(time.UTC, nil, types.NewIntDatum(7))
+	require.NoError(t, err)
+
+	// a local index is probed in the partition holding the referenced row
+	key, err := buffer.ForeignKeyProbeKey(time.UTC, []int{3}, refTbl, refTbl.Indices[0], 12)
+	require.NoError(t, err)
+	require.Equal(t, tablecodec.EncodeIndexSeekKey(12, 2, encoded), key)
+
+	// the logical table and the unknown partitions are rejected for a local index
+	for _, physicalID := range []int64{refTbl.ID, 13} {
+		_, err = buffer.ForeignKeyProbeKey(time.UTC, []int{3}, refTbl, refTbl.Indices[0], physicalID)
+		require.ErrorContains(t, err, "is not a physical table id")
+	}
+
+	// a global index is probed in the logical table
+	key, err = buffer.ForeignKeyProbeKey(time.UTC, []int{3}, refTbl, globalIdx, 12)
+	require.NoError(t, err)
+	require.Equal(t, tablecodec.EncodeIndexSeekKey(refTbl.ID, 4, encoded), key)
+}
+
+func TestCheckRowBufferDeferredCheck(t *testing.T) {
+	ctx := context.Background()
+	// the unique index 2 of the table 10 has the key of the value 1
+	encoded, err := codec.EncodeKey(time.UTC, nil, types.NewIntDatum(1))
+	require.NoError(t, err)
+	existing := tablecodec.EncodeIndexSeekKey(10, 2, encoded)
+	var batches [][]kv.Key
+	getter := batchGetterFunc(func(_ context.Context, keys []kv.Key) (map[string][]byte, error) {
+		batches = append(batches, slices.Clone(keys))
+		values := make(map[string][]byte)
+		for _, key := range keys {
+			if key.Cmp(existing) == 0 {
+				values[string(key)] = []byte{'1'}
+			}
+		}
+		return values, nil
+	})
+
+	refTbl := newForeignKeyRefTable()
+	refTbl.Indices[0].Columns[0].Offset = 0
+	buffer := &CheckRowBuffer{}
+	queueRows := func() {
+		for _, val := range []types.Datum{types.NewIntDatum(1), types.NewIntDatum(2), types.NewDatum(nil)} {
+			buffer.Reset(1)
+			buffer.AddColVal(val)
+			key, err := buffer.ForeignKeyProbeKey(time.UTC, []int{0}, refTbl, refTbl.Indices[0], refTbl.ID)
+			require.NoError(t, err)
+			buffer.QueueForDeferredCheck(key)
+		}
+	}
+	queueRows()
+	require.Equal(t, 3, buffer.DeferredCheckCount())
+
+	// the rows are checked in one batch, and the NULL is not looked up
+	exists, err := buffer.EvalDeferredChecks(ctx, getter)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, false}, exists)
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 2)
+	require.Equal(t, existing, batches[0][0])
+	require.Zero(t, buffer.DeferredCheckCount())
+
+	// nothing to check
+	exists, err = buffer.EvalDeferredChecks(ctx, getter)
+	require.NoError(t, err)
+	require.Empty(t, exists)
+	require.Len(t, batches, 1)
+
+	// the queue is kept for a retry if the lookup fails
+	queueRows()
+	_, err = buffer.EvalDeferredChecks(ctx, batchGetterFunc(func(context.Context, []kv.Key) (map[string][]byte, error) {
+		return nil, errors.New("mock error")
+	}))
+	require.EqualError(t, err, "mock error")
+	require.Equal(t, 3, buffer.DeferredCheckCount())
+	buffer.ClearDeferredChecks()
+	require.Zero(t, buffer.DeferredCheckCount())
+}
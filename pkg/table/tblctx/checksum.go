@@ -0,0 +1,129 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"cmp"
+	"encoding/binary"
+	"hash/crc32"
+	"slices"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/util/codec"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+)
+
+// RewriteChecksum returns the `existing` row value with the row level checksum recomputed by `handle`, which is
+// used by the scrub and repair jobs to refresh the checksum of a row without changing its data.
+// The column data bytes of the result are identical to `existing`. Only the rows encoded in the new row format can
+// carry a checksum, and the row level checksum must be enabled in `cfg`.
+// The result is a new slice which is not referenced by the buffer.
+func (*EncodeRowBuffer) RewriteChecksum(existing []byte, handle kv.Handle, cfg RowEncodingConfig) ([]byte, error) {
+	if !cfg.IsRowLevelChecksumEnabled {
+		return nil, errors.New("RewriteChecksum requires the row level checksum to be enabled")
+	}
+	if !rowcodec.IsNewFormat(existing) {
+		return nil, errors.New("RewriteChecksum requires the row encoded in the new row format")
+	}
+	return rowcodec.RewriteRawChecksum(existing, handle, make([]byte, 0, len(existing)+5))
+}
+
+// VerifyEncodedChecksum recomputes the row level checksum of the `encoded` row value by `handle` and reports whether it
+// equals to the checksum embedded by `WriteMemBufferEncoded` when `RowEncodingConfig.IsRowLevelChecksumEnabled` is set.
+// It is used by the consumers to validate the integrity of the rows. Only the rows encoded in the new row format can
+// carry a checksum, so an error is returned for the old row format, e.g. the value of `EncodeBinlogRowData`, and for
+// the rows without a checksum.
+func VerifyEncodedChecksum(encoded []byte, handle kv.Handle) (bool, error) {
+	if !rowcodec.IsNewFormat(encoded) {
+		return false, errors.New("VerifyEncodedChecksum requires the row encoded in the new row format")
+	}
+	return rowcodec.VerifyRawChecksum(encoded, handle)
+}
+
+// colOffsetsByID returns the offsets of the added columns in the ascending order of the column ids.
+func (b *EncodeRowBuffer) colOffsetsByID() []int {
+	order := make([]int, len(b.colIDs))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(i, j int) int {
+		return cmp.Compare(b.colIDs[i], b.colIDs[j])
+	})
+	return order
+}
+
+// PKAndRowChecksum computes two checksums for the added columns which are used for anti-entropy comparison
+// between replicas. `pkSum` only covers the primary key columns in `pkColIDs` and the handle, so it keeps stable
+// when non-PK columns change. `rowSum` covers all the added columns and the handle.
+// The columns are folded in the ascending order of the column ids, so the checksums do not depend on the order the
+// columns are added in.
+func (b *EncodeRowBuffer) PKAndRowChecksum(pkColIDs []int64, handle kv.Handle) (pkSum, rowSum uint32, err error) {
+	if err = b.evalLazyColVals(); err != nil {
+		return 0, 0, err
+	}
+	var buf []byte
+	for _, i := range b.colOffsetsByID() {
+		colID := b.colIDs[i]
+		buf = codec.EncodeVarint(buf[:0], colID)
+		if buf, err = tablecodec.EncodeValue(time.UTC, buf, b.row[i]); err != nil {
+			return 0, 0, err
+		}
+		rowSum = crc32.Update(rowSum, crc32.IEEETable, buf)
+		if slices.Contains(pkColIDs, colID) {
+			pkSum = crc32.Update(pkSum, crc32.IEEETable, buf)
+		}
+	}
+	if handle != nil {
+		pkSum = crc32.Update(pkSum, crc32.IEEETable, handle.Encoded())
+		rowSum = crc32.Update(rowSum, crc32.IEEETable, handle.Encoded())
+	}
+	return pkSum, rowSum, nil
+}
+
+// ColumnChecksum computes a checksum of the added columns in the ascending order of the column ids.
+// Like the column level checksum of `rowcodec.RowData`, the NULL columns are skipped, so a row with an explicit NULL
+// column has the same checksum as the row omitting the column. If `nullAware` is true, the ids of the NULL columns
+// are also folded into the checksum to tell the two rows apart.
+func (b *EncodeRowBuffer) ColumnChecksum(nullAware bool) (uint32, error) {
+	if err := b.evalLazyColVals(); err != nil {
+		return 0, err
+	}
+	order := b.colOffsetsByID()
+
+	var (
+		checksum uint32
+		nullSum  uint32
+		buf      []byte
+		err      error
+	)
+	for _, i := range order {
+		buf = codec.EncodeVarint(buf[:0], b.colIDs[i])
+		if b.row[i].IsNull() {
+			nullSum = crc32.Update(nullSum, crc32.IEEETable, buf)
+			continue
+		}
+		if buf, err = tablecodec.EncodeValue(time.UTC, buf, b.row[i]); err != nil {
+			return 0, err
+		}
+		checksum = crc32.Update(checksum, crc32.IEEETable, buf)
+	}
+	if nullAware {
+		checksum = crc32.Update(checksum, crc32.IEEETable, binary.LittleEndian.AppendUint32(buf[:0], nullSum))
+	}
+	return checksum, nil
+}
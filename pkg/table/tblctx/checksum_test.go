@@ -0,0 +1,240 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPKAndRowChecksum(t *testing.T) {
+	buffer := &EncodeRowBuffer{}
+	buffer.Reset(3)
+	buffer.AddColVal(1, types.NewIntDatum(10))
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	buffer.AddColVal(3, types.NewIntDatum(100))
+	pkSum1, rowSum1, err := buffer.PKAndRowChecksum([]int64{1}, kv.IntHandle(10))
+	require.NoError(t, err)
+
+	// the checksums should be deterministic
+	pkSum, rowSum, err := buffer.PKAndRowChecksum([]int64{1}, kv.IntHandle(10))
+	require.NoError(t, err)
+	require.Equal(t, pkSum1, pkSum)
+	require.Equal(t, rowSum1, rowSum)
+
+	// change the non-PK columns
+	buffer.Reset(3)
+	buffer.AddColVal(1, types.NewIntDatum(10))
+	buffer.AddColVal(2, types.NewStringDatum("abd"))
+	buffer.AddColVal(3, types.NewIntDatum(100))
+	pkSum2, rowSum2, err := buffer.PKAndRowChecksum([]int64{1}, kv.IntHandle(10))
+	require.NoError(t, err)
+	require.Equal(t, pkSum1, pkSum2)
+	require.NotEqual(t, rowSum1, rowSum2)
+
+	// change the PK column
+	buffer.Reset(3)
+	buffer.AddColVal(1, types.NewIntDatum(11))
+	buffer.AddColVal(2, types.NewStringDatum("abd"))
+	buffer.AddColVal(3, types.NewIntDatum(100))
+	pkSum3, rowSum3, err := buffer.PKAndRowChecksum([]int64{1}, kv.IntHandle(11))
+	require.NoError(t, err)
+	require.NotEqual(t, pkSum2, pkSum3)
+	require.NotEqual(t, rowSum2, rowSum3)
+
+	// the order the columns are added in does not matter
+	buffer.Reset(3)
+	buffer.AddColVal(3, types.NewIntDatum(100))
+	buffer.AddColVal(1, types.NewIntDatum(11))
+	buffer.AddColVal(2, types.NewStringDatum("abd"))
+	pkSum, rowSum, err = buffer.PKAndRowChecksum([]int64{1}, kv.IntHandle(11))
+	require.NoError(t, err)
+	require.Equal(t, pkSum3, pkSum)
+	require.Equal(t, rowSum3, rowSum)
+}
+
+func TestEncodeRowBufferRewriteChecksum(t *testing.T) {
+	colIDs := []int64{1, 2, 3}
+	row := []types.Datum{types.NewIntDatum(10), types.NewStringDatum("abc"), types.NewDatum(nil)}
+	encode := func(checksum rowcodec.Checksum) []byte {
+		encoded, err := (&rowcodec.Encoder{Enable: true}).Encode(time.UTC, colIDs, row, checksum, nil)
+		require.NoError(t, err)
+		return encoded
+	}
+	cfg := RowEncodingConfig{IsRowLevelChecksumEnabled: true, RowEncoder: &rowcodec.Encoder{Enable: true}}
+	buffer := &EncodeRowBuffer{}
+
+	existing := encode(rowcodec.RawChecksum{Handle: kv.IntHandle(1)})
+	rewritten, err := buffer.RewriteChecksum(existing, kv.IntHandle(2), cfg)
+	require.NoError(t, err)
+	// the checksum should be updated
+	require.NotEqual(t, existing, rewritten)
+	require.Equal(t, encode(rowcodec.RawChecksum{Handle: kv.IntHandle(2)}), rewritten)
+	// the data should be unchanged
+	offsets, err := rowcodec.ColumnOffsets(existing)
+	require.NoError(t, err)
+	rewrittenOffsets, err := rowcodec.ColumnOffsets(rewritten)
+	require.NoError(t, err)
+	require.Equal(t, offsets, rewrittenOffsets)
+	for _, loc := range offsets {
+		require.Equal(t, existing[loc[0]:loc[0]+loc[1]], rewritten[loc[0]:loc[0]+loc[1]])
+	}
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+		3: types.NewFieldType(mysql.TypeLonglong),
+	}
+	decoded, err := tablecodec.DecodeRowToDatumMap(rewritten, fts, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, map[int64]types.Datum{1: row[0], 2: row[1], 3: {}}, decoded)
+	// the existing value should not be modified
+	require.Equal(t, encode(rowcodec.RawChecksum{Handle: kv.IntHandle(1)}), existing)
+
+	// the row without checksum
+	rewritten, err = buffer.RewriteChecksum(encode(nil), kv.IntHandle(2), cfg)
+	require.NoError(t, err)
+	require.Equal(t, encode(rowcodec.RawChecksum{Handle: kv.IntHandle(2)}), rewritten)
+
+	_, err = buffer.RewriteChecksum(existing, kv.IntHandle(2), RowEncodingConfig{RowEncoder: cfg.RowEncoder})
+	require.ErrorContains(t, err, "row level checksum to be enabled")
+	oldFormat, err := tablecodec.EncodeOldRow(time.UTC, row, colIDs, nil, nil)
+	require.NoError(t, err)
+	_, err = buffer.RewriteChecksum(oldFormat, kv.IntHandle(2), cfg)
+	require.ErrorContains(t, err, "new row format")
+}
+
+func TestVerifyEncodedChecksum(t *testing.T) {
+	stmtBufs, ctx := newMockMutateCtx()
+	buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+	buffer.AddColVal(1, types.NewIntDatum(10))
+	buffer.AddColVal(2, types.NewStringDatum("abc"))
+	buffer.AddColVal(3, types.NewDatum(nil))
+	cfg := RowEncodingConfig{IsRowLevelChecksumEnabled: true, RowEncoder: &rowcodec.Encoder{Enable: true}}
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Once()
+	require.NoError(t, buffer.WriteMemBufferEncoded(
+		cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+	))
+	encoded := slices.Clone(stmtBufs.RowValBuf)
+
+	ok, err := VerifyEncodedChecksum(encoded, kv.IntHandle(1))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = VerifyEncodedChecksum(encoded, kv.IntHandle(2))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// a tampered byte of the column data or the checksum should be detected
+	offsets, err := rowcodec.ColumnOffsets(encoded)
+	require.NoError(t, err)
+	for _, pos := range []int{offsets[2][0], len(encoded) - 1} {
+		tampered := slices.Clone(encoded)
+		tampered[pos] ^= 0x01
+		ok, err = VerifyEncodedChecksum(tampered, kv.IntHandle(1))
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+
+	// the row without checksum
+	noChecksum, err := (&rowcodec.Encoder{Enable: true}).Encode(time.UTC, []int64{1}, types.MakeDatums(10), nil, nil)
+	require.NoError(t, err)
+	_, err = VerifyEncodedChecksum(noChecksum, kv.IntHandle(1))
+	require.ErrorContains(t, err, "no checksum")
+	// the old row format of binlog
+	binlogRow, err := buffer.EncodeBinlogRowData(time.UTC, errctx.StrictNoWarningContext)
+	require.NoError(t, err)
+	_, err = VerifyEncodedChecksum(binlogRow, kv.IntHandle(1))
+	require.ErrorContains(t, err, "new row format")
+}
+
+func TestEncodeRowBufferChecksumVersion(t *testing.T) {
+	stmtBufs, ctx := newMockMutateCtx()
+	dec := rowcodec.NewDatumMapDecoder([]rowcodec.ColInfo{
+		{ID: 1, Ft: types.NewFieldType(mysql.TypeLonglong)},
+		{ID: 2, Ft: types.NewFieldType(mysql.TypeVarchar)},
+	}, time.UTC)
+	memBuffer := &mockMemBuffer{}
+	memBuffer.On("Set", kv.Key("key1"), mock.Anything).Return(nil).Twice()
+	for _, enabled := range []bool{false, true} {
+		buffer := ctx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		cfg := RowEncodingConfig{IsRowLevelChecksumEnabled: enabled, RowEncoder: &rowcodec.Encoder{Enable: true}}
+		require.NoError(t, buffer.WriteMemBufferEncoded(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, kv.Key("key1"), kv.IntHandle(1),
+		))
+		row, err := dec.DecodeToDatumMap(stmtBufs.RowValBuf, nil)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{1: types.NewIntDatum(1), 2: types.NewStringDatum("abc")}, row)
+
+		checksum, ok := dec.GetChecksum()
+		require.Equal(t, enabled, ok)
+		// the extra checksum only exists in the legacy column level checksum, which is never written
+		_, ok = dec.GetExtraChecksum()
+		require.False(t, ok)
+		if !enabled {
+			require.Zero(t, checksum)
+			continue
+		}
+		// the raw checksum of the handle, which is the latest version
+		require.Equal(t, 2, dec.ChecksumVersion())
+		verified, err := VerifyEncodedChecksum(stmtBufs.RowValBuf, kv.IntHandle(1))
+		require.NoError(t, err)
+		require.True(t, verified)
+	}
+	memBuffer.AssertExpectations(t)
+}
+
+func TestEncodeRowBufferColumnChecksum(t *testing.T) {
+	checksum := func(nullAware bool, cols map[int64]types.Datum, order ...int64) uint32 {
+		buffer := &EncodeRowBuffer{}
+		buffer.Reset(len(cols))
+		for _, colID := range order {
+			buffer.AddColVal(colID, cols[colID])
+		}
+		sum, err := buffer.ColumnChecksum(nullAware)
+		require.NoError(t, err)
+		return sum
+	}
+	withNull := map[int64]types.Datum{1: types.NewIntDatum(1), 2: {}, 3: types.NewStringDatum("abc")}
+	withoutNull := map[int64]types.Datum{1: types.NewIntDatum(1), 3: types.NewStringDatum("abc")}
+
+	// the checksum does not depend on the order of the columns
+	require.Equal(t, checksum(false, withNull, 1, 2, 3), checksum(false, withNull, 3, 2, 1))
+	require.Equal(t, checksum(true, withNull, 1, 2, 3), checksum(true, withNull, 3, 2, 1))
+
+	// NULL columns are skipped by default
+	require.Equal(t, checksum(false, withNull, 1, 2, 3), checksum(false, withoutNull, 1, 3))
+	// an explicit NULL column is different from the omitted column in the null aware mode
+	require.NotEqual(t, checksum(true, withNull, 1, 2, 3), checksum(true, withoutNull, 1, 3))
+	// the ids of the NULL columns matter in the null aware mode
+	require.NotEqual(t, checksum(true, withNull, 1, 2, 3), checksum(true, map[int64]types.Datum{
+		1: types.NewIntDatum(1), 3: types.NewStringDatum("abc"), 4: {},
+	}, 1, 3, 4))
+	// the values still matter
+	require.NotEqual(t, checksum(true, withoutNull, 1, 3), checksum(true, map[int64]types.Datum{
+		1: types.NewIntDatum(2), 3: types.NewStringDatum("abc"),
+	}, 1, 3))
+}
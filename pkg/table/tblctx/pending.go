@@ -0,0 +1,248 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"slices"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/codec"
+)
+
+// pendingFormatVersion is the version of the format of `MutateBuffers.MarshalPending`.
+const pendingFormatVersion byte = 1
+
+// MarshalPending serializes the columns added to the buffer to encode a row but not written yet, so that a crashed
+// write can be resumed by `UnmarshalPending`. It is used by the experimental recovery.
+// The datums are serialized with their kinds, collations, lengths and fracs, so they are restored exactly.
+// It returns an error if there are lazy columns not evaluated yet or a value of an unsupported kind.
+func (b *MutateBuffers) MarshalPending() ([]byte, error) {
+	buffer := b.encodeRow
+	if len(buffer.lazyCols) > 0 {
+		return nil, errors.New("the pending row has lazy columns not evaluated yet, which can not be marshaled")
+	}
+	data := []byte{pendingFormatVersion}
+	data = codec.EncodeUvarint(data, uint64(len(buffer.colIDs)))
+	for i, colID := range buffer.colIDs {
+		data = codec.EncodeVarint(data, colID)
+		var err error
+		if data, err = marshalPendingDatum(data, &buffer.row[i]); err != nil {
+			return nil, errors.Annotatef(err, "failed to marshal the pending column %d", colID)
+		}
+	}
+	return data, nil
+}
+
+// UnmarshalPending restores the columns serialized by `MarshalPending` to the buffer to encode a row, which is reset
+// before restoring. Get the restored buffer by `PendingEncodeRowBuffer` to continue the write.
+func (b *MutateBuffers) UnmarshalPending(data []byte) error {
+	if len(data) == 0 || data[0] != pendingFormatVersion {
+		return errors.New("invalid pending row, unknown format version")
+	}
+	data, count, err := codec.DecodeUvarint(data[1:])
+	if err != nil {
+		return err
+	}
+	buffer := b.encodeRow
+	buffer.Reset(int(count))
+	for i := uint64(0); i < count; i++ {
+		var colID int64
+		if data, colID, err = codec.DecodeVarint(data); err != nil {
+			return err
+		}
+		var val types.Datum
+		if data, val, err = unmarshalPendingDatum(data); err != nil {
+			return errors.Annotatef(err, "failed to unmarshal the pending column %d", colID)
+		}
+		buffer.AddColVal(colID, val)
+	}
+	if len(data) > 0 {
+		return errors.Errorf("invalid pending row, %d trailing bytes", len(data))
+	}
+	return nil
+}
+
+// PendingEncodeRowBuffer returns the buffer to encode a row without resetting it, which is used to continue the
+// write restored by `UnmarshalPending`. Use `GetEncodeRowBufferWithCap` to start a new row.
+func (b *MutateBuffers) PendingEncodeRowBuffer() *EncodeRowBuffer {
+	return b.encodeRow
+}
+
+// marshalPendingDatum appends the datum to `data` for `MarshalPending`, which is the kind, the collation,
+// the length, the frac and the value depending on the kind.
+func marshalPendingDatum(data []byte, d *types.Datum) ([]byte, error) {
+	data = append(data, d.Kind())
+	data = codec.EncodeCompactBytes(data, []byte(d.Collation()))
+	data = codec.EncodeVarint(data, int64(d.Length()))
+	data = codec.EncodeVarint(data, int64(d.Frac()))
+	switch d.Kind() {
+	case types.KindNull:
+	case types.KindInt64:
+		data = codec.EncodeVarint(data, d.GetInt64())
+	case types.KindUint64:
+		data = codec.EncodeUvarint(data, d.GetUint64())
+	case types.KindFloat32, types.KindFloat64:
+		data = codec.EncodeFloat(data, d.GetFloat64())
+	case types.KindString, types.KindBytes, types.KindBinaryLiteral, types.KindMysqlBit:
+		data = codec.EncodeCompactBytes(data, d.GetBytes())
+	case types.KindMysqlDecimal:
+		data = codec.EncodeCompactBytes(data, d.GetMysqlDecimal().ToString())
+	case types.KindMysqlTime:
+		t := d.GetMysqlTime()
+		packed, err := t.ToPackedUint()
+		if err != nil {
+			return nil, err
+		}
+		data = codec.EncodeUvarint(data, packed)
+		data = append(data, t.Type())
+		data = codec.EncodeVarint(data, int64(t.Fsp()))
+	case types.KindMysqlDuration:
+		dur := d.GetMysqlDuration()
+		data = codec.EncodeVarint(data, int64(dur.Duration))
+		data = codec.EncodeVarint(data, int64(dur.Fsp))
+	case types.KindMysqlEnum:
+		e := d.GetMysqlEnum()
+		data = codec.EncodeCompactBytes(data, []byte(e.Name))
+		data = codec.EncodeUvarint(data, e.Value)
+	case types.KindMysqlSet:
+		s := d.GetMysqlSet()
+		data = codec.EncodeCompactBytes(data, []byte(s.Name))
+		data = codec.EncodeUvarint(data, s.Value)
+	case types.KindMysqlJSON:
+		j := d.GetMysqlJSON()
+		data = append(data, j.TypeCode)
+		data = codec.EncodeCompactBytes(data, j.Value)
+	default:
+		return nil, errors.Errorf("unsupported kind %d", d.Kind())
+	}
+	return data, nil
+}
+
+// unmarshalPendingDatum decodes a datum appended by `marshalPendingDatum` and returns the remaining data.
+func unmarshalPendingDatum(data []byte) ([]byte, types.Datum, error) {
+	var d types.Datum
+	if len(data) == 0 {
+		return nil, d, errors.New("insufficient bytes to decode the kind")
+	}
+	kind := data[0]
+	data, collation, err := codec.DecodeCompactBytes(data[1:])
+	if err != nil {
+		return nil, d, err
+	}
+	data, length, err := codec.DecodeVarint(data)
+	if err != nil {
+		return nil, d, err
+	}
+	data, frac, err := codec.DecodeVarint(data)
+	if err != nil {
+		return nil, d, err
+	}
+	switch kind {
+	case types.KindNull:
+	case types.KindInt64:
+		var v int64
+		data, v, err = codec.DecodeVarint(data)
+		d.SetInt64(v)
+	case types.KindUint64:
+		var v uint64
+		data, v, err = codec.DecodeUvarint(data)
+		d.SetUint64(v)
+	case types.KindFloat32, types.KindFloat64:
+		var v float64
+		data, v, err = codec.DecodeFloat(data)
+		if kind == types.KindFloat32 {
+			d.SetFloat32FromF64(v)
+		} else {
+			d.SetFloat64(v)
+		}
+	case types.KindString, types.KindBytes, types.KindBinaryLiteral, types.KindMysqlBit:
+		var v []byte
+		data, v, err = codec.DecodeCompactBytes(data)
+		switch kind {
+		case types.KindString:
+			d.SetString(string(v), "")
+		case types.KindBytes:
+			d.SetBytes(slices.Clone(v))
+		case types.KindBinaryLiteral:
+			d.SetBinaryLiteral(slices.Clone(v))
+		default:
+			d.SetMysqlBit(slices.Clone(v))
+		}
+	case types.KindMysqlDecimal:
+		var v []byte
+		if data, v, err = codec.DecodeCompactBytes(data); err == nil {
+			dec := new(types.MyDecimal)
+			err = dec.FromString(v)
+			d.SetMysqlDecimal(dec)
+		}
+	case types.KindMysqlTime:
+		var packed uint64
+		var fsp int64
+		if data, packed, err = codec.DecodeUvarint(data); err != nil {
+			break
+		}
+		if len(data) == 0 {
+			err = errors.New("insufficient bytes to decode the time type")
+			break
+		}
+		tp := data[0]
+		if data, fsp, err = codec.DecodeVarint(data[1:]); err != nil {
+			break
+		}
+		var t types.Time
+		if err = t.FromPackedUint(packed); err == nil {
+			t.SetType(tp)
+			t.SetFsp(int(fsp))
+			d.SetMysqlTime(t)
+		}
+	case types.KindMysqlDuration:
+		var dur, fsp int64
+		if data, dur, err = codec.DecodeVarint(data); err == nil {
+			data, fsp, err = codec.DecodeVarint(data)
+			d.SetMysqlDuration(types.Duration{Duration: time.Duration(dur), Fsp: int(fsp)})
+		}
+	case types.KindMysqlEnum, types.KindMysqlSet:
+		var name []byte
+		var value uint64
+		if data, name, err = codec.DecodeCompactBytes(data); err == nil {
+			data, value, err = codec.DecodeUvarint(data)
+			if kind == types.KindMysqlEnum {
+				d.SetMysqlEnum(types.Enum{Name: string(name), Value: value}, "")
+			} else {
+				d.SetMysqlSet(types.Set{Name: string(name), Value: value}, "")
+			}
+		}
+	case types.KindMysqlJSON:
+		if len(data) == 0 {
+			err = errors.New("insufficient bytes to decode the json type code")
+			break
+		}
+		var v []byte
+		typeCode := data[0]
+		data, v, err = codec.DecodeCompactBytes(data[1:])
+		d.SetMysqlJSON(types.BinaryJSON{TypeCode: typeCode, Value: slices.Clone(v)})
+	default:
+		err = errors.Errorf("unsupported kind %d", kind)
+	}
+	if err != nil {
+		return nil, types.Datum{}, err
+	}
+	d.SetCollation(string(collation))
+	d.SetLength(int(length))
+	d.SetFrac(int(frac))
+	return data, d, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/sessionctx/variable"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutateBuffersMarshalPending(t *testing.T) {
+	json, err := types.ParseBinaryJSONFromString(`{"a": [1, "abc"]}`)
+	require.NoError(t, err)
+	tm := types.NewTime(types.FromDate(2021, 1, 2, 3, 4, 5, 6), mysql.TypeTimestamp, 6)
+	float32Datum := types.NewFloat32Datum(1.5)
+	decimalDatum := types.NewDecimalDatum(types.NewDecFromStringForTest("-123.4500"))
+	decimalDatum.SetLength(10)
+	decimalDatum.SetFrac(4)
+	row := []types.Datum{
+		types.NewDatum(nil),
+		types.NewIntDatum(-1),
+		types.NewUintDatum(math.MaxUint64),
+		float32Datum,
+		types.NewFloat64Datum(-2.25),
+		types.NewCollationStringDatum("abc", "utf8mb4_general_ci"),
+		types.NewBytesDatum([]byte{0, 1, 2}),
+		types.NewMysqlBitDatum(types.NewBinaryLiteralFromUint(5, 1)),
+		decimalDatum,
+		types.NewTimeDatum(tm),
+		types.NewDurationDatum(types.Duration{Duration: -time.Hour - time.Millisecond, Fsp: 3}),
+		types.NewCollateMysqlEnumDatum(types.Enum{Name: "b", Value: 2}, "utf8mb4_bin"),
+		types.NewMysqlSetDatum(types.Set{Name: "a,c", Value: 5}, "utf8mb4_bin"),
+		types.NewJSONDatum(json),
+	}
+	buffers := NewMutateBuffers(&variable.WriteStmtBufs{})
+	buffer := buffers.GetEncodeRowBufferWithCap(len(row))
+	for i, val := range row {
+		buffer.AddColVal(int64(i+1), val)
+	}
+	data, err := buffers.MarshalPending()
+	require.NoError(t, err)
+
+	// the columns are restored to another buffers, which discards the columns added before
+	restored := NewMutateBuffers(&variable.WriteStmtBufs{})
+	restored.GetEncodeRowBufferWithCap(1).AddColVal(100, types.NewIntDatum(100))
+	require.NoError(t, restored.UnmarshalPending(data))
+	require.Equal(t, buffer.colIDs, restored.PendingEncodeRowBuffer().colIDs)
+	require.Equal(t, buffer.row, restored.PendingEncodeRowBuffer().row)
+	// the restored datums do not reference the data
+	clear(data)
+	require.Equal(t, buffer.row, restored.PendingEncodeRowBuffer().row)
+
+	// the restored row can be written
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}}
+	expected, err := buffers.PendingEncodeRowBuffer().WriteMemBufferEncodedReturning(
+		cfg, time.UTC, errctx.StrictNoWarningContext, discardMemBuffer{}, kv.Key("key"), kv.IntHandle(1),
+	)
+	require.NoError(t, err)
+	actual, err := restored.PendingEncodeRowBuffer().WriteMemBufferEncodedReturning(
+		cfg, time.UTC, errctx.StrictNoWarningContext, discardMemBuffer{}, kv.Key("key"), kv.IntHandle(1),
+	)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// an empty row
+	buffers.GetEncodeRowBufferWithCap(0)
+	data, err = buffers.MarshalPending()
+	require.NoError(t, err)
+	require.NoError(t, restored.UnmarshalPending(data))
+	require.Empty(t, restored.PendingEncodeRowBuffer().colIDs)
+
+	// the lazy columns can not be marshaled
+	buffers.GetEncodeRowBufferWithCap(1).AddLazyColVal(1, func() (types.Datum, error) {
+		return types.NewIntDatum(1), nil
+	})
+	_, err = buffers.MarshalPending()
+	require.ErrorContains(t, err, "lazy columns")
+
+	// invalid data
+	require.ErrorContains(t, restored.UnmarshalPending(nil), "unknown format version")
+	require.ErrorContains(t, restored.UnmarshalPending([]byte{pendingFormatVersion, 1}), "insufficient")
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"sync"
+
+	"github.com/pingcap/tidb/pkg/sessionctx/variable"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/intest"
+)
+
+// releaseForPool resets the buffer before it is put back to the pool, and drops the values of the last row kept in
+// the inner slices and the reused row, see `EncodeRowBuffer.releaseForPool`.
+func (b *CheckRowBuffer) releaseForPool() {
+	b.Reset(0)
+	clear(b.rowToCheck[:cap(b.rowToCheck)])
+	b.mutRow, b.mutRowKinds = chunk.MutRow{}, b.mutRowKinds[:0]
+	b.ClearDeferredChecks()
+	b.reuse = reuseStats{}
+}
+
+var mutateBuffersPool = sync.Pool{
+	New: func() any {
+		return &MutateBuffers{
+			encodeRow: &EncodeRowBuffer{},
+			checkRow:  &CheckRowBuffer{},
+		}
+	},
+}
+
+// AcquireMutateBuffers gets a `MutateBuffers` from the pool, which refs the `stmtBufs`.
+// It should be returned to the pool by `ReleaseMutateBuffers` after use, see `WithMutateBuffers`.
+func AcquireMutateBuffers(stmtBufs *variable.WriteStmtBufs) *MutateBuffers {
+	intest.AssertNotNil(stmtBufs)
+	buffers := mutateBuffersPool.Get().(*MutateBuffers)
+	buffers.stmtBufs = stmtBufs
+	buffers.encodeRow.writeStmtBufs = stmtBufs
+	return buffers
+}
+
+// ReleaseMutateBuffers returns the `MutateBuffers` acquired by `AcquireMutateBuffers` to the pool.
+// The buffers should not be used after release.
+func ReleaseMutateBuffers(buffers *MutateBuffers) {
+	// do not hold the session buffers in the pool
+	buffers.stmtBufs = nil
+	buffers.encodeRow.writeStmtBufs = nil
+	buffers.encodeRow.releaseForPool()
+	// the pair buffers own their `WriteStmtBufs`, so they can be kept in the pool
+	for _, buffer := range buffers.encodeRowPair {
+		if buffer != nil {
+			buffer.releaseForPool()
+			clear(buffer.writeStmtBufs.AddRowValues[:cap(buffer.writeStmtBufs.AddRowValues)])
+			clear(buffer.writeStmtBufs.IndexValsBuf[:cap(buffer.writeStmtBufs.IndexValsBuf)])
+		}
+	}
+	buffers.checkRow.releaseForPool()
+	mutateBuffersPool.Put(buffers)
+}
+
+// releaseForPool resets the buffer and its modes before it is put back to the pool. The datums kept in the inner
+// slices are cleared including the spare capacity, so the pooled buffer does not keep the values of the last rows
+// alive, e.g. the strings sharing the memory of the caller, or the closures of the lazy values.
+func (b *EncodeRowBuffer) releaseForPool() {
+	b.Reset(0)
+	clear(b.row[:cap(b.row)])
+	clear(b.lazyCols[:cap(b.lazyCols)])
+	clear(b.encodeToValues[:cap(b.encodeToValues)])
+	clear(b.indexVals[:cap(b.indexVals)])
+	clear(b.filteredRow[:cap(b.filteredRow)])
+	b.faultInjector = nil
+	b.copyOnAdd = false
+	b.setInternStrings(false)
+	b.reuse = reuseStats{}
+}
+
+// WithMutateBuffers acquires a `MutateBuffers` from the pool and runs `fn` with it.
+// The buffers are always returned to the pool after `fn` returns, even if `fn` panics,
+// so `fn` should not keep the buffers after it returns.
+func WithMutateBuffers(stmtBufs *variable.WriteStmtBufs, fn func(*MutateBuffers) error) error {
+	buffers := AcquireMutateBuffers(stmtBufs)
+	defer ReleaseMutateBuffers(buffers)
+	return fn(buffers)
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/sessionctx/variable"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/chunk"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMutateBuffers(t *testing.T) {
+	stmtBufs := &variable.WriteStmtBufs{}
+	var acquired *MutateBuffers
+	err := WithMutateBuffers(stmtBufs, func(buffers *MutateBuffers) error {
+		acquired = buffers
+		require.Same(t, stmtBufs, buffers.GetWriteStmtBufs())
+		buffer := buffers.GetEncodeRowBufferWithCap(1)
+		require.Same(t, stmtBufs, buffer.writeStmtBufs)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		return errors.New("mock error")
+	})
+	require.EqualError(t, err, "mock error")
+	// the buffers are released and do not ref the session buffers any more
+	require.Nil(t, acquired.stmtBufs)
+	require.Nil(t, acquired.encodeRow.writeStmtBufs)
+	require.Empty(t, acquired.encodeRow.colIDs)
+
+	// the buffers should be released after fn panics
+	acquired = nil
+	require.PanicsWithValue(t, "mock panic", func() {
+		_ = WithMutateBuffers(stmtBufs, func(buffers *MutateBuffers) error {
+			acquired = buffers
+			buffers.GetCheckRowBufferWithCap(1).AddColVal(types.NewIntDatum(1))
+			panic("mock panic")
+		})
+	})
+	require.NotNil(t, acquired)
+	require.Nil(t, acquired.stmtBufs)
+	require.Nil(t, acquired.encodeRow.writeStmtBufs)
+	require.Empty(t, acquired.checkRow.rowToCheck)
+}
+
+func TestReleaseMutateBuffersClearsDatums(t *testing.T) {
+	buffers := AcquireMutateBuffers(&variable.WriteStmtBufs{})
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: false}}
+	buffer := buffers.GetEncodeRowBufferWithCap(2)
+	buffer.AddColVal(1, types.NewStringDatum("abc"))
+	buffer.AddLazyColVal(2, func() (types.Datum, error) { return types.NewIntDatum(1), nil })
+	_, err := buffer.EncodeTo(cfg, time.UTC, errctx.StrictNoWarningContext, nil)
+	require.NoError(t, err)
+	first, _ := buffers.GetEncodeRowBufferPair()
+	first.AddColVal(1, types.NewStringDatum("def"))
+	first.writeStmtBufs.AddRowValues = append(first.writeStmtBufs.AddRowValues, types.NewStringDatum("ghi"))
+	checkRow := buffers.GetCheckRowBufferWithCap(1)
+	checkRow.AddColVal(types.NewStringDatum("jkl"))
+	checkRow.GetRowToCheck()
+
+	ReleaseMutateBuffers(buffers)
+	isCleared := func(datums []types.Datum) bool {
+		return !slices.ContainsFunc(datums[:cap(datums)], func(d types.Datum) bool { return !d.IsNull() })
+	}
+	require.True(t, isCleared(buffers.encodeRow.row))
+	require.True(t, isCleared(buffers.encodeRow.encodeToValues))
+	require.Nil(t, buffers.encodeRow.lazyCols[:cap(buffers.encodeRow.lazyCols)][0].fn)
+	require.True(t, isCleared(first.row))
+	require.True(t, isCleared(first.writeStmtBufs.AddRowValues))
+	require.True(t, isCleared(buffers.checkRow.rowToCheck))
+	require.Equal(t, chunk.MutRow{}, buffers.checkRow.mutRow)
+}
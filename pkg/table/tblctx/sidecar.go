@@ -0,0 +1,215 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/meta/model"
+	"github.com/pingcap/tidb/pkg/util/codec"
+)
+
+// rowSidecarFlag is the first byte of the row values with an embedded `RowSidecar`. It never starts a plain row value,
+// which starts with `rowcodec.CodecVer` in the new row format, or with the flag of a datum in the old row format.
+const rowSidecarFlag byte = 0xfd
+
+// sidecarVersion is the version of the layout of the sidecar, which should be bumped once the layout changes.
+const sidecarVersion byte = 1
+
+// sidecarFlagIntent is set in the flag byte of the sidecar of an intent written by `WriteIntent`.
+const sidecarFlagIntent byte = 1
+
+// RowSidecar is the metadata of a row embedded in the row value by `WriteWithSidecar` or `WriteIntent`, which is
+// enabled by `RowEncodingConfig.EmbedRowSidecar`. The sidecar is a part of the value, so it is removed with the row,
+// and it is cleared once the row is written again without it, e.g. by `UpdateRecord`.
+// The layout of the value is `rowSidecarFlag`, the version, a flag byte, the schema state, the count of the columns
+// with the expiry, the column id and the expiry in unix nanoseconds of each column, and then the encoded row.
+type RowSidecar struct {
+	// Intent indicates the row is an intent of the application-level two-phase protocol, see `CommitIntent`.
+	Intent bool
+	// SchemaState is the schema state the row is written under, see `EncodeRowBuffer.SetSchemaState`.
+	SchemaState byte
+	// ColumnTTLs is the expiry of the columns in UTC, see `EncodeRowBuffer.SetColumnTTL`.
+	// It is nil if no column has an expiry.
+	ColumnTTLs map[int64]time.Time
+}
+
+// isEmpty returns whether the sidecar carries nothing but the defaults, so it needs not to be embedded.
+func (s *RowSidecar) isEmpty() bool {
+	return !s.Intent && s.SchemaState == DefaultSchemaState && len(s.ColumnTTLs) == 0
+}
+
+func appendSidecar(buf []byte, intent bool, state byte, ttls []columnTTL) []byte {
+	var flag byte
+	if intent {
+		flag |= sidecarFlagIntent
+	}
+	buf = append(buf, rowSidecarFlag, sidecarVersion, flag, state)
+	buf = codec.EncodeUvarint(buf, uint64(len(ttls)))
+	for _, ttl := range ttls {
+		buf = codec.EncodeVarint(buf, ttl.colID)
+		buf = codec.EncodeVarint(buf, ttl.expireAt.UnixNano())
+	}
+	return buf
+}
+
+// SplitRowSidecar splits the row value `val` into the `RowSidecar` embedded by `WriteWithSidecar` or `WriteIntent`
+// and the encoded row, which can be decoded as a plain row value. If no sidecar is embedded, it returns the default
+// one, that is, the row is not an intent, is written under `DefaultSchemaState` and has no expiry, and `val` as is.
+func SplitRowSidecar(val []byte) (sidecar RowSidecar, row []byte, err error) {
+	if len(val) == 0 || val[0] != rowSidecarFlag {
+		return RowSidecar{SchemaState: DefaultSchemaState}, val, nil
+	}
+	if len(val) < 4 {
+		return RowSidecar{}, nil, errors.New("invalid row sidecar, insufficient bytes to decode the header")
+	}
+	if val[1] != sidecarVersion {
+		return RowSidecar{}, nil, errors.Errorf("invalid row sidecar, unknown version %d", val[1])
+	}
+	sidecar = RowSidecar{Intent: val[2]&sidecarFlagIntent != 0, SchemaState: val[3]}
+	row, count, err := codec.DecodeUvarint(val[4:])
+	if err != nil {
+		return RowSidecar{}, nil, err
+	}
+	if count > 0 {
+		sidecar.ColumnTTLs = make(map[int64]time.Time, count)
+	}
+	for i := uint64(0); i < count; i++ {
+		var colID, expireAt int64
+		if row, colID, err = codec.DecodeVarint(row); err != nil {
+			return RowSidecar{}, nil, err
+		}
+		if row, expireAt, err = codec.DecodeVarint(row); err != nil {
+			return RowSidecar{}, nil, err
+		}
+		sidecar.ColumnTTLs[colID] = time.Unix(0, expireAt).UTC()
+	}
+	return sidecar, row, nil
+}
+
+// GetRowSidecar returns the `RowSidecar` embedded in the value of the row of `key`, see `SplitRowSidecar`.
+// It returns `kv.ErrNotExist` if the row does not exist.
+func GetRowSidecar(ctx context.Context, getter kv.Getter, key kv.Key) (RowSidecar, error) {
+	val, err := getter.Get(ctx, key)
+	if err != nil {
+		return RowSidecar{}, err
+	}
+	sidecar, _, err := SplitRowSidecar(val)
+	return sidecar, err
+}
+
+// WriteWithSidecar is similar to `WriteMemBufferEncoded`, but it embeds the `RowSidecar` of the schema state set by
+// `SetSchemaState` and the expiry of the columns set by `SetColumnTTL` in the row value. The row is written as a plain
+// row value if the sidecar is the default one. It requires `RowEncodingConfig.EmbedRowSidecar`, because the value
+// with a sidecar can only be decoded after `SplitRowSidecar`.
+func (b *EncodeRowBuffer) WriteWithSidecar(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+	memBuffer kv.MemBuffer, key kv.Key, handle kv.Handle, flags ...kv.FlagsOp,
+) error {
+	return b.writeWithSidecar(cfg, loc, ec, memBuffer, key, handle, false, flags...)
+}
+
+// WriteIntent is similar to `WriteWithSidecar`, but the sidecar marks the row as an intent of the application-level
+// two-phase protocol, and the intent should be rewritten to the final value by `CommitIntent` in the commit step.
+func (b *EncodeRowBuffer) WriteIntent(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+	memBuffer kv.MemBuffer, key kv.Key, handle kv.Handle, flags ...kv.FlagsOp,
+) error {
+	return b.writeWithSidecar(cfg, loc, ec, memBuffer, key, handle, true, flags...)
+}
+
+func (b *EncodeRowBuffer) writeWithSidecar(
+	cfg RowEncodingConfig, loc *time.Location, ec errctx.Context,
+	memBuffer kv.MemBuffer, key kv.Key, handle kv.Handle, intent bool, flags ...kv.FlagsOp,
+) error {
+	if !cfg.EmbedRowSidecar {
+		return errors.New("writing the row sidecar requires RowEncodingConfig.EmbedRowSidecar to be enabled")
+	}
+	encoded, err := b.encodeForWrite(cfg, loc, ec, key, handle)
+	if err != nil {
+		return err
+	}
+
+	state := DefaultSchemaState
+	if b.hasSchemaState {
+		state = b.schemaState
+	}
+	if intent || state != DefaultSchemaState || len(b.colTTLs) > 0 {
+		b.sidecarBuf = appendSidecar(b.sidecarBuf[:0], intent, state, b.colTTLs)
+		b.sidecarBuf = append(b.sidecarBuf, encoded...)
+		encoded = b.sidecarBuf
+	}
+	return b.setEncoded(cfg, memBuffer, key, encoded, flags...)
+}
+
+// CommitIntent commits the intent written by `WriteIntent` to the row of `key`, that is, it rewrites the row value
+// with the intent flag cleared, and the row is written as a plain row value if nothing else is left in the sidecar.
+// It returns an error if the row is not an intent.
+func CommitIntent(ctx context.Context, memBuffer kv.MemBuffer, key kv.Key) error {
+	val, err := memBuffer.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	sidecar, row, err := SplitRowSidecar(val)
+	if err != nil {
+		return err
+	}
+	if !sidecar.Intent {
+		return errors.Errorf("the row of key %s is not an intent", key)
+	}
+	sidecar.Intent = false
+	if sidecar.isEmpty() {
+		return memBuffer.Set(key, row)
+	}
+	ttls := make([]columnTTL, 0, len(sidecar.ColumnTTLs))
+	for colID, expireAt := range sidecar.ColumnTTLs {
+		ttls = append(ttls, columnTTL{colID: colID, expireAt: expireAt})
+	}
+	committed := appendSidecar(make([]byte, 0, len(val)), false, sidecar.SchemaState, ttls)
+	return memBuffer.Set(key, append(committed, row...))
+}
+
+// columnTTL is the expiry of a column set by `EncodeRowBuffer.SetColumnTTL`.
+type columnTTL struct {
+	colID    int64
+	expireAt time.Time
+}
+
+// SetColumnTTL records that the value of the column `colID` expires at `expireAt`, which is embedded in the sidecar
+// by `WriteWithSidecar`. Setting the expiry of a column again overwrites it. The expiry is cleared by `Reset`.
+func (b *EncodeRowBuffer) SetColumnTTL(colID int64, expireAt time.Time) {
+	for i := range b.colTTLs {
+		if b.colTTLs[i].colID == colID {
+			b.colTTLs[i].expireAt = expireAt
+			return
+		}
+	}
+	b.colTTLs = append(b.colTTLs, columnTTL{colID: colID, expireAt: expireAt})
+}
+
+// DefaultSchemaState is the schema state of the row written without `SetSchemaState` or without a sidecar, that is,
+// the row is regarded as written under the public schema.
+const DefaultSchemaState = byte(model.StatePublic)
+
+// SetSchemaState sets the schema state the row is written under, which is usually a `model.SchemaState` during an
+// online schema change, and is embedded in the sidecar by `WriteWithSidecar` to help the backfill reconcile the rows
+// written in the transition. The state is cleared by `Reset`.
+func (b *EncodeRowBuffer) SetSchemaState(state byte) {
+	b.schemaState, b.hasSchemaState = state, true
+}
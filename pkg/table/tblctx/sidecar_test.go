@@ -0,0 +1,226 @@
+// Copyright 2024 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tblctx
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/errctx"
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/meta/model"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeRowBufferWriteIntent(t *testing.T) {
+	ctx := context.Background()
+	memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+	}
+	key := tablecodec.EncodeRecordKey(tablecodec.GenTableRecordPrefix(1), kv.IntHandle(1))
+	for _, newFormat := range []bool{true, false} {
+		_, mutateCtx := newMockMutateCtx()
+		cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: newFormat}}
+		buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(2)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+
+		// the sidecar must be enabled
+		require.ErrorContains(t, buffer.WriteIntent(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+		), "EmbedRowSidecar")
+		require.Empty(t, memBuffer.values)
+
+		cfg.EmbedRowSidecar = true
+		require.NoError(t, buffer.WriteIntent(cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1)))
+		plain := slices.Clone(mutateCtx.GetMutateBuffers().GetWriteStmtBufs().RowValBuf)
+
+		// the intent is embedded in the row value
+		val, err := memBuffer.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, rowSidecarFlag, val[0])
+		sidecar, row, err := SplitRowSidecar(val)
+		require.NoError(t, err)
+		require.Equal(t, RowSidecar{Intent: true, SchemaState: DefaultSchemaState}, sidecar)
+		require.Equal(t, plain, row)
+		decoded, err := tablecodec.DecodeRowToDatumMap(row, fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]types.Datum{1: types.NewIntDatum(1), 2: types.NewStringDatum("abc")}, decoded)
+
+		// the commit step rewrites the intent to the plain row with nothing else left in the sidecar
+		require.NoError(t, CommitIntent(ctx, memBuffer, key))
+		committed, err := memBuffer.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, plain, committed)
+
+		// committing twice is an error
+		require.ErrorContains(t, CommitIntent(ctx, memBuffer, key), "is not an intent")
+
+		// the commit step keeps the rest of the sidecar
+		buffer.SetSchemaState(byte(model.StateWriteOnly))
+		require.NoError(t, buffer.WriteIntent(cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1)))
+		require.NoError(t, CommitIntent(ctx, memBuffer, key))
+		committed, err = memBuffer.Get(ctx, key)
+		require.NoError(t, err)
+		sidecar, row, err = SplitRowSidecar(committed)
+		require.NoError(t, err)
+		require.Equal(t, RowSidecar{SchemaState: byte(model.StateWriteOnly)}, sidecar)
+		require.Equal(t, plain, row)
+		require.NoError(t, memBuffer.Delete(key))
+	}
+	require.True(t, kv.ErrNotExist.Equal(CommitIntent(ctx, memBuffer, key)))
+}
+
+func TestEncodeRowBufferWriteWithSidecar(t *testing.T) {
+	ctx := context.Background()
+	fts := map[int64]*types.FieldType{
+		1: types.NewFieldType(mysql.TypeLonglong),
+		2: types.NewFieldType(mysql.TypeVarchar),
+		3: types.NewFieldType(mysql.TypeLonglong),
+	}
+	require.Equal(t, byte(model.StatePublic), DefaultSchemaState)
+	expire1 := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	expire2 := time.Date(2030, 6, 7, 8, 9, 10, 0, time.UTC)
+	key := tablecodec.EncodeRecordKey(tablecodec.GenTableRecordPrefix(1), kv.IntHandle(1))
+
+	for _, newFormat := range []bool{true, false} {
+		memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+		_, mutateCtx := newMockMutateCtx()
+		cfg := RowEncodingConfig{
+			RowEncoder: &rowcodec.Encoder{Enable: newFormat}, VerifyAfterWrite: true, EmbedRowSidecar: true,
+		}
+		buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(3)
+		buffer.AddColVal(1, types.NewIntDatum(1))
+		buffer.AddColVal(2, types.NewStringDatum("abc"))
+		buffer.AddColVal(3, types.NewDatum(nil))
+		buffer.SetColumnTTL(1, expire2)
+		// setting the expiry of a column again overwrites it
+		buffer.SetColumnTTL(1, expire1.In(time.FixedZone("UTC+8", 8*3600)))
+		buffer.SetColumnTTL(2, expire2)
+		buffer.SetSchemaState(byte(model.StateWriteOnly))
+		require.NoError(t, buffer.WriteWithSidecar(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+		))
+		require.Equal(t, 1, buffer.NullColumnCount())
+
+		// the expiry and the schema state are combined in the sidecar, followed by the row
+		val, err := memBuffer.Get(ctx, key)
+		require.NoError(t, err)
+		sidecar, row, err := SplitRowSidecar(val)
+		require.NoError(t, err)
+		require.Equal(t, RowSidecar{
+			SchemaState: byte(model.StateWriteOnly),
+			ColumnTTLs:  map[int64]time.Time{1: expire1, 2: expire2},
+		}, sidecar)
+		require.Equal(t, mutateCtx.GetMutateBuffers().GetWriteStmtBufs().RowValBuf, row)
+		decoded, err := tablecodec.DecodeRowToDatumMap(row, fts, time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, types.NewIntDatum(1), decoded[1])
+		require.Equal(t, types.NewStringDatum("abc"), decoded[2])
+		got, err := GetRowSidecar(ctx, memBuffer, key)
+		require.NoError(t, err)
+		require.Equal(t, sidecar, got)
+
+		// the row is verified after write
+		faulty := &corruptMemBuffer{mapMemBuffer{values: make(map[string][]byte)}}
+		require.ErrorContains(t, buffer.WriteWithSidecar(
+			cfg, time.UTC, errctx.StrictNoWarningContext, faulty, key, kv.IntHandle(1),
+		), "mismatches the written one")
+
+		// the expiry and the schema state are cleared by reset, and the row is written as a plain row value
+		buffer.Reset(1)
+		buffer.AddColVal(1, types.NewIntDatum(2))
+		require.NoError(t, buffer.WriteWithSidecar(
+			cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+		))
+		require.Equal(t, 0, buffer.NullColumnCount())
+		val, err = memBuffer.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, mutateCtx.GetMutateBuffers().GetWriteStmtBufs().RowValBuf, val)
+		sidecar, row, err = SplitRowSidecar(val)
+		require.NoError(t, err)
+		require.Equal(t, RowSidecar{SchemaState: DefaultSchemaState}, sidecar)
+		require.Equal(t, val, row)
+	}
+
+	// the truncated or unknown sidecars are errors
+	_, _, err := SplitRowSidecar([]byte{rowSidecarFlag, sidecarVersion, 0})
+	require.Error(t, err)
+	_, _, err = SplitRowSidecar([]byte{rowSidecarFlag, sidecarVersion + 1, 0, 0, 0})
+	require.ErrorContains(t, err, "unknown version")
+	_, _, err = SplitRowSidecar([]byte{rowSidecarFlag, sidecarVersion, 0, 0, 1})
+	require.Error(t, err)
+}
+
+func TestEncodeRowBufferSidecarClearedWithRow(t *testing.T) {
+	ctx := context.Background()
+	key := tablecodec.EncodeRecordKey(tablecodec.GenTableRecordPrefix(1), kv.IntHandle(1))
+	cfg := RowEncodingConfig{RowEncoder: &rowcodec.Encoder{Enable: true}, EmbedRowSidecar: true}
+	for _, c := range []struct {
+		name string
+		set  func(buffer *EncodeRowBuffer)
+	}{
+		{"column ttl", func(buffer *EncodeRowBuffer) {
+			buffer.SetColumnTTL(1, time.Date(2030, 6, 7, 8, 9, 10, 0, time.UTC))
+		}},
+		{"schema state", func(buffer *EncodeRowBuffer) {
+			buffer.SetSchemaState(byte(model.StateWriteReorganization))
+		}},
+	} {
+		memBuffer := &mapMemBuffer{values: make(map[string][]byte)}
+		_, mutateCtx := newMockMutateCtx()
+		buffer := mutateCtx.GetMutateBuffers().GetEncodeRowBufferWithCap(1)
+		write := func(val int64, withSidecar bool) {
+			buffer.Reset(1)
+			buffer.AddColVal(1, types.NewIntDatum(val))
+			if withSidecar {
+				c.set(buffer)
+				require.NoError(t, buffer.WriteWithSidecar(
+					cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+				), c.name)
+				return
+			}
+			// `UpdateRecord` writes the row by `WriteMemBufferEncoded`
+			require.NoError(t, buffer.WriteMemBufferEncoded(
+				cfg, time.UTC, errctx.StrictNoWarningContext, memBuffer, key, kv.IntHandle(1),
+			), c.name)
+		}
+
+		// updating the row without the sidecar clears it
+		write(1, true)
+		sidecar, err := GetRowSidecar(ctx, memBuffer, key)
+		require.NoError(t, err, c.name)
+		require.False(t, sidecar.isEmpty(), c.name)
+		write(2, false)
+		sidecar, err = GetRowSidecar(ctx, memBuffer, key)
+		require.NoError(t, err, c.name)
+		require.Equal(t, RowSidecar{SchemaState: DefaultSchemaState}, sidecar, c.name)
+
+		// deleting the row removes the sidecar with it, like `RemoveRecord`
+		write(3, true)
+		require.NoError(t, memBuffer.Delete(key), c.name)
+		require.Empty(t, memBuffer.values, c.name)
+		_, err = GetRowSidecar(ctx, memBuffer, key)
+		require.True(t, kv.ErrNotExist.Equal(err), c.name)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/pingcap/tidb/pkg/meta/model"
 	"github.com/pingcap/tidb/pkg/sessionctx/stmtctx"
 	"github.com/pingcap/tidb/pkg/sessionctx/variable"
+	"github.com/pingcap/tidb/pkg/types"
 	"github.com/pingcap/tidb/pkg/util/rowcodec"
 	"github.com/pingcap/tidb/pkg/util/tableutil"
 )
@@ -33,6 +34,27 @@ type RowEncodingConfig struct {
 	IsRowLevelChecksumEnabled bool
 	// RowEncoder is used to encode a row
 	RowEncoder *rowcodec.Encoder
+	// ValidateUTF8 indicates whether to validate the string values of the columns in `UTF8Columns`
+	// before encoding. It is used in strict mode to reject the invalid byte sequences.
+	ValidateUTF8 bool
+	// UTF8Columns maps the ids of the columns declared with the utf8mb4 charset to their names.
+	UTF8Columns map[int64]string
+	// CheckNotNull indicates whether to check that no NULL value is written to the columns in `NotNullColumns`.
+	// If it is false, the check is only done as an assertion in the test.
+	CheckNotNull bool
+	// NotNullColumns maps the ids of the NOT NULL columns to their names.
+	NotNullColumns map[int64]string
+	// Transforms maps the column ids to the functions transforming their values before encoding, for example,
+	// trimming or case-folding the strings. The transforms are applied before all the validations, and each value
+	// is transformed once even if the row is encoded more than once.
+	Transforms map[int64]func(types.Datum) (types.Datum, error)
+	// VerifyAfterWrite indicates whether to read the row back from the memBuffer after writing it and check
+	// that the bytes match the written ones. It is used to catch the bugs of the memBuffer early.
+	VerifyAfterWrite bool
+	// EmbedRowSidecar indicates whether the rows can be written with a `RowSidecar` embedded in the value, see
+	// `EncodeRowBuffer.WriteWithSidecar`. The value with a sidecar can only be decoded after `SplitRowSidecar`,
+	// so it should only be enabled when all the readers of the table strip the sidecar.
+	EmbedRowSidecar bool
 }
 
 // StatisticsSupport is used for statistics update operations.
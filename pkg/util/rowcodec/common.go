@@ -37,6 +37,7 @@ var (
 	errInvalidCodecVer    = errors.New("invalid codec version")
 	errInvalidChecksumVer = errors.New("invalid checksum version")
 	errInvalidChecksumTyp = errors.New("invalid type for checksum")
+	errNoChecksum         = errors.New("no checksum in the row")
 )
 
 // First byte in the encoded value which specifies the encoding type.
@@ -260,8 +260,14 @@ func (c RawChecksum) encode(encoder *Encoder, buf []byte) ([]byte, error) {
 	encoder.checksumHeader |= checksumVersionRawHandle // set checksum version
 	valueBytes := encoder.toBytes(buf)
 	valueBytes = append(valueBytes, encoder.checksumHeader)
-	encoder.checksum1 = crc32.Checksum(valueBytes, crc32.IEEETable)
-	encoder.checksum1 = crc32.Update(encoder.checksum1, crc32.IEEETable, c.Handle.Encoded())
+	encoder.checksum1 = rawHandleChecksum(valueBytes, c.Handle)
 	valueBytes = binary.LittleEndian.AppendUint32(valueBytes, encoder.checksum1)
 	return valueBytes, nil
 }
+
+// rawHandleChecksum calculates the bytes-level checksum of the row value `valueBytes`, which ends with the checksum
+// header, and the encoded `handle`. It's shared by `RawChecksum`, `RewriteRawChecksum` and `VerifyRawChecksum`.
+func rawHandleChecksum(valueBytes []byte, handle kv.Handle) uint32 {
+	checksum := crc32.Checksum(valueBytes, crc32.IEEETable)
+	return crc32.Update(checksum, crc32.IEEETable, handle.Encoded())
+}
@@ -233,6 +233,70 @@ func (r *row) findColID(colID int64) (idx int, isNil, notFound bool) {
 	return
 }
 
+// ColumnOffsets returns the positions of the values of the not-null columns in `rowData` encoded in the new row format.
+// The key of the result is the column id, and the value is the start offset and the length of the column value.
+// The null columns are not included because they have no value bytes.
+func ColumnOffsets(rowData []byte) (map[int64][2]int, error) {
+	var r row
+	if err := r.fromBytes(rowData); err != nil {
+		return nil, err
+	}
+	// the data follows the header, the column ids and the offsets.
+	dataStart := 6
+	if r.large() {
+		dataStart += int(r.numNotNullCols+r.numNullCols)*4 + int(r.numNotNullCols)*4
+	} else {
+		dataStart += int(r.numNotNullCols+r.numNullCols) + int(r.numNotNullCols)*2
+	}
+	offsets := make(map[int64][2]int, r.numNotNullCols)
+	for i := 0; i < int(r.numNotNullCols); i++ {
+		var colID int64
+		if r.large() {
+			colID = int64(r.colIDs32[i])
+		} else {
+			colID = int64(r.colIDs[i])
+		}
+		start, end := r.getOffsets(i)
+		offsets[colID] = [2]int{dataStart + int(start), int(end - start)}
+	}
+	return offsets, nil
+}
+
+// RewriteRawChecksum re-encodes `rowData` encoded in the new row format with the bytes-level checksum of the
+// latest version calculated by `handle`, like `RawChecksum`. The existing checksums are replaced, and the column
+// data is kept unchanged. The result is appended to `buf`.
+func RewriteRawChecksum(rowData []byte, handle kv.Handle, buf []byte) ([]byte, error) {
+	var r row
+	if err := r.fromBytes(rowData); err != nil {
+		return nil, err
+	}
+	r.flags |= rowFlagChecksum
+	r.checksumHeader = checksumVersionRawHandle
+	start := len(buf)
+	buf = r.toBytes(buf)
+	buf = append(buf, r.checksumHeader)
+	return binary.LittleEndian.AppendUint32(buf, rawHandleChecksum(buf[start:], handle)), nil
+}
+
+// VerifyRawChecksum recomputes the bytes-level checksum of `rowData` encoded in the new row format by `handle`, like
+// `RawChecksum`, and reports whether it equals to the checksum in the row. It returns `errNoChecksum` if the row has
+// no checksum, and `errInvalidChecksumVer` if the checksum of the row is not calculated by the handle.
+func VerifyRawChecksum(rowData []byte, handle kv.Handle) (bool, error) {
+	var r row
+	if err := r.fromBytes(rowData); err != nil {
+		return false, err
+	}
+	if !r.hasChecksum() {
+		return false, errNoChecksum
+	}
+	if r.ChecksumVersion() != int(checksumVersionRawHandle) {
+		return false, errInvalidChecksumVer
+	}
+	buf := r.toBytes(make([]byte, 0, len(rowData)))
+	buf = append(buf, r.checksumHeader)
+	return rawHandleChecksum(buf, handle) == r.checksum1, nil
+}
+
 // ChecksumVersion returns the version of checksum. Note that it's valid only if checksum has been encoded in the row
 // value (callers can check it by `GetChecksum`).
 func (r *row) ChecksumVersion() int { return int(r.checksumHeader & checksumMaskVersion) }